@@ -5,5 +5,6 @@ go 1.12
 require (
 	github.com/dchote/go-openal v0.0.0-20171116030048-f4a9a141d372
 	github.com/golang/protobuf v1.3.1
+	gopkg.in/yaml.v2 v2.4.0
 	layeh.com/gopus v0.0.0-20161224163843-0ebf989153aa
 )
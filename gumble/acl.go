@@ -20,14 +20,19 @@ type ACL struct {
 func (a *ACL) writeMessage(client *Client) error {
 	packet := MumbleProto.ACL{
 		ChannelId:   &a.Channel.ID,
-		Groups:      make([]*MumbleProto.ACL_ChanGroup, len(a.Groups)),
-		Acls:        make([]*MumbleProto.ACL_ChanACL, len(a.Rules)),
+		Groups:      make([]*MumbleProto.ACL_ChanGroup, 0, len(a.Groups)),
+		Acls:        make([]*MumbleProto.ACL_ChanACL, 0, len(a.Rules)),
 		InheritAcls: &a.Inherits,
 		Query:       proto.Bool(false),
 	}
 
-	for i, group := range a.Groups {
-		packet.Groups[i] = &MumbleProto.ACL_ChanGroup{
+	for _, group := range a.Groups {
+		// Inherited groups that have not been modified are not part of the
+		// channel's ACL.
+		if group.Inherited && group.InheritUsers && group.Inheritable && len(group.UsersAdd) == 0 && len(group.UsersRemove) == 0 {
+			continue
+		}
+		packetGroup := &MumbleProto.ACL_ChanGroup{
 			Name:        &group.Name,
 			Inherit:     &group.InheritUsers,
 			Inheritable: &group.Inheritable,
@@ -35,26 +40,32 @@ func (a *ACL) writeMessage(client *Client) error {
 			Remove:      make([]uint32, 0, len(group.UsersRemove)),
 		}
 		for _, user := range group.UsersAdd {
-			packet.Groups[i].Add = append(packet.Groups[i].Add, user.UserID)
+			packetGroup.Add = append(packetGroup.Add, user.UserID)
 		}
 		for _, user := range group.UsersRemove {
-			packet.Groups[i].Remove = append(packet.Groups[i].Remove, user.UserID)
+			packetGroup.Remove = append(packetGroup.Remove, user.UserID)
 		}
+		packet.Groups = append(packet.Groups, packetGroup)
 	}
 
-	for i, rule := range a.Rules {
-		packet.Acls[i] = &MumbleProto.ACL_ChanACL{
+	for _, rule := range a.Rules {
+		// Inherited rules belong to the ACL of a parent channel.
+		if rule.Inherited {
+			continue
+		}
+		packetRule := &MumbleProto.ACL_ChanACL{
 			ApplyHere: &rule.AppliesCurrent,
 			ApplySubs: &rule.AppliesChildren,
 			Grant:     proto.Uint32(uint32(rule.Granted)),
 			Deny:      proto.Uint32(uint32(rule.Denied)),
 		}
 		if rule.User != nil {
-			packet.Acls[i].UserId = &rule.User.UserID
+			packetRule.UserId = &rule.User.UserID
 		}
 		if rule.Group != nil {
-			packet.Acls[i].Group = &rule.Group.Name
+			packetRule.Group = &rule.Group.Name
 		}
+		packet.Acls = append(packet.Acls, packetRule)
 	}
 
 	return client.Conn.WriteProto(&packet)
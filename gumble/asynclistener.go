@@ -0,0 +1,333 @@
+package gumble
+
+import (
+	"sync"
+)
+
+// AsyncOverflow specifies what happens when an event is dispatched to an
+// asynchronous listener whose queue is full.
+type AsyncOverflow int
+
+// Asynchronous listener overflow behaviors.
+const (
+	// Block the client's event dispatching (and therefore network reads) until
+	// the listener has made room in its queue.
+	AsyncOverflowBlock AsyncOverflow = iota
+	// Discard the event being dispatched.
+	AsyncOverflowDropNewest
+	// Discard the oldest event in the queue to make room for the event being
+	// dispatched.
+	AsyncOverflowDropOldest
+)
+
+// AsyncDefaultQueueSize is the default queue size of asynchronous listeners.
+const AsyncDefaultQueueSize = 64
+
+// AsyncOptions configures an asynchronous listener.
+type AsyncOptions struct {
+	// The maximum number of events waiting to be processed by the listener.
+	// If zero, AsyncDefaultQueueSize is used.
+	QueueSize int
+	// What to do when an event is dispatched while the queue is full.
+	Overflow AsyncOverflow
+	// If non-nil, called with each event that is discarded because the queue
+	// was full. It is called from the client's event goroutine, so it must not
+	// block.
+	OnDrop func(event interface{})
+}
+
+// AttachAsync adds a new event listener to the end of the current list of
+// listeners. Unlike Attach, the listener's methods are not called
+// synchronously; events are added to a bounded queue and delivered, in order,
+// from a separate goroutine. This means a slow listener does not block
+// network reads (unless options.Overflow is AsyncOverflowBlock and the queue
+// is full).
+//
+// Users and channels referenced by the events are copies of the state at the
+// time of the event, so they can be read without calling Client.Do, and they
+// do not reflect later changes. They are not the same pointers as the ones in
+// Client.Users and Client.Channels, so they should be compared by session or
+// ID. Maps in the copies (e.g. Channel.Users) contain the live objects.
+//
+// After the returned Detacher is called, no new events are queued; events that
+// were already queued are still delivered.
+func (e *Listeners) AttachAsync(listener EventListener, options AsyncOptions) Detacher {
+	return e.attachAsync(listener, options, nil)
+}
+
+// attachAsync is like AttachAsync, but events for which filter (if non-nil)
+// returns false are discarded before they are queued.
+func (e *Listeners) attachAsync(listener EventListener, options AsyncOptions, filter func(Event) bool) Detacher {
+	if options.QueueSize <= 0 {
+		options.QueueSize = AsyncDefaultQueueSize
+	}
+	a := &asyncListener{
+		listener: listener,
+		options:  options,
+		filter:   filter,
+	}
+	a.cond = sync.NewCond(&a.mu)
+	a.item = e.Attach(a)
+	return a
+}
+
+// AttachAsync is an alias of c.Listeners.AttachAsync.
+func (c *Config) AttachAsync(l EventListener, options AsyncOptions) Detacher {
+	return c.Listeners.AttachAsync(l, options)
+}
+
+type asyncEvent struct {
+	event   interface{}
+	deliver func()
+}
+
+type asyncListener struct {
+	listener EventListener
+	options  AsyncOptions
+	filter   func(Event) bool
+	item     Detacher
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []asyncEvent
+	running  bool
+	detached bool
+}
+
+func (a *asyncListener) Detach() {
+	a.item.Detach()
+	a.mu.Lock()
+	a.detached = true
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// enqueue adds an event to the queue, starting the delivery goroutine if it is
+// not running.
+func (a *asyncListener) enqueue(event interface{}, deliver func()) {
+	if e, ok := event.(Event); ok && a.filter != nil && !a.filter(e) {
+		return
+	}
+	var dropped []interface{}
+
+	a.mu.Lock()
+	for !a.detached && len(a.queue) >= a.options.QueueSize {
+		if a.options.Overflow == AsyncOverflowDropNewest {
+			a.mu.Unlock()
+			if a.options.OnDrop != nil {
+				a.options.OnDrop(event)
+			}
+			return
+		}
+		if a.options.Overflow == AsyncOverflowDropOldest {
+			dropped = append(dropped, a.queue[0].event)
+			a.queue[0] = asyncEvent{}
+			a.queue = a.queue[1:]
+			continue
+		}
+		a.cond.Wait()
+	}
+	if a.detached {
+		a.mu.Unlock()
+		return
+	}
+	a.queue = append(a.queue, asyncEvent{
+		event:   event,
+		deliver: deliver,
+	})
+	if !a.running {
+		a.running = true
+		go a.run()
+	}
+	a.mu.Unlock()
+
+	if a.options.OnDrop != nil {
+		for _, event := range dropped {
+			a.options.OnDrop(event)
+		}
+	}
+}
+
+// run delivers queued events until the queue is empty.
+func (a *asyncListener) run() {
+	for {
+		a.mu.Lock()
+		if len(a.queue) == 0 {
+			a.running = false
+			a.mu.Unlock()
+			return
+		}
+		item := a.queue[0]
+		a.queue[0] = asyncEvent{}
+		a.queue = a.queue[1:]
+		a.cond.Broadcast()
+		a.mu.Unlock()
+
+		item.deliver()
+	}
+}
+
+func (a *asyncListener) OnConnect(e *ConnectEvent) {
+	event := *e
+	a.enqueue(&event, func() { a.listener.OnConnect(&event) })
+}
+
+func (a *asyncListener) OnDisconnect(e *DisconnectEvent) {
+	event := *e
+	a.enqueue(&event, func() { a.listener.OnDisconnect(&event) })
+}
+
+func (a *asyncListener) OnTextMessage(e *TextMessageEvent) {
+	event := *e
+	event.Sender = event.Sender.snapshot()
+	event.Users = snapshotUsers(event.Users)
+	event.Channels = snapshotChannels(event.Channels)
+	event.Trees = snapshotChannels(event.Trees)
+	a.enqueue(&event, func() { a.listener.OnTextMessage(&event) })
+}
+
+func (a *asyncListener) OnUserChange(e *UserChangeEvent) {
+	event := *e
+	event.User = event.User.snapshot()
+	event.Actor = event.Actor.snapshot()
+	a.enqueue(&event, func() { a.listener.OnUserChange(&event) })
+}
+
+func (a *asyncListener) OnChannelChange(e *ChannelChangeEvent) {
+	event := *e
+	event.Channel = event.Channel.snapshot()
+	a.enqueue(&event, func() { a.listener.OnChannelChange(&event) })
+}
+
+func (a *asyncListener) OnPermissionDenied(e *PermissionDeniedEvent) {
+	event := *e
+	event.Channel = event.Channel.snapshot()
+	event.User = event.User.snapshot()
+	a.enqueue(&event, func() { a.listener.OnPermissionDenied(&event) })
+}
+
+func (a *asyncListener) OnUserList(e *UserListEvent) {
+	event := *e
+	a.enqueue(&event, func() { a.listener.OnUserList(&event) })
+}
+
+func (a *asyncListener) OnACL(e *ACLEvent) {
+	event := *e
+	if event.ACL != nil {
+		acl := *event.ACL
+		acl.Channel = acl.Channel.snapshot()
+		event.ACL = &acl
+	}
+	a.enqueue(&event, func() { a.listener.OnACL(&event) })
+}
+
+func (a *asyncListener) OnBanList(e *BanListEvent) {
+	event := *e
+	a.enqueue(&event, func() { a.listener.OnBanList(&event) })
+}
+
+func (a *asyncListener) OnContextActionChange(e *ContextActionChangeEvent) {
+	event := *e
+	if event.ContextAction != nil {
+		contextAction := *event.ContextAction
+		event.ContextAction = &contextAction
+	}
+	a.enqueue(&event, func() { a.listener.OnContextActionChange(&event) })
+}
+
+func (a *asyncListener) OnServerConfig(e *ServerConfigEvent) {
+	event := *e
+	a.enqueue(&event, func() { a.listener.OnServerConfig(&event) })
+}
+
+// snapshot returns a copy of the user. The user's channel and stats are also
+// copied.
+func (u *User) snapshot() *User {
+	if u == nil {
+		return nil
+	}
+	user := *u
+	user.Channel = u.Channel.snapshot()
+	if u.Stats != nil {
+		stats := *u.Stats
+		user.Stats = &stats
+	}
+	return &user
+}
+
+// snapshot returns a copy of the channel. The channel's parents are also
+// copied, and its maps are replaced with copies that contain the same values.
+//
+// The parents are copied iteratively, and each channel is copied only once, so
+// that a parent cycle (which a misbehaving server can create) is preserved in
+// the copies instead of causing unbounded recursion.
+func (c *Channel) snapshot() *Channel {
+	if c == nil {
+		return nil
+	}
+	copies := make(map[*Channel]*Channel)
+	var first, previous *Channel
+	for channel := c; channel != nil; channel = channel.Parent {
+		if copied := copies[channel]; copied != nil {
+			previous.Parent = copied
+			break
+		}
+		copied := channel.copy()
+		copies[channel] = copied
+		if previous == nil {
+			first = copied
+		} else {
+			previous.Parent = copied
+		}
+		previous = copied
+	}
+	return first
+}
+
+// copy returns a shallow copy of the channel, whose maps are replaced with
+// copies that contain the same values.
+func (c *Channel) copy() *Channel {
+	channel := *c
+	channel.Children = copyChannels(c.Children)
+	channel.Links = copyChannels(c.Links)
+	if c.Users != nil {
+		channel.Users = make(Users, len(c.Users))
+		for session, user := range c.Users {
+			channel.Users[session] = user
+		}
+	}
+	return &channel
+}
+
+func copyChannels(c Channels) Channels {
+	if c == nil {
+		return nil
+	}
+	channels := make(Channels, len(c))
+	for id, channel := range c {
+		channels[id] = channel
+	}
+	return channels
+}
+
+func snapshotUsers(users []*User) []*User {
+	if users == nil {
+		return nil
+	}
+	s := make([]*User, len(users))
+	for i, user := range users {
+		s[i] = user.snapshot()
+	}
+	return s
+}
+
+func snapshotChannels(channels []*Channel) []*Channel {
+	if channels == nil {
+		return nil
+	}
+	s := make([]*Channel, len(channels))
+	for i, channel := range channels {
+		s[i] = channel.snapshot()
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package gumble
+
+import (
+	"runtime"
+	"testing"
+)
+
+type blockingListener struct {
+	EventListener
+	release chan struct{}
+	events  chan *TextMessageEvent
+}
+
+func (b *blockingListener) OnTextMessage(e *TextMessageEvent) {
+	<-b.release
+	b.events <- e
+}
+
+func TestAsyncListener(t *testing.T) {
+	var dropped []string
+	listener := &blockingListener{
+		release: make(chan struct{}),
+		events:  make(chan *TextMessageEvent, 10),
+	}
+	var listeners Listeners
+	a := listeners.AttachAsync(listener, AsyncOptions{
+		QueueSize: 2,
+		Overflow:  AsyncOverflowDropOldest,
+		OnDrop: func(event interface{}) {
+			dropped = append(dropped, event.(*TextMessageEvent).Message)
+		},
+	}).(*asyncListener)
+
+	sender := &User{Name: "before"}
+	a.OnTextMessage(&TextMessageEvent{TextMessage: TextMessage{Sender: sender, Message: "1"}})
+	sender.Name = "after"
+	// Wait for the delivery goroutine to take the first event.
+	for {
+		a.mu.Lock()
+		n := len(a.queue)
+		a.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		runtime.Gosched()
+	}
+	for _, message := range []string{"2", "3", "4"} {
+		a.OnTextMessage(&TextMessageEvent{TextMessage: TextMessage{Message: message}})
+	}
+	close(listener.release)
+
+	first := <-listener.events
+	if first.Message != "1" || first.Sender.Name != "before" || first.Sender == sender {
+		t.Fatalf("unexpected first event: %q from %+v", first.Message, first.Sender)
+	}
+	received := []string{(<-listener.events).Message, (<-listener.events).Message}
+	if received[0] != "3" || received[1] != "4" || len(dropped) != 1 || dropped[0] != "2" {
+		t.Errorf("received %v, dropped %v", received, dropped)
+	}
+
+	a.Detach()
+	a.OnTextMessage(&TextMessageEvent{TextMessage: TextMessage{Message: "5"}})
+	select {
+	case e := <-listener.events:
+		t.Errorf("event %q delivered after detach", e.Message)
+	default:
+	}
+}
+
+func TestChannelSnapshotCycle(t *testing.T) {
+	a := &Channel{ID: 1, Name: "a"}
+	b := &Channel{ID: 2, Name: "b", Parent: a}
+	a.Parent = b
+	self := &Channel{ID: 3, Name: "self"}
+	self.Parent = self
+
+	s := a.snapshot()
+	if s == a || s.Parent == b || s.Parent.Name != "b" || s.Parent.Parent != s {
+		t.Fatalf("unexpected snapshot of cycle: %+v", s)
+	}
+	s = self.snapshot()
+	if s == self || s.Parent != s {
+		t.Fatalf("unexpected snapshot of self-parented channel: %+v", s)
+	}
+
+	root := &Channel{ID: 0}
+	child := &Channel{ID: 4, Parent: root}
+	s = child.snapshot()
+	if s.Parent == root || s.Parent.ID != 0 || s.Parent.Parent != nil {
+		t.Fatalf("unexpected snapshot of chain: %+v", s)
+	}
+}
@@ -1,6 +1,7 @@
 package gumble
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -61,15 +62,33 @@ func (a AudioBuffer) writeAudio(client *Client, seq int64, final bool) error {
 		defer encoder.Reset()
 	}
 	if err != nil {
+		atomic.AddUint64(&client.metrics.framesDropped, 1)
 		return err
 	}
+	atomic.AddUint64(&client.metrics.framesEncoded, 1)
+	return writeEncodedAudio(client, raw, seq, final)
+}
+
+// OpusPacket is an audio packet that has already been encoded with Opus (e.g.
+// a packet read from an Ogg Opus file). It is written to the channel returned
+// by Client.AudioOutgoingOpus.
+type OpusPacket struct {
+	Data []byte
+	// The duration of the audio in the packet.
+	Duration time.Duration
+}
 
+func writeEncodedAudio(client *Client, raw []byte, seq int64, final bool) error {
 	var targetID byte
 	if target := client.VoiceTarget; target != nil {
 		targetID = byte(target.ID)
 	}
 	// TODO: re-enable positional audio
-	return client.Conn.WriteAudio(byte(4), targetID, seq, final, raw, nil, nil, nil)
+	if err := client.Conn.WriteAudio(byte(4), targetID, seq, final, raw, nil, nil, nil); err != nil {
+		atomic.AddUint64(&client.metrics.framesDropped, 1)
+		return err
+	}
+	return nil
 }
 
 // AudioPacket contains incoming audio samples and information.
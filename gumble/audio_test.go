@@ -0,0 +1,41 @@
+package gumble
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpusSequence(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		durations []time.Duration
+		seqs      []int64
+	}{
+		{[]time.Duration{10 * ms, 10 * ms, 10 * ms}, []int64{0, 1, 2}},
+		{[]time.Duration{20 * ms, 20 * ms, 60 * ms, 10 * ms}, []int64{0, 2, 4, 10}},
+		{[]time.Duration{2500 * time.Microsecond, 2500 * time.Microsecond, 2500 * time.Microsecond, 2500 * time.Microsecond, 2500 * time.Microsecond}, []int64{0, 0, 0, 0, 1}},
+		{[]time.Duration{5 * ms, 5 * ms, 5 * ms, 5 * ms, 20 * ms, 5 * ms}, []int64{0, 0, 1, 1, 2, 4}},
+		{[]time.Duration{0, 0, 10 * ms}, []int64{0, 1, 2}},
+	}
+	for _, test := range tests {
+		var s opusSequence
+		var seqs []int64
+		for _, duration := range test.durations {
+			seqs = append(seqs, s.next(duration))
+		}
+		if !reflect.DeepEqual(seqs, test.seqs) {
+			t.Errorf("%v: got sequence %v, expected %v", test.durations, seqs, test.seqs)
+		}
+	}
+
+	// Sequence numbers wrap around.
+	s := opusSequence{elapsed: (math.MaxInt32 - 1) * AudioDefaultInterval}
+	if seq := s.next(AudioDefaultInterval); seq != math.MaxInt32-1 {
+		t.Errorf("got %d, expected %d", seq, math.MaxInt32-1)
+	}
+	if seq := s.next(AudioDefaultInterval); seq != 0 {
+		t.Errorf("got %d after wrapping around, expected 0", seq)
+	}
+}
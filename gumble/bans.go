@@ -88,12 +88,22 @@ func (b BanList) writeMessage(client *Client) error {
 	for _, ban := range b {
 		if !ban.unban {
 			maskSize, _ := ban.Mask.Size()
-			packet.Bans = append(packet.Bans, &MumbleProto.BanList_BanEntry{
+			entry := &MumbleProto.BanList_BanEntry{
 				Address:  ban.Address,
 				Mask:     proto.Uint32(uint32(maskSize)),
 				Reason:   &ban.Reason,
 				Duration: proto.Uint32(uint32(ban.Duration / time.Second)),
-			})
+			}
+			if ban.Name != "" {
+				entry.Name = proto.String(ban.Name)
+			}
+			if ban.Hash != "" {
+				entry.Hash = proto.String(ban.Hash)
+			}
+			if !ban.Start.IsZero() {
+				entry.Start = proto.String(ban.Start.UTC().Format(time.RFC3339))
+			}
+			packet.Bans = append(packet.Bans, entry)
 		}
 	}
 
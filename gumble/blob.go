@@ -0,0 +1,288 @@
+package gumble
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"time"
+
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// blobRequestDelay is how long blob requests are collected before they are
+// sent to the server in a single RequestBlob message.
+const blobRequestDelay = 10 * time.Millisecond
+
+var (
+	errUserDisconnected = errors.New("gumble: user is no longer connected")
+	errChannelRemoved   = errors.New("gumble: channel has been removed")
+	errClientClosed     = errors.New("gumble: client is disconnected")
+)
+
+// BlobCache stores blobs (user comments, user textures, and channel
+// descriptions) by their SHA-1 hash, so that they do not have to be requested
+// from the server when their hash is seen again.
+//
+// A BlobCache can be shared between multiple Clients (e.g. when reconnecting
+// to a server), so implementations must be safe for concurrent use.
+type BlobCache interface {
+	// Blob returns the blob with the given hash, or nil if it is not in the
+	// cache.
+	Blob(hash []byte) []byte
+	// SetBlob stores blob in the cache under the given hash.
+	SetBlob(hash, blob []byte)
+}
+
+// BlobRequest is a request for the actual (i.e. non-hashed) comments and
+// textures of users, and descriptions of channels. Entries that do not have
+// a hash are not requested.
+type BlobRequest struct {
+	Comments     []*User
+	Textures     []*User
+	Descriptions []*Channel
+}
+
+func (b *BlobRequest) writeMessage(client *Client) error {
+	var packet MumbleProto.RequestBlob
+	for _, user := range b.Comments {
+		if user.CommentHash != nil {
+			packet.SessionComment = append(packet.SessionComment, user.Session)
+		}
+	}
+	for _, user := range b.Textures {
+		if user.TextureHash != nil {
+			packet.SessionTexture = append(packet.SessionTexture, user.Session)
+		}
+	}
+	for _, channel := range b.Descriptions {
+		if channel.DescriptionHash != nil {
+			packet.ChannelDescription = append(packet.ChannelDescription, channel.ID)
+		}
+	}
+	if len(packet.SessionComment) == 0 && len(packet.SessionTexture) == 0 && len(packet.ChannelDescription) == 0 {
+		return nil
+	}
+	return client.Conn.WriteProto(&packet)
+}
+
+type blobKind int
+
+const (
+	blobComment blobKind = iota
+	blobTexture
+	blobDescription
+)
+
+type blobKey struct {
+	kind blobKind
+	id   uint32
+}
+
+// blobRequests batches blob requests and keeps track of the goroutines that
+// are waiting for them.
+type blobRequests struct {
+	sync.Mutex
+	client  *Client
+	waiters map[blobKey]chan struct{}
+	pending []blobKey
+	timer   *time.Timer
+}
+
+// wait returns a channel that is closed once the blob identified by kind and
+// id has been received, or its owner has gone away. If the blob has not
+// already been requested, a request is queued.
+//
+// client.volatile must be held.
+func (b *blobRequests) wait(kind blobKind, id uint32) <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+
+	key := blobKey{kind, id}
+	if ch := b.waiters[key]; ch != nil {
+		return ch
+	}
+	if b.waiters == nil {
+		b.waiters = make(map[blobKey]chan struct{})
+	}
+	ch := make(chan struct{})
+	b.waiters[key] = ch
+	b.pending = append(b.pending, key)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(blobRequestDelay, b.flush)
+	}
+	return ch
+}
+
+// resolve wakes the goroutines waiting for the given blob.
+//
+// client.volatile must be held.
+func (b *blobRequests) resolve(kind blobKind, id uint32) {
+	b.Lock()
+	defer b.Unlock()
+
+	key := blobKey{kind, id}
+	if ch := b.waiters[key]; ch != nil {
+		close(ch)
+		delete(b.waiters, key)
+	}
+}
+
+// flush sends all of the queued blob requests to the server.
+func (b *blobRequests) flush() {
+	b.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.timer = nil
+	b.Unlock()
+
+	var packet MumbleProto.RequestBlob
+	for _, key := range pending {
+		switch key.kind {
+		case blobComment:
+			packet.SessionComment = append(packet.SessionComment, key.id)
+		case blobTexture:
+			packet.SessionTexture = append(packet.SessionTexture, key.id)
+		case blobDescription:
+			packet.ChannelDescription = append(packet.ChannelDescription, key.id)
+		}
+	}
+	if len(pending) > 0 {
+		b.client.Conn.WriteProto(&packet)
+	}
+}
+
+// blobHash returns the hash that the server uses to identify blob.
+func blobHash(blob []byte) []byte {
+	hash := sha1.Sum(blob)
+	return hash[:]
+}
+
+// cachedBlob returns the blob with the given hash from the client's blob
+// cache, or nil if it is not cached.
+func (c *Client) cachedBlob(hash []byte) []byte {
+	if cache := c.Config.BlobCache; cache != nil {
+		return cache.Blob(hash)
+	}
+	return nil
+}
+
+// cacheBlob stores blob in the client's blob cache.
+func (c *Client) cacheBlob(blob []byte) {
+	if cache := c.Config.BlobCache; cache != nil && len(blob) > 0 {
+		cache.SetBlob(blobHash(blob), blob)
+	}
+}
+
+// awaitBlob blocks until ch is closed, ctx is done, or the client
+// disconnects.
+func (c *Client) awaitBlob(ctx context.Context, ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.end:
+		return errClientClosed
+	}
+}
+
+// CommentContext returns the user's comment. If only the comment's hash is
+// known, the comment is requested from the server and the method blocks until
+// it is received, ctx is done, or the user disconnects.
+//
+// This method must not be called from inside of an event listener.
+func (u *User) CommentContext(ctx context.Context) (string, error) {
+	client := u.owner
+	if client == nil {
+		return "", errUserDisconnected
+	}
+	for {
+		client.volatile.RLock()
+		// u can be a copy (e.g. from an event passed to an asynchronous
+		// listener), whose hash is never cleared, so the client's current
+		// user is read instead.
+		user := client.Users[u.Session]
+		if user == nil {
+			client.volatile.RUnlock()
+			return "", errUserDisconnected
+		}
+		if user.CommentHash == nil {
+			comment := user.Comment
+			client.volatile.RUnlock()
+			return comment, nil
+		}
+		ch := client.blobs.wait(blobComment, u.Session)
+		client.volatile.RUnlock()
+		if err := client.awaitBlob(ctx, ch); err != nil {
+			return "", err
+		}
+	}
+}
+
+// TextureContext returns the user's texture. If only the texture's hash is
+// known, the texture is requested from the server and the method blocks until
+// it is received, ctx is done, or the user disconnects.
+//
+// This method must not be called from inside of an event listener.
+func (u *User) TextureContext(ctx context.Context) ([]byte, error) {
+	client := u.owner
+	if client == nil {
+		return nil, errUserDisconnected
+	}
+	for {
+		client.volatile.RLock()
+		// u can be a copy (e.g. from an event passed to an asynchronous
+		// listener), whose hash is never cleared, so the client's current
+		// user is read instead.
+		user := client.Users[u.Session]
+		if user == nil {
+			client.volatile.RUnlock()
+			return nil, errUserDisconnected
+		}
+		if user.TextureHash == nil {
+			texture := user.Texture
+			client.volatile.RUnlock()
+			return texture, nil
+		}
+		ch := client.blobs.wait(blobTexture, u.Session)
+		client.volatile.RUnlock()
+		if err := client.awaitBlob(ctx, ch); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DescriptionContext returns the channel's description. If only the
+// description's hash is known, the description is requested from the server
+// and the method blocks until it is received, ctx is done, or the channel is
+// removed.
+//
+// This method must not be called from inside of an event listener.
+func (c *Channel) DescriptionContext(ctx context.Context) (string, error) {
+	client := c.owner
+	if client == nil {
+		return "", errChannelRemoved
+	}
+	for {
+		client.volatile.RLock()
+		// c can be a copy (e.g. from an event passed to an asynchronous
+		// listener), whose hash is never cleared, so the client's current
+		// channel is read instead.
+		channel := client.Channels[c.ID]
+		if channel == nil {
+			client.volatile.RUnlock()
+			return "", errChannelRemoved
+		}
+		if channel.DescriptionHash == nil {
+			description := channel.Description
+			client.volatile.RUnlock()
+			return description, nil
+		}
+		ch := client.blobs.wait(blobDescription, c.ID)
+		client.volatile.RUnlock()
+		if err := client.awaitBlob(ctx, ch); err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package gumble
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+type testBlobCache struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (c *testBlobCache) Blob(hash []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blobs[string(hash)]
+}
+
+func (c *testBlobCache) SetBlob(hash, blob []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[string(hash)] = blob
+}
+
+// blobClient returns a synced client with the root channel and users 1 and 2,
+// and a channel that receives the RequestBlob messages that it sends.
+func blobClient(t *testing.T) (*Client, <-chan *MumbleProto.RequestBlob) {
+	conn, server := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	requests := make(chan *MumbleProto.RequestBlob, 10)
+	go func() {
+		serverConn := NewConn(server)
+		for {
+			pType, data, err := serverConn.ReadPacket()
+			if err != nil {
+				return
+			}
+			if pType != 23 {
+				continue
+			}
+			var request MumbleProto.RequestBlob
+			if err := proto.Unmarshal(data, &request); err == nil {
+				requests <- &request
+			}
+		}
+	}()
+
+	c := &Client{
+		Config:      NewConfig(),
+		Conn:        NewConn(conn),
+		Users:       Users{},
+		Channels:    Channels{},
+		permissions: map[uint32]*Permission{},
+		state:       uint32(StateSynced),
+		end:         make(chan struct{}),
+	}
+	c.blobs.client = c
+	c.Config.BlobCache = &testBlobCache{blobs: map[string][]byte{}}
+
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), Name: proto.String("a")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), Name: proto.String("b")})
+	return c, requests
+}
+
+func TestBlobRequests(t *testing.T) {
+	c, requests := blobClient(t)
+	a, b := c.Users[1], c.Users[2]
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), CommentHash: []byte("hash-a")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), CommentHash: []byte("hash-b"), TextureHash: []byte("hash-t")})
+
+	type result struct {
+		comment string
+		texture []byte
+		err     error
+	}
+	results := make(chan result, 3)
+	go func() {
+		comment, err := a.CommentContext(context.Background())
+		results <- result{comment: comment, err: err}
+	}()
+	go func() {
+		comment, err := b.CommentContext(context.Background())
+		results <- result{comment: comment, err: err}
+	}()
+	go func() {
+		texture, err := b.TextureContext(context.Background())
+		results <- result{texture: texture, err: err}
+	}()
+
+	// The requests are sent in a single message.
+	var comments, textures []uint32
+	timeout := time.After(5 * time.Second)
+	for len(comments) < 2 || len(textures) < 1 {
+		select {
+		case request := <-requests:
+			comments = append(comments, request.SessionComment...)
+			textures = append(textures, request.SessionTexture...)
+			if len(comments) < 2 || len(textures) < 1 {
+				t.Errorf("requests were not batched: %v", request)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for blob request")
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i] < comments[j] })
+	if len(comments) != 2 || comments[0] != 1 || comments[1] != 2 || len(textures) != 1 || textures[0] != 2 {
+		t.Fatalf("unexpected request: comments %v, textures %v", comments, textures)
+	}
+
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), Comment: proto.String("comment a")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), Comment: proto.String("comment b"), Texture: []byte("texture")})
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			got[r.comment+string(r.texture)] = true
+		case <-timeout:
+			t.Fatal("timed out waiting for blob")
+		}
+	}
+	if !got["comment a"] || !got["comment b"] || !got["texture"] {
+		t.Fatalf("unexpected results: %v", got)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	c, requests := blobClient(t)
+
+	// Received blobs are cached, and used when their hash is seen again.
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), Comment: proto.String("hello")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), CommentHash: blobHash([]byte("hello"))})
+	b := c.Users[2]
+	if b.CommentHash != nil || b.Comment != "hello" {
+		t.Fatalf("cached comment not used: %q %x", b.Comment, b.CommentHash)
+	}
+	comment, err := b.CommentContext(context.Background())
+	if err != nil || comment != "hello" {
+		t.Fatalf("CommentContext() = %q, %v", comment, err)
+	}
+
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Description: proto.String("root")})
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(0), DescriptionHash: blobHash([]byte("root"))})
+	description, err := c.Channels[1].DescriptionContext(context.Background())
+	if err != nil || description != "root" {
+		t.Fatalf("DescriptionContext() = %q, %v", description, err)
+	}
+
+	select {
+	case request := <-requests:
+		t.Fatalf("unexpected request: %v", request)
+	case <-time.After(2 * blobRequestDelay):
+	}
+}
+
+func TestBlobDisconnect(t *testing.T) {
+	c, _ := blobClient(t)
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), CommentHash: []byte("hash")})
+	b := c.Users[2]
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.CommentContext(context.Background())
+		errs <- err
+	}()
+	time.Sleep(2 * blobRequestDelay)
+	handle(t, (*Client).handleUserRemove, c, &MumbleProto.UserRemove{Session: proto.Uint32(2)})
+	select {
+	case err := <-errs:
+		if err != errUserDisconnected {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CommentContext did not return")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), TextureHash: []byte("hash")})
+	if _, err := c.Users[1].TextureContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+type userChangeListener struct {
+	EventListener
+	users chan *User
+}
+
+func (l *userChangeListener) OnUserChange(e *UserChangeEvent) {
+	l.users <- e.User
+}
+
+func TestBlobAsyncListener(t *testing.T) {
+	c, requests := blobClient(t)
+	listener := &userChangeListener{users: make(chan *User, 10)}
+	c.Config.AttachAsync(listener, AsyncOptions{})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), CommentHash: []byte("hash-a")})
+
+	// Async listeners receive a copy of the user, whose hash is not cleared
+	// when the comment arrives.
+	var user *User
+	select {
+	case user = <-listener.users:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	if user == c.Users[1] {
+		t.Fatal("async listener received the client's user")
+	}
+	result := make(chan string, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		comment, err := user.CommentContext(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- comment
+	}()
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for request")
+	}
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), Comment: proto.String("hello")})
+	if comment := <-result; comment != "hello" {
+		t.Errorf("got comment %q", comment)
+	}
+	select {
+	case request := <-requests:
+		t.Errorf("comment requested again: %v", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
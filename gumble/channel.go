@@ -20,7 +20,8 @@ type Channel struct {
 	// The users currently in the channel.
 	Users Users
 	// The channel's description. Contains the empty string if the channel does
-	// not have a description, or if it needs to be requested.
+	// not have a description, or if it needs to be requested (see
+	// DescriptionContext).
 	Description string
 	// The channel's description hash. nil if Channel.Description has
 	// been populated.
@@ -35,6 +36,10 @@ type Channel struct {
 	Temporary bool
 
 	client *Client
+	// owner is the client that the channel belongs to. Unlike client, it is
+	// not cleared when the channel is removed, so it can be read without
+	// holding client.volatile.
+	owner *Client
 }
 
 // IsRoot returns true if the channel is the server's root channel.
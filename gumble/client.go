@@ -6,6 +6,7 @@ import (
 	"math"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,6 +36,11 @@ const ClientVersion = 1<<16 | 3<<8 | 0
 
 // Client is the type used to create a connection to a server.
 type Client struct {
+	// stateVersion and metrics are accessed atomically, so they must be
+	// 64-bit aligned.
+	stateVersion uint64
+	metrics      clientMetrics
+
 	// The User associated with the client.
 	Self *User
 	// The client's configuration.
@@ -72,6 +78,16 @@ type Client struct {
 	// modified.
 	volatile rpwMutex
 
+	blobs    blobRequests
+	requests requestTracker
+
+	// The most recent Snapshot, and the users and channels that have changed
+	// since it was created.
+	snapshot      atomic.Value
+	snapshotMutex sync.Mutex
+	dirtyUsers    map[uint32]bool
+	dirtyChannels map[uint32]bool
+
 	connect         chan *RejectError
 	end             chan struct{}
 	disconnectEvent DisconnectEvent
@@ -112,6 +128,8 @@ func DialWithDialer(dialer *net.Dialer, addr string, config *Config, tlsConfig *
 		connect: make(chan *RejectError),
 		end:     make(chan struct{}),
 	}
+	client.blobs.client = client
+	client.Conn.Logger = config.Logger
 
 	go client.readRoutine()
 
@@ -175,54 +193,106 @@ func (c *Client) State() State {
 // to. The channel must be closed after the audio stream is completed. Only
 // a single channel should be open at any given time (i.e. close the channel
 // before opening another).
+//
+// Frames are sent as soon as they are written to the channel; the writer must
+// pace them at Config.AudioInterval (see AudioPacer).
 func (c *Client) AudioOutgoing() chan<- AudioBuffer {
 	ch := make(chan AudioBuffer)
 	go func() {
 		var seq int64
 		previous := <-ch
 		for p := range ch {
-			previous.writeAudio(c, seq, false)
+			if err := previous.writeAudio(c, seq, false); err != nil {
+				c.Logger().Warn("gumble: failed to send audio frame", LogKeyError, err)
+			}
 			previous = p
 			seq = (seq + 1) % math.MaxInt32
 		}
 		if previous != nil {
-			previous.writeAudio(c, seq, true)
+			if err := previous.writeAudio(c, seq, true); err != nil {
+				c.Logger().Warn("gumble: failed to send audio frame", LogKeyError, err)
+			}
+		}
+	}()
+	return ch
+}
+
+// AudioOutgoingOpus is like AudioOutgoing, except that the audio written to
+// the channel is already encoded with Opus, and is sent without being
+// re-encoded. The same rules apply: the channel must be closed after the audio
+// stream is completed, only a single outgoing audio channel should be open at
+// a time, and the writer must pace the packets according to their duration.
+func (c *Client) AudioOutgoingOpus() chan<- OpusPacket {
+	ch := make(chan OpusPacket)
+	go func() {
+		var seq opusSequence
+		previous, ok := <-ch
+		if !ok {
+			return
+		}
+		for p := range ch {
+			if err := writeEncodedAudio(c, previous.Data, seq.next(previous.Duration), false); err != nil {
+				c.Logger().Warn("gumble: failed to send audio frame", LogKeyError, err)
+			}
+			previous = p
+		}
+		if err := writeEncodedAudio(c, previous.Data, seq.next(previous.Duration), true); err != nil {
+			c.Logger().Warn("gumble: failed to send audio frame", LogKeyError, err)
 		}
 	}()
 	return ch
 }
 
+// opusSequence numbers Opus packets. A sequence number corresponds to 10ms
+// of audio, so the number of a packet is the amount of audio sent before it,
+// in whole 10ms units; packets shorter than 10ms can share a number.
+type opusSequence struct {
+	elapsed time.Duration
+}
+
+// next returns the sequence number of a packet of the given duration, and
+// advances past it. Packets without a duration are counted as 10ms.
+func (s *opusSequence) next(duration time.Duration) int64 {
+	seq := int64(s.elapsed/AudioDefaultInterval) % math.MaxInt32
+	if duration <= 0 {
+		duration = AudioDefaultInterval
+	}
+	s.elapsed += duration
+	return seq
+}
+
 // pingRoutine sends ping packets to the server at regular intervals.
 func (c *Client) pingRoutine() {
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
 
-	var timestamp uint64
-	var tcpPingAvg float32
-	var tcpPingVar float32
-	packet := MumbleProto.Ping{
-		Timestamp:  &timestamp,
-		TcpPackets: &c.tcpPacketsReceived,
-		TcpPingAvg: &tcpPingAvg,
-		TcpPingVar: &tcpPingVar,
-	}
-
-	t := time.Now()
 	for {
-		timestamp = uint64(t.UnixNano())
-		tcpPingAvg = math.Float32frombits(atomic.LoadUint32(&c.tcpPingAvg))
-		tcpPingVar = math.Float32frombits(atomic.LoadUint32(&c.tcpPingVar))
-		c.Conn.WriteProto(&packet)
+		c.writePing(nil)
 
 		select {
 		case <-c.end:
 			return
-		case t = <-ticker.C:
+		case <-ticker.C:
 			// continue to top of loop
 		}
 	}
 }
 
+// logHandlerError logs err, which was returned by the handler for packets of
+// type pType.
+func logHandlerError(logger Logger, pType uint16, err error) {
+	switch err := err.(type) {
+	case *channelError:
+		logger.Warn("gumble: failed to handle packet", LogKeyPacketType, PacketTypeName(pType), LogKeyChannel, err.channel, LogKeyError, err.err)
+	default:
+		if err == errUnimplementedHandler {
+			logger.Debug("gumble: ignoring unhandled packet", LogKeyPacketType, PacketTypeName(pType))
+		} else {
+			logger.Warn("gumble: failed to handle packet", LogKeyPacketType, PacketTypeName(pType), LogKeyError, err)
+		}
+	}
+}
+
 // readRoutine reads protocol buffer messages from the server.
 func (c *Client) readRoutine() {
 	c.disconnectEvent = DisconnectEvent{
@@ -230,19 +300,29 @@ func (c *Client) readRoutine() {
 		Type:   DisconnectError,
 	}
 
+	logger := c.Logger()
+	var readErr error
 	for {
 		pType, data, err := c.Conn.ReadPacket()
 		if err != nil {
+			readErr = err
 			break
 		}
-		if int(pType) < len(handlers) {
-			handlers[pType](c, data)
+		if int(pType) >= len(handlers) {
+			logger.Debug("gumble: ignoring unknown packet", LogKeyPacketType, PacketTypeName(pType))
+			continue
+		}
+		// Audio errors are logged by handleUDPTunnel, which knows the sender.
+		if err := handlers[pType](c, data); err != nil && pType != 1 {
+			logHandlerError(logger, pType, err)
 		}
 	}
 
 	wasSynced := c.State() == StateSynced
+	logger.Info("gumble: disconnected", LogKeyReason, c.disconnectEvent.Type.logName(), LogKeyError, readErr)
 	atomic.StoreUint32(&c.state, uint32(StateDisconnected))
 	close(c.end)
+	c.closeRequests()
 	if wasSynced {
 		c.Config.Listeners.onDisconnect(&c.disconnectEvent)
 	}
@@ -275,7 +355,8 @@ func (c *Client) Disconnect() error {
 
 // Do executes f in a thread-safe manner. It ensures that Client and its
 // associated data will not be changed during the lifetime of the function
-// call.
+// call. Read-only access to users and channels can instead use Snapshot, which
+// does not block the client.
 func (c *Client) Do(f func()) {
 	c.volatile.RLock()
 	defer c.volatile.RUnlock()
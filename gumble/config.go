@@ -23,6 +23,18 @@ type Config struct {
 	// AudioDataBytes is the number of bytes that an audio frame can use.
 	AudioDataBytes int
 
+	// BlobCache, if non-nil, is used to store user comments, user textures, and
+	// channel descriptions, so that they do not need to be requested from the
+	// server again. The same cache can be used by successive Clients (e.g. when
+	// reconnecting).
+	BlobCache BlobCache
+
+	// Logger, if non-nil, receives the client's diagnostic messages: errors
+	// that cannot be returned to the caller (e.g. malformed packets and
+	// dropped audio frames) are logged at the warning level, and each packet
+	// sent and received is traced at the debug level.
+	Logger Logger
+
 	// The event listeners used when client events are triggered.
 	Listeners      Listeners
 	AudioListeners AudioListeners
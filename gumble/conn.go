@@ -23,8 +23,11 @@ type Conn struct {
 
 	MaximumPacketBytes int
 	Timeout            time.Duration
+	// If non-nil, each packet read and written is logged at the debug level.
+	Logger Logger
 
-	buffer []byte
+	buffer  []byte
+	packets *packetCounts
 }
 
 // NewConn creates a new Conn with the given net.Conn.
@@ -33,6 +36,7 @@ func NewConn(conn net.Conn) *Conn {
 		Conn:               conn,
 		Timeout:            time.Second * 20,
 		MaximumPacketBytes: 1024 * 1024 * 10,
+		packets:            &packetCounts{},
 	}
 }
 
@@ -58,6 +62,10 @@ func (c *Conn) ReadPacket() (uint16, []byte, error) {
 	if _, err := io.ReadFull(c.Conn, c.buffer[:pLengthInt]); err != nil {
 		return 0, nil, err
 	}
+	if c.packets != nil {
+		c.packets.add(c.packets.read[:], pType)
+	}
+	c.logger().Debug("gumble: packet received", LogKeyPacketType, PacketTypeName(pType), LogKeyLength, pLengthInt)
 	return pType, c.buffer[:pLengthInt], nil
 }
 
@@ -109,6 +117,10 @@ func (c *Conn) WriteAudio(format, target byte, sequence int64, final bool, data
 		}
 	}
 
+	if c.packets != nil {
+		c.packets.add(c.packets.written[:], 1)
+	}
+	c.logger().Debug("gumble: packet sent", LogKeyPacketType, PacketTypeName(1), LogKeyLength, len(header)+len(data)+positionalLength)
 	return nil
 }
 
@@ -122,6 +134,10 @@ func (c *Conn) WritePacket(ptype uint16, data []byte) error {
 	if _, err := c.Conn.Write(data); err != nil {
 		return err
 	}
+	if c.packets != nil {
+		c.packets.add(c.packets.written[:], ptype)
+	}
+	c.logger().Debug("gumble: packet sent", LogKeyPacketType, PacketTypeName(ptype), LogKeyLength, len(data))
 	return nil
 }
 
@@ -10,7 +10,8 @@ import (
 // Listener methods are executed synchronously as event happen. They also block
 // network reads from happening until all handlers for an event are called.
 // Therefore, it is not recommended to do any long processing from inside of
-// these methods.
+// these methods. Listeners that need to do so can be attached with
+// Listeners.AttachAsync instead.
 type EventListener interface {
 	OnConnect(e *ConnectEvent)
 	OnDisconnect(e *DisconnectEvent)
@@ -154,7 +155,8 @@ func (p PermissionDeniedType) Has(changeType PermissionDeniedType) bool {
 }
 
 // PermissionDeniedEvent is the event that is passed to
-// EventListener.OnPermissionDenied.
+// EventListener.OnPermissionDenied. Client.Track can be used to match the
+// event to the request that caused it.
 type PermissionDeniedEvent struct {
 	Client  *Client
 	Type    PermissionDeniedType
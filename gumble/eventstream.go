@@ -0,0 +1,262 @@
+package gumble
+
+import (
+	"context"
+	"sync"
+)
+
+// Event is one of the event types that are passed to EventListener:
+//
+//	*ConnectEvent
+//	*DisconnectEvent
+//	*TextMessageEvent
+//	*UserChangeEvent
+//	*ChannelChangeEvent
+//	*PermissionDeniedEvent
+//	*UserListEvent
+//	*ACLEvent
+//	*BanListEvent
+//	*ContextActionChangeEvent
+//	*ServerConfigEvent
+//
+// A type switch can be used to determine which event it is.
+type Event interface {
+	eventType() EventType
+}
+
+// EventType is a bitmask of event types.
+type EventType int
+
+// Event types.
+const (
+	EventConnect EventType = 1 << iota
+	EventDisconnect
+	EventTextMessage
+	EventUserChange
+	EventChannelChange
+	EventPermissionDenied
+	EventUserList
+	EventACL
+	EventBanList
+	EventContextActionChange
+	EventServerConfig
+)
+
+// Has returns true if the EventType has eventType part of its bitmask.
+func (e EventType) Has(eventType EventType) bool {
+	return e&eventType == eventType
+}
+
+func (*ConnectEvent) eventType() EventType             { return EventConnect }
+func (*DisconnectEvent) eventType() EventType          { return EventDisconnect }
+func (*TextMessageEvent) eventType() EventType         { return EventTextMessage }
+func (*UserChangeEvent) eventType() EventType          { return EventUserChange }
+func (*ChannelChangeEvent) eventType() EventType       { return EventChannelChange }
+func (*PermissionDeniedEvent) eventType() EventType    { return EventPermissionDenied }
+func (*UserListEvent) eventType() EventType            { return EventUserList }
+func (*ACLEvent) eventType() EventType                 { return EventACL }
+func (*BanListEvent) eventType() EventType             { return EventBanList }
+func (*ContextActionChangeEvent) eventType() EventType { return EventContextActionChange }
+func (*ServerConfigEvent) eventType() EventType        { return EventServerConfig }
+
+// EventFilter selects the events that are sent by Client.Events. The zero
+// value matches all events.
+type EventFilter struct {
+	// The types of events to receive. If zero, all types are received.
+	Types EventType
+	// If non-nil, only events that involve the user (compared by session) are
+	// received, e.g. changes to the user, messages sent by the user, and
+	// permission denied events about the user.
+	User *User
+	// If non-nil, only events that involve the channel (compared by ID) are
+	// received, e.g. changes to the channel, changes to users in the channel,
+	// messages sent to the channel, and the channel's ACL.
+	Channel *Channel
+}
+
+// Match returns true if the event is selected by the filter.
+func (f *EventFilter) Match(e Event) bool {
+	if f.Types != 0 && f.Types&e.eventType() == 0 {
+		return false
+	}
+	if f.User != nil {
+		if !eventHasUser(e, f.User.Session) {
+			return false
+		}
+	}
+	if f.Channel != nil {
+		if !eventHasChannel(e, f.Channel.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+func eventHasUser(e Event, session uint32) bool {
+	is := func(u *User) bool {
+		return u != nil && u.Session == session
+	}
+	switch e := e.(type) {
+	case *TextMessageEvent:
+		if is(e.Sender) {
+			return true
+		}
+		for _, user := range e.Users {
+			if is(user) {
+				return true
+			}
+		}
+	case *UserChangeEvent:
+		return is(e.User) || is(e.Actor)
+	case *PermissionDeniedEvent:
+		return is(e.User)
+	}
+	return false
+}
+
+func eventHasChannel(e Event, id uint32) bool {
+	is := func(c *Channel) bool {
+		return c != nil && c.ID == id
+	}
+	switch e := e.(type) {
+	case *TextMessageEvent:
+		for _, channel := range e.Channels {
+			if is(channel) {
+				return true
+			}
+		}
+		for _, channel := range e.Trees {
+			if is(channel) {
+				return true
+			}
+		}
+	case *UserChangeEvent:
+		return e.User != nil && is(e.User.Channel)
+	case *ChannelChangeEvent:
+		return is(e.Channel)
+	case *PermissionDeniedEvent:
+		return is(e.Channel)
+	case *ACLEvent:
+		return e.ACL != nil && is(e.ACL.Channel)
+	}
+	return false
+}
+
+// Events returns a channel that receives the client's events that match
+// filter, in the order in which they happen. The events are dispatched
+// asynchronously (see Listeners.AttachAsync), so they can be read from any
+// goroutine.
+//
+// The channel is closed, and the underlying listener detached, when ctx is
+// done or after the client's DisconnectEvent has been received. Events that
+// match filter are queued while the channel is not being read; if the queue
+// fills up (see AsyncDefaultQueueSize), the oldest event is dropped and a
+// warning is logged. Reading the channel slowly therefore never blocks the
+// client.
+func (c *Client) Events(ctx context.Context, filter EventFilter) <-chan Event {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &eventStream{
+		ctx:    ctx,
+		cancel: cancel,
+		filter: filter,
+		out:    make(chan Event),
+	}
+
+	var detacher Detacher
+	c.Do(func() {
+		detacher = c.Config.Listeners.attachAsync(s, AsyncOptions{
+			Overflow: AsyncOverflowDropOldest,
+			OnDrop: func(interface{}) {
+				c.Logger().Warn("gumble: event stream queue full, event dropped")
+			},
+		}, func(e Event) bool {
+			// The DisconnectEvent closes the stream, so it is always queued.
+			_, disconnect := e.(*DisconnectEvent)
+			return disconnect || filter.Match(e)
+		})
+	})
+	if c.State() == StateDisconnected {
+		cancel()
+	}
+	go func() {
+		<-ctx.Done()
+		c.Do(func() {
+			detacher.Detach()
+		})
+		s.mu.Lock()
+		s.closed = true
+		close(s.out)
+		s.mu.Unlock()
+	}()
+	return s.out
+}
+
+type eventStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	filter EventFilter
+
+	mu     sync.Mutex
+	closed bool
+	out    chan Event
+}
+
+func (s *eventStream) send(e Event) {
+	if !s.filter.Match(e) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.out <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *eventStream) OnConnect(e *ConnectEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnDisconnect(e *DisconnectEvent) {
+	s.send(e)
+	s.cancel()
+}
+
+func (s *eventStream) OnTextMessage(e *TextMessageEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnUserChange(e *UserChangeEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnChannelChange(e *ChannelChangeEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnPermissionDenied(e *PermissionDeniedEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnUserList(e *UserListEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnACL(e *ACLEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnBanList(e *BanListEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnContextActionChange(e *ContextActionChangeEvent) {
+	s.send(e)
+}
+
+func (s *eventStream) OnServerConfig(e *ServerConfigEvent) {
+	s.send(e)
+}
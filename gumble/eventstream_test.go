@@ -0,0 +1,104 @@
+package gumble
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+func TestEventsFilter(t *testing.T) {
+	c, _ := blobClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := c.Events(ctx, EventFilter{Types: EventTextMessage, User: c.Users[2]})
+
+	// Events that do not match the filter are discarded without being queued,
+	// so they never block the client, even if the stream is not read.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10*AsyncDefaultQueueSize; i++ {
+			handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), Name: proto.String(strconv.Itoa(i))})
+			handle(t, (*Client).handleTextMessage, c, &MumbleProto.TextMessage{Actor: proto.Uint32(1), Message: proto.String("from a")})
+		}
+		handle(t, (*Client).handleTextMessage, c, &MumbleProto.TextMessage{Actor: proto.Uint32(2), Message: proto.String("from b")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client blocked on unread event stream")
+	}
+
+	select {
+	case e := <-events:
+		if m, ok := e.(*TextMessageEvent); !ok || m.Message != "from b" {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestEventsOverflow(t *testing.T) {
+	c, _ := blobClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := c.Events(ctx, EventFilter{Types: EventTextMessage})
+
+	// When the queue is full, the oldest events are dropped.
+	n := 3 * AsyncDefaultQueueSize
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			handle(t, (*Client).handleTextMessage, c, &MumbleProto.TextMessage{Actor: proto.Uint32(1), Message: proto.String(strconv.Itoa(i))})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client blocked on full event stream")
+	}
+
+	var last string
+	received := 0
+	for last != strconv.Itoa(n-1) {
+		select {
+		case e := <-events:
+			last = e.(*TextMessageEvent).Message
+			received++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events, last %q", received, last)
+		}
+	}
+	// The queue, and the event that was being delivered when the queue
+	// filled up.
+	if received > AsyncDefaultQueueSize+1 {
+		t.Errorf("received %d events, expected at most %d", received, AsyncDefaultQueueSize+1)
+	}
+}
+
+func TestEventsDisconnect(t *testing.T) {
+	c, _ := blobClient(t)
+	events := c.Events(context.Background(), EventFilter{Types: EventTextMessage})
+
+	// The stream is closed by the DisconnectEvent, even though the filter
+	// does not select it.
+	c.Config.Listeners.onDisconnect(&DisconnectEvent{Client: c})
+	select {
+	case e, ok := <-events:
+		if ok {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed")
+	}
+}
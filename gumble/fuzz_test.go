@@ -0,0 +1,256 @@
+package gumble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// fuzzClient returns a synced client with a root channel, a child channel
+// (ID 1), the client's own user (session 1) in the root channel, and a user
+// (session 2) in the child channel.
+func fuzzClient(tb testing.TB) *Client {
+	conn, server := net.Pipe()
+	go io.Copy(ioutil.Discard, server)
+
+	c := &Client{
+		Config:      NewConfig(),
+		Conn:        NewConn(conn),
+		Users:       Users{},
+		Channels:    Channels{},
+		permissions: map[uint32]*Permission{},
+		audioCodec:  fuzzCodec{},
+		state:       uint32(StateSynced),
+		connect:     make(chan *RejectError),
+		end:         make(chan struct{}),
+	}
+	c.blobs.client = c
+	c.Config.AttachAudio(fuzzAudioListener{})
+	// Async listeners copy the users and channels that events refer to, so
+	// they must handle any state that the handlers can produce.
+	async := c.Config.Listeners.AttachAsync(fuzzListener{}, AsyncOptions{
+		Overflow: AsyncOverflowDropOldest,
+	})
+	tb.Cleanup(async.Detach)
+
+	setup := []struct {
+		handler func(*Client, []byte) error
+		packet  proto.Message
+	}{
+		{(*Client).handleChannelState, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")}},
+		{(*Client).handleChannelState, &MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(0), Name: proto.String("A")}},
+		{(*Client).handleUserState, &MumbleProto.UserState{Session: proto.Uint32(1), Name: proto.String("self")}},
+		{(*Client).handleUserState, &MumbleProto.UserState{Session: proto.Uint32(2), Name: proto.String("other"), ChannelId: proto.Uint32(1)}},
+	}
+	for _, s := range setup {
+		buffer, err := proto.Marshal(s.packet)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := s.handler(c, buffer); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	c.Self = c.Users[1]
+	c.Snapshot()
+	return c
+}
+
+// fuzzListener is an EventListener that ignores all events.
+type fuzzListener struct{}
+
+func (fuzzListener) OnConnect(e *ConnectEvent)                         {}
+func (fuzzListener) OnDisconnect(e *DisconnectEvent)                   {}
+func (fuzzListener) OnTextMessage(e *TextMessageEvent)                 {}
+func (fuzzListener) OnUserChange(e *UserChangeEvent)                   {}
+func (fuzzListener) OnChannelChange(e *ChannelChangeEvent)             {}
+func (fuzzListener) OnPermissionDenied(e *PermissionDeniedEvent)       {}
+func (fuzzListener) OnUserList(e *UserListEvent)                       {}
+func (fuzzListener) OnACL(e *ACLEvent)                                 {}
+func (fuzzListener) OnBanList(e *BanListEvent)                         {}
+func (fuzzListener) OnContextActionChange(e *ContextActionChangeEvent) {}
+func (fuzzListener) OnServerConfig(e *ServerConfigEvent)               {}
+
+type fuzzCodec struct{}
+
+func (fuzzCodec) ID() int                  { return audioCodecIDOpus }
+func (fuzzCodec) NewEncoder() AudioEncoder { return nil }
+func (fuzzCodec) NewDecoder() AudioDecoder { return fuzzCodec{} }
+func (fuzzCodec) Reset()                   {}
+
+func (fuzzCodec) Decode(data []byte, frameSize int) ([]int16, error) {
+	return make([]int16, len(data)), nil
+}
+
+type fuzzAudioListener struct{}
+
+func (fuzzAudioListener) OnAudioStream(e *AudioStreamEvent) {
+	go func() {
+		for range e.C {
+		}
+	}()
+}
+
+func marshalSeed(f *testing.F, packet proto.Message) {
+	buffer, err := proto.Marshal(packet)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buffer)
+}
+
+func FuzzHandleUDPTunnel(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x80, 2, 0, 3, 1, 2, 3})
+	f.Add([]byte{0x80, 2, 0, 0x20, 0x03, 1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := fuzzClient(t)
+		defer c.Conn.Close()
+		c.handleUDPTunnel(data)
+	})
+}
+
+func FuzzHandleUserState(f *testing.F) {
+	marshalSeed(f, &MumbleProto.UserState{Session: proto.Uint32(3), Name: proto.String("new")})
+	marshalSeed(f, &MumbleProto.UserState{Session: proto.Uint32(2), Actor: proto.Uint32(1), ChannelId: proto.Uint32(0)})
+	marshalSeed(f, &MumbleProto.UserState{Session: proto.Uint32(2), ChannelId: proto.Uint32(7)})
+	marshalSeed(f, &MumbleProto.UserState{Session: proto.Uint32(2), CommentHash: []byte{1}, TextureHash: []byte{2}})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := fuzzClient(t)
+		defer c.Conn.Close()
+		c.handleUserState(data)
+		checkClientState(t, c)
+	})
+}
+
+func FuzzHandleACL(f *testing.F) {
+	marshalSeed(f, &MumbleProto.ACL{
+		ChannelId: proto.Uint32(1),
+		Groups: []*MumbleProto.ACL_ChanGroup{
+			{Name: proto.String("admin"), Add: []uint32{1}},
+		},
+		Acls: []*MumbleProto.ACL_ChanACL{
+			{Group: proto.String("admin"), Grant: proto.Uint32(uint32(PermissionWrite))},
+			{UserId: proto.Uint32(4), Deny: proto.Uint32(uint32(PermissionSpeak))},
+		},
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := fuzzClient(t)
+		defer c.Conn.Close()
+		c.handleACL(data)
+	})
+}
+
+// FuzzHandlers passes data to the handler for packetType.
+func FuzzHandlers(f *testing.F) {
+	f.Add(uint16(18), mustMarshal(&MumbleProto.UserList{Users: []*MumbleProto.UserList_User{{UserId: proto.Uint32(1), Name: proto.String("a")}}}))
+	f.Add(uint16(22), mustMarshal(&MumbleProto.UserStats{Session: proto.Uint32(2), FromServer: &MumbleProto.UserStats_Stats{Good: proto.Uint32(1)}}))
+	f.Add(uint16(5), mustMarshal(&MumbleProto.ServerSync{Session: proto.Uint32(1)}))
+	f.Add(uint16(8), mustMarshal(&MumbleProto.UserRemove{Session: proto.Uint32(2), Actor: proto.Uint32(1)}))
+	f.Add(uint16(6), mustMarshal(&MumbleProto.ChannelRemove{ChannelId: proto.Uint32(1)}))
+	f.Add(uint16(7), mustMarshal(&MumbleProto.ChannelState{ChannelId: proto.Uint32(2), Parent: proto.Uint32(1), Links: []uint32{0, 5}}))
+	f.Add(uint16(7), mustMarshal(&MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(1)}))
+	f.Add(uint16(7), mustMarshal(&MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Parent: proto.Uint32(1)}))
+	f.Add(uint16(12), mustMarshal(&MumbleProto.PermissionDenied{Type: MumbleProto.PermissionDenied_Permission.Enum(), Session: proto.Uint32(2)}))
+	f.Fuzz(func(t *testing.T, packetType uint16, data []byte) {
+		if int(packetType) >= len(handlers) {
+			return
+		}
+		c := fuzzClient(t)
+		defer c.Conn.Close()
+		handlers[packetType](c, data)
+		checkClientState(t, c)
+	})
+}
+
+func mustMarshal(packet proto.Message) []byte {
+	buffer, err := proto.Marshal(packet)
+	if err != nil {
+		panic(err)
+	}
+	return buffer
+}
+
+// checkClientState verifies that users and channels reference each other
+// consistently, and that the client's lock has been released.
+func checkClientState(t *testing.T, c *Client) {
+	locked := make(chan struct{})
+	go func() {
+		c.volatile.Lock()
+		c.volatile.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not release the client lock")
+	}
+
+	// Snapshots copy the changed users and channels.
+	c.Snapshot()
+
+	for session, user := range c.Users {
+		if user.Channel == nil {
+			t.Fatalf("user %d has no channel", session)
+		}
+		if user.Channel.Users[session] != user {
+			t.Fatalf("user %d is missing from channel %d", session, user.Channel.ID)
+		}
+	}
+	for id, channel := range c.Channels {
+		if channel.Parent != nil && channel.Parent.Children[id] != channel {
+			t.Fatalf("channel %d is missing from its parent", id)
+		}
+		for parent, n := channel.Parent, 0; parent != nil; parent, n = parent.Parent, n+1 {
+			if parent == channel || n > len(c.Channels) {
+				t.Fatalf("channel %d is its own ancestor", id)
+			}
+		}
+		for session, user := range channel.Users {
+			if user.Channel != channel {
+				t.Fatalf("user %d is in channel %d, but is listed in channel %d", session, user.Channel.ID, id)
+			}
+		}
+	}
+}
+
+func FuzzReadPacket(f *testing.F) {
+	f.Add([]byte{0, 3, 0, 0, 0, 2, 8, 1})
+	f.Add([]byte{0, 1, 0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			server.Write(data)
+			server.Close()
+		}()
+
+		conn := NewConn(client)
+		conn.MaximumPacketBytes = 1024
+		for {
+			pType, packet, err := conn.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(data) < 6 {
+				t.Fatal("read packet from truncated header")
+			}
+			header := data[:6]
+			if binary.BigEndian.Uint16(header) != pType || int(binary.BigEndian.Uint32(header[2:])) != len(packet) {
+				t.Fatalf("packet does not match header %v", header)
+			}
+			if !bytes.Equal(packet, data[6:6+len(packet)]) {
+				t.Fatal("packet data does not match input")
+			}
+			data = data[6+len(packet):]
+		}
+	})
+}
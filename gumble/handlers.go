@@ -22,6 +22,16 @@ var (
 	errNoCodec              = errors.New("gumble: no audio codec")
 )
 
+// channelError is a handler error caused by the channel with the given ID.
+type channelError struct {
+	channel uint32
+	err     error
+}
+
+func (e *channelError) Error() string {
+	return e.err.Error()
+}
+
 var handlers = [...]func(*Client, []byte) error{
 	(*Client).handleVersion,
 	(*Client).handleUDPTunnel,
@@ -76,7 +86,21 @@ func (c *Client) handleVersion(buffer []byte) error {
 	return nil
 }
 
-func (c *Client) handleUDPTunnel(buffer []byte) error {
+func (c *Client) handleUDPTunnel(buffer []byte) (err error) {
+	// Frames that are not passed to the decoder are counted as dropped.
+	dropped := true
+	var session int64 = -1
+	defer func() {
+		if dropped {
+			atomic.AddUint64(&c.metrics.framesDropped, 1)
+			if session >= 0 {
+				c.Logger().Debug("gumble: audio frame dropped", LogKeySession, session, LogKeyError, err)
+			} else {
+				c.Logger().Debug("gumble: audio frame dropped", LogKeyError, err)
+			}
+		}
+	}()
+
 	if len(buffer) < 1 {
 		return errInvalidProtobuf
 	}
@@ -91,8 +115,10 @@ func (c *Client) handleUDPTunnel(buffer []byte) error {
 
 	// Session
 	buffer = buffer[1:]
-	session, n := varint.Decode(buffer)
+	var n int
+	session, n = varint.Decode(buffer)
 	if n <= 0 {
+		session = -1
 		return errInvalidProtobuf
 	}
 	buffer = buffer[n:]
@@ -128,14 +154,18 @@ func (c *Client) handleUDPTunnel(buffer []byte) error {
 	buffer = buffer[n:]
 	// Opus audio packets set the 13th bit in the size field as the terminator.
 	audioLength := int(length) &^ 0x2000
-	if audioLength > len(buffer) {
+	if audioLength < 0 || audioLength > len(buffer) {
 		return errInvalidProtobuf
 	}
 
+	dropped = false
 	pcm, err := decoder.Decode(buffer[:audioLength], AudioMaximumFrameSize)
 	if err != nil {
+		atomic.AddUint64(&c.metrics.decodeErrors, 1)
+		c.Logger().Warn("gumble: failed to decode audio frame", LogKeySession, session, LogKeyError, err)
 		return err
 	}
+	atomic.AddUint64(&c.metrics.framesDecoded, 1)
 
 	event := AudioPacket{
 		Client: c,
@@ -189,6 +219,7 @@ func (c *Client) handlePing(buffer []byte) error {
 	}
 
 	atomic.AddUint32(&c.tcpPacketsReceived, 1)
+	c.pingReceived()
 
 	if packet.Timestamp != nil {
 		diff := time.Since(time.Unix(0, int64(*packet.Timestamp)))
@@ -241,6 +272,7 @@ func (c *Client) handleReject(buffer []byte) error {
 	if packet.Reason != nil {
 		err.Reason = *packet.Reason
 	}
+	c.Logger().Warn("gumble: connection rejected", LogKeyReason, err.Reason)
 	c.connect <- err
 	c.Conn.Close()
 	return nil
@@ -251,6 +283,9 @@ func (c *Client) handleServerSync(buffer []byte) error {
 	if err := proto.Unmarshal(buffer, &packet); err != nil {
 		return err
 	}
+	if c.State() != StateConnected {
+		return errInvalidProtobuf
+	}
 	event := ConnectEvent{
 		Client: c,
 	}
@@ -260,6 +295,7 @@ func (c *Client) handleServerSync(buffer []byte) error {
 			c.volatile.Lock()
 
 			c.Self = c.Users[*packet.Session]
+			c.advanceState()
 
 			c.volatile.Unlock()
 		}
@@ -272,6 +308,11 @@ func (c *Client) handleServerSync(buffer []byte) error {
 		event.MaximumBitrate = &val
 	}
 	atomic.StoreUint32(&c.state, uint32(StateSynced))
+	if packet.Session != nil {
+		c.Logger().Info("gumble: connected", LogKeySession, *packet.Session)
+	} else {
+		c.Logger().Info("gumble: connected")
+	}
 	c.Config.Listeners.onConnect(&event)
 	close(c.connect)
 	return nil
@@ -295,17 +336,21 @@ func (c *Client) handleChannelRemove(buffer []byte) error {
 		channel = c.Channels[channelID]
 		if channel == nil {
 			c.volatile.Unlock()
-			return errInvalidProtobuf
+			return &channelError{channelID, errInvalidProtobuf}
 		}
 		channel.client = nil
+		c.blobs.resolve(blobDescription, channelID)
 		delete(c.Channels, channelID)
 		delete(c.permissions, channelID)
 		if parent := channel.Parent; parent != nil {
 			delete(parent.Children, channel.ID)
+			c.touchChannel(parent)
 		}
 		for _, link := range channel.Links {
 			delete(link.Links, channelID)
+			c.touchChannel(link)
 		}
+		c.advanceState()
 
 		c.volatile.Unlock()
 	}
@@ -321,6 +366,27 @@ func (c *Client) handleChannelRemove(buffer []byte) error {
 	return nil
 }
 
+// isDescendant returns whether the channel with the given ID is ancestorID or
+// one of its descendants. A channel cannot be moved into such a channel.
+//
+// c.volatile must be held.
+func (c *Client) isDescendant(id, ancestorID uint32) bool {
+	// The channel tree has no cycles, so the walk ends within len(c.Channels)
+	// steps; the limit guards against that invariant being broken.
+	channel := c.Channels[id]
+	for i := 0; i <= len(c.Channels); i++ {
+		if id == ancestorID {
+			return true
+		}
+		if channel == nil || channel.Parent == nil {
+			return false
+		}
+		channel = channel.Parent
+		id = channel.ID
+	}
+	return true
+}
+
 func (c *Client) handleChannelState(buffer []byte) error {
 	var packet MumbleProto.ChannelState
 	if err := proto.Unmarshal(buffer, &packet); err != nil {
@@ -334,21 +400,34 @@ func (c *Client) handleChannelState(buffer []byte) error {
 		Client: c,
 	}
 
+	// The blob cache may do I/O, so it is not used while c.volatile is held.
+	var cachedDescription []byte
+	if packet.DescriptionHash != nil {
+		cachedDescription = c.cachedBlob(packet.DescriptionHash)
+	}
+
 	{
 		c.volatile.Lock()
 
 		channelID := *packet.ChannelId
+		if packet.Parent != nil && c.isDescendant(*packet.Parent, channelID) {
+			c.volatile.Unlock()
+			return &channelError{channelID, errInvalidProtobuf}
+		}
 		channel := c.Channels[channelID]
 		if channel == nil {
 			channel = c.Channels.create(channelID)
 			channel.client = c
+			channel.owner = c
 
 			event.Type |= ChannelChangeCreated
 		}
 		event.Channel = channel
+		c.touchChannel(channel)
 		if packet.Parent != nil {
 			if channel.Parent != nil {
 				delete(channel.Parent.Children, channelID)
+				c.touchChannel(channel.Parent)
 			}
 			newParent := c.Channels[*packet.Parent]
 			if newParent != channel.Parent {
@@ -357,6 +436,7 @@ func (c *Client) handleChannelState(buffer []byte) error {
 			channel.Parent = newParent
 			if channel.Parent != nil {
 				channel.Parent.Children[channel.ID] = channel
+				c.touchChannel(channel.Parent)
 			}
 		}
 		if packet.Name != nil {
@@ -379,6 +459,7 @@ func (c *Client) handleChannelState(buffer []byte) error {
 				event.Type |= ChannelChangeLinks
 				channel.Links[channelID] = c
 				c.Links[channel.ID] = channel
+				channel.client.touchChannel(c)
 			}
 		}
 		for _, channelID := range packet.LinksRemove {
@@ -386,6 +467,7 @@ func (c *Client) handleChannelState(buffer []byte) error {
 				event.Type |= ChannelChangeLinks
 				delete(channel.Links, channelID)
 				delete(c.Links, channel.ID)
+				channel.client.touchChannel(c)
 			}
 		}
 		if packet.Description != nil {
@@ -394,6 +476,7 @@ func (c *Client) handleChannelState(buffer []byte) error {
 			}
 			channel.Description = *packet.Description
 			channel.DescriptionHash = nil
+			c.blobs.resolve(blobDescription, channelID)
 		}
 		if packet.Temporary != nil {
 			channel.Temporary = *packet.Temporary
@@ -406,17 +489,28 @@ func (c *Client) handleChannelState(buffer []byte) error {
 		}
 		if packet.DescriptionHash != nil {
 			event.Type |= ChannelChangeDescription
-			channel.DescriptionHash = packet.DescriptionHash
-			channel.Description = ""
+			if blob := cachedDescription; blob != nil {
+				channel.Description = string(blob)
+				channel.DescriptionHash = nil
+				c.blobs.resolve(blobDescription, channelID)
+			} else {
+				channel.DescriptionHash = packet.DescriptionHash
+				channel.Description = ""
+			}
 		}
 		if packet.MaxUsers != nil {
 			event.Type |= ChannelChangeMaxUsers
 			channel.MaxUsers = *packet.MaxUsers
 		}
 
+		c.advanceState()
 		c.volatile.Unlock()
 	}
 
+	if packet.Description != nil {
+		c.cacheBlob([]byte(*packet.Description))
+	}
+
 	if c.State() == StateSynced {
 		c.Config.Listeners.onChannelChange(&event)
 	}
@@ -456,10 +550,14 @@ func (c *Client) handleUserRemove(buffer []byte) error {
 		}
 
 		event.User.client = nil
+		c.blobs.resolve(blobComment, session)
+		c.blobs.resolve(blobTexture, session)
 		if event.User.Channel != nil {
 			delete(event.User.Channel.Users, session)
+			c.touchChannel(event.User.Channel)
 		}
 		delete(c.Users, session)
+		c.advanceState()
 		if packet.Reason != nil {
 			event.String = *packet.Reason
 		}
@@ -495,6 +593,16 @@ func (c *Client) handleUserState(buffer []byte) error {
 	event := UserChangeEvent{
 		Client: c,
 	}
+
+	// The blob cache may do I/O, so it is not used while c.volatile is held.
+	var cachedComment, cachedTexture []byte
+	if packet.CommentHash != nil {
+		cachedComment = c.cachedBlob(packet.CommentHash)
+	}
+	if packet.TextureHash != nil {
+		cachedTexture = c.cachedBlob(packet.TextureHash)
+	}
+
 	var user, actor *User
 	{
 		c.volatile.Lock()
@@ -505,6 +613,7 @@ func (c *Client) handleUserState(buffer []byte) error {
 			user = c.Users.create(session)
 			user.Channel = c.Channels[0]
 			user.client = c
+			user.owner = c
 
 			event.Type |= UserChangeConnected
 
@@ -514,7 +623,9 @@ func (c *Client) handleUserState(buffer []byte) error {
 			}
 			event.Type |= UserChangeChannel
 			user.Channel.Users[session] = user
+			c.touchChannel(user.Channel)
 		}
+		c.touchUser(user)
 
 		event.User = user
 		if packet.Actor != nil {
@@ -545,19 +656,21 @@ func (c *Client) handleUserState(buffer []byte) error {
 			}
 		}
 		if packet.ChannelId != nil {
-			if user.Channel != nil {
-				delete(user.Channel.Users, user.Session)
-			}
 			newChannel := c.Channels[*packet.ChannelId]
 			if newChannel == nil {
-				c.volatile.Lock()
-				return errInvalidProtobuf
+				c.volatile.Unlock()
+				return &channelError{*packet.ChannelId, errInvalidProtobuf}
+			}
+			if user.Channel != nil {
+				delete(user.Channel.Users, user.Session)
+				c.touchChannel(user.Channel)
 			}
 			if newChannel != user.Channel {
 				event.Type |= UserChangeChannel
 				user.Channel = newChannel
 			}
 			user.Channel.Users[user.Session] = user
+			c.touchChannel(user.Channel)
 		}
 		if packet.Mute != nil {
 			if *packet.Mute != user.Muted {
@@ -593,6 +706,7 @@ func (c *Client) handleUserState(buffer []byte) error {
 			event.Type |= UserChangeTexture
 			user.Texture = packet.Texture
 			user.TextureHash = nil
+			c.blobs.resolve(blobTexture, user.Session)
 		}
 		if packet.Comment != nil {
 			if *packet.Comment != user.Comment {
@@ -600,19 +714,32 @@ func (c *Client) handleUserState(buffer []byte) error {
 			}
 			user.Comment = *packet.Comment
 			user.CommentHash = nil
+			c.blobs.resolve(blobComment, user.Session)
 		}
 		if packet.Hash != nil {
 			user.Hash = *packet.Hash
 		}
 		if packet.CommentHash != nil {
 			event.Type |= UserChangeComment
-			user.CommentHash = packet.CommentHash
-			user.Comment = ""
+			if blob := cachedComment; blob != nil {
+				user.Comment = string(blob)
+				user.CommentHash = nil
+				c.blobs.resolve(blobComment, user.Session)
+			} else {
+				user.CommentHash = packet.CommentHash
+				user.Comment = ""
+			}
 		}
 		if packet.TextureHash != nil {
 			event.Type |= UserChangeTexture
-			user.TextureHash = packet.TextureHash
-			user.Texture = nil
+			if blob := cachedTexture; blob != nil {
+				user.Texture = blob
+				user.TextureHash = nil
+				c.blobs.resolve(blobTexture, user.Session)
+			} else {
+				user.TextureHash = packet.TextureHash
+				user.Texture = nil
+			}
 		}
 		if packet.PrioritySpeaker != nil {
 			if *packet.PrioritySpeaker != user.PrioritySpeaker {
@@ -627,9 +754,17 @@ func (c *Client) handleUserState(buffer []byte) error {
 			user.Recording = *packet.Recording
 		}
 
+		c.advanceState()
 		c.volatile.Unlock()
 	}
 
+	if packet.Texture != nil {
+		c.cacheBlob(packet.Texture)
+	}
+	if packet.Comment != nil {
+		c.cacheBlob([]byte(*packet.Comment))
+	}
+
 	if c.State() == StateSynced {
 		c.Config.Listeners.onUserChange(&event)
 	}
@@ -760,6 +895,7 @@ func (c *Client) handlePermissionDenied(buffer []byte) error {
 		event.Permission = Permission(*packet.Permission)
 	}
 
+	c.denyRequest(&event)
 	c.Config.Listeners.onPermissionDenied(&event)
 	return nil
 }
@@ -784,6 +920,9 @@ func (c *Client) handleACL(buffer []byte) error {
 	if packet.Groups != nil {
 		acl.Groups = make([]*ACLGroup, 0, len(packet.Groups))
 		for _, group := range packet.Groups {
+			if group.Name == nil {
+				return errIncompleteProtobuf
+			}
 			aclGroup := &ACLGroup{
 				Name:         *group.Name,
 				Inherited:    group.GetInherited(),
@@ -968,6 +1107,9 @@ func (c *Client) handleUserList(buffer []byte) error {
 	}
 
 	for _, user := range packet.Users {
+		if user.UserId == nil {
+			return errIncompleteProtobuf
+		}
 		registeredUser := &RegisteredUser{
 			UserID: *user.UserId,
 		}
@@ -1125,13 +1267,13 @@ func (c *Client) handleUserStats(buffer []byte) error {
 			if packet.FromServer.Good != nil {
 				stats.FromServer.Good = *packet.FromServer.Good
 			}
-			if packet.FromClient.Late != nil {
+			if packet.FromServer.Late != nil {
 				stats.FromServer.Late = *packet.FromServer.Late
 			}
-			if packet.FromClient.Lost != nil {
+			if packet.FromServer.Lost != nil {
 				stats.FromServer.Lost = *packet.FromServer.Lost
 			}
-			if packet.FromClient.Resync != nil {
+			if packet.FromServer.Resync != nil {
 				stats.FromServer.Resync = *packet.FromServer.Resync
 			}
 		}
@@ -0,0 +1,65 @@
+package gumble
+
+// Logger receives diagnostic messages from gumble. The arguments following
+// the message are alternating key-value pairs (e.g. "session", 4).
+//
+// The method set matches that of *slog.Logger, so a structured logger from
+// the standard library can be used directly:
+//
+//	config.Logger = slog.Default()
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Attribute keys used in log messages.
+const (
+	LogKeySession    = "session"
+	LogKeyChannel    = "channel"
+	LogKeyPacketType = "packet_type"
+	LogKeyLength     = "length"
+	LogKeyError      = "error"
+	LogKeyReason     = "reason"
+)
+
+// NopLogger is a Logger that discards all messages.
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Warn(string, ...interface{})  {}
+func (NopLogger) Error(string, ...interface{}) {}
+
+// Logger returns the client's Config.Logger, or a Logger that discards all
+// messages if it is nil. It is intended for packages that extend gumble, so
+// that their messages go to the same destination.
+func (c *Client) Logger() Logger {
+	if c.Config != nil && c.Config.Logger != nil {
+		return c.Config.Logger
+	}
+	return NopLogger{}
+}
+
+// logger returns the Logger used by the connection.
+func (c *Conn) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return NopLogger{}
+}
+
+func (d DisconnectType) logName() string {
+	switch d {
+	case DisconnectError:
+		return "error"
+	case DisconnectKicked:
+		return "kicked"
+	case DisconnectBanned:
+		return "banned"
+	case DisconnectUser:
+		return "user"
+	}
+	return "unknown"
+}
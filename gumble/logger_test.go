@@ -0,0 +1,74 @@
+package gumble
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// testLogger is a Logger that records messages as lines of the form
+// "level msg key=value ...".
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) log(level, msg string, args []interface{}) {
+	line := level + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.mu.Lock()
+	l.lines = append(l.lines, line)
+	l.mu.Unlock()
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestConnLogger(t *testing.T) {
+	logger := &testLogger{}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := NewConn(server)
+	r.Logger = logger
+	go NewConn(client).WriteProto(&MumbleProto.Ping{Timestamp: new(uint64)})
+	if _, _, err := r.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := logger.String(); !strings.Contains(s, "DEBUG gumble: packet received packet_type=Ping length=2") {
+		t.Errorf("unexpected log output: %q", s)
+	}
+}
+
+func TestHandlerErrorLogger(t *testing.T) {
+	logger := &testLogger{}
+
+	c, _ := blobClient(t)
+	buffer, _ := proto.Marshal(&MumbleProto.ChannelRemove{ChannelId: proto.Uint32(5)})
+	err := c.handleChannelRemove(buffer)
+	if err == nil {
+		t.Fatal("expected error for unknown channel")
+	}
+	logHandlerError(logger, 6, err)
+	if s := logger.String(); !strings.Contains(s, "WARN gumble: failed to handle packet packet_type=ChannelRemove channel=5 error=") {
+		t.Errorf("unexpected log output: %q", s)
+	}
+}
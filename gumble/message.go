@@ -5,6 +5,7 @@ package gumble
 //  AccessTokens
 //  ACL
 //  BanList
+//  BlobRequest
 //  RegisteredUsers
 //  TextMessage
 //  VoiceTarget
@@ -0,0 +1,155 @@
+package gumble
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+)
+
+// packetTypeNames contains the names of the control protocol packet types,
+// indexed by packet type.
+var packetTypeNames = [...]string{
+	"Version",
+	"UDPTunnel",
+	"Authenticate",
+	"Ping",
+	"Reject",
+	"ServerSync",
+	"ChannelRemove",
+	"ChannelState",
+	"UserRemove",
+	"UserState",
+	"BanList",
+	"TextMessage",
+	"PermissionDenied",
+	"ACL",
+	"QueryUsers",
+	"CryptSetup",
+	"ContextActionModify",
+	"ContextAction",
+	"UserList",
+	"VoiceTarget",
+	"PermissionQuery",
+	"CodecVersion",
+	"UserStats",
+	"RequestBlob",
+	"ServerConfig",
+	"SuggestConfig",
+}
+
+// PacketTypeName returns the name of the control protocol packet type (e.g.
+// "UserState"). Unknown types are returned as a number.
+func PacketTypeName(packetType uint16) string {
+	if int(packetType) < len(packetTypeNames) {
+		return packetTypeNames[packetType]
+	}
+	return strconv.Itoa(int(packetType))
+}
+
+// packetCounts counts the packets read from and written to a Conn.
+type packetCounts struct {
+	read    [len(packetTypeNames) + 1]uint64
+	written [len(packetTypeNames) + 1]uint64
+}
+
+// index returns the counter index of the packet type. Unknown packet types
+// share the last counter.
+func (p *packetCounts) index(packetType uint16) int {
+	if int(packetType) < len(packetTypeNames) {
+		return int(packetType)
+	}
+	return len(packetTypeNames)
+}
+
+func (p *packetCounts) add(counters []uint64, packetType uint16) {
+	atomic.AddUint64(&counters[p.index(packetType)], 1)
+}
+
+func (p *packetCounts) counts(counters []uint64) map[string]uint64 {
+	m := make(map[string]uint64)
+	for i := range counters {
+		if n := atomic.LoadUint64(&counters[i]); n > 0 {
+			name := "Unknown"
+			if i < len(packetTypeNames) {
+				name = packetTypeNames[i]
+			}
+			m[name] = n
+		}
+	}
+	return m
+}
+
+// PacketsRead returns the number of packets read from the connection, keyed
+// by packet type name (see PacketTypeName). Packets of unknown types are
+// counted as "Unknown".
+func (c *Conn) PacketsRead() map[string]uint64 {
+	if c == nil || c.packets == nil {
+		return map[string]uint64{}
+	}
+	return c.packets.counts(c.packets.read[:])
+}
+
+// PacketsWritten returns the number of packets written to the connection,
+// keyed by packet type name.
+func (c *Conn) PacketsWritten() map[string]uint64 {
+	if c == nil || c.packets == nil {
+		return map[string]uint64{}
+	}
+	return c.packets.counts(c.packets.written[:])
+}
+
+// clientMetrics contains the client's voice counters. It must be 64-bit
+// aligned.
+type clientMetrics struct {
+	framesEncoded uint64
+	framesDecoded uint64
+	decodeErrors  uint64
+	framesDropped uint64
+}
+
+// Metrics is a point-in-time copy of a client's statistics.
+type Metrics struct {
+	// The average and variance of the TCP ping time to the server, in
+	// milliseconds.
+	PingAverage  float32
+	PingVariance float32
+
+	// The number of control protocol packets received and sent, keyed by
+	// packet type name (see PacketTypeName).
+	PacketsReceived map[string]uint64
+	PacketsSent     map[string]uint64
+
+	// The number of voice frames encoded and sent, and received and decoded.
+	VoiceFramesEncoded uint64
+	VoiceFramesDecoded uint64
+	// The number of received voice frames that could not be decoded.
+	VoiceDecodeErrors uint64
+	// The number of voice frames that were dropped: received frames that
+	// were malformed, used an unsupported codec, or came from an unknown
+	// user, and outgoing frames that could not be encoded or sent.
+	VoiceFramesDropped uint64
+
+	// The number of connected users and known channels.
+	Users    int
+	Channels int
+}
+
+// Metrics returns the client's current statistics. It can be called from any
+// goroutine.
+func (c *Client) Metrics() Metrics {
+	m := Metrics{
+		PingAverage:        math.Float32frombits(atomic.LoadUint32(&c.tcpPingAvg)),
+		PingVariance:       math.Float32frombits(atomic.LoadUint32(&c.tcpPingVar)),
+		PacketsReceived:    c.Conn.PacketsRead(),
+		PacketsSent:        c.Conn.PacketsWritten(),
+		VoiceFramesEncoded: atomic.LoadUint64(&c.metrics.framesEncoded),
+		VoiceFramesDecoded: atomic.LoadUint64(&c.metrics.framesDecoded),
+		VoiceDecodeErrors:  atomic.LoadUint64(&c.metrics.decodeErrors),
+		VoiceFramesDropped: atomic.LoadUint64(&c.metrics.framesDropped),
+	}
+	c.volatile.RLock()
+	m.Users = len(c.Users)
+	m.Channels = len(c.Channels)
+	c.volatile.RUnlock()
+	return m
+}
@@ -0,0 +1,36 @@
+package gumble
+
+import (
+	"net"
+	"testing"
+
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+func TestConnPacketCounts(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	w, r := NewConn(client), NewConn(server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.WriteProto(&MumbleProto.Ping{})
+		w.WriteProto(&MumbleProto.Ping{})
+		w.WritePacket(200, []byte{0})
+	}()
+	for i := 0; i < 3; i++ {
+		if _, _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	written, read := w.PacketsWritten(), r.PacketsRead()
+	for _, counts := range []map[string]uint64{written, read} {
+		if len(counts) != 2 || counts["Ping"] != 2 || counts["Unknown"] != 1 {
+			t.Errorf("unexpected counts: %v", counts)
+		}
+	}
+}
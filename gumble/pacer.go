@@ -0,0 +1,131 @@
+package gumble
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AudioDefaultMaxCatchUp is the default value of AudioPacer.MaxCatchUp.
+const AudioDefaultMaxCatchUp = 5
+
+// AudioPacer schedules outgoing audio frames at a fixed interval. Frame n is
+// due at n intervals after the first frame, measured with the monotonic
+// clock, so that the schedule does not drift when individual frames are
+// late.
+//
+// A producer calls Wait before sending each frame:
+//
+//	pacer := gumble.NewAudioPacer(client.Config.AudioInterval)
+//	outgoing := client.AudioOutgoing()
+//	defer close(outgoing)
+//	for pacer.Wait(stop) {
+//		outgoing <- nextFrame()
+//	}
+//
+// If the producer falls behind (e.g. because of a GC pause, or because
+// reading the next frame was slow), Wait returns immediately for each frame
+// that is overdue, so that the producer catches up. If it falls behind by more
+// than MaxCatchUp frames, the overdue frames are skipped instead: the schedule
+// moves forward to the current time, and OnUnderrun is called.
+//
+// An AudioPacer must only be used by one goroutine, except for Stats.
+type AudioPacer struct {
+	// Accessed atomically; kept first for 64-bit alignment.
+	frames, late, skipped uint64
+
+	// The number of overdue frames that the producer may catch up on by
+	// sending them immediately. Defaults to AudioDefaultMaxCatchUp.
+	MaxCatchUp int
+	// If non-nil, OnUnderrun is called from Wait when frames are skipped,
+	// with the number of frames that were skipped.
+	OnUnderrun func(skipped int)
+
+	interval time.Duration
+	started  bool
+	start    time.Time
+	next     int64
+
+	// The clock, which can be replaced in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// AudioPacerStats contains the number of frames that an AudioPacer has
+// scheduled.
+type AudioPacerStats struct {
+	// The number of times that Wait returned true.
+	Frames uint64
+	// The number of frames for which Wait was called after the frame was due.
+	Late uint64
+	// The number of frames that were skipped.
+	Skipped uint64
+}
+
+// NewAudioPacer returns a new AudioPacer that schedules frames at the given
+// interval (e.g. Config.AudioInterval).
+func NewAudioPacer(interval time.Duration) *AudioPacer {
+	return &AudioPacer{
+		MaxCatchUp: AudioDefaultMaxCatchUp,
+		interval:   interval,
+		now:        time.Now,
+		after:      time.After,
+	}
+}
+
+// Wait blocks until the next frame is due. It returns false, without waiting
+// further, if stop is closed. The first frame after NewAudioPacer or Reset is
+// due immediately.
+func (p *AudioPacer) Wait(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	now := p.now()
+	if !p.started {
+		p.started = true
+		p.start = now
+		p.next = 1
+		atomic.AddUint64(&p.frames, 1)
+		return true
+	}
+
+	due := p.start.Add(time.Duration(p.next) * p.interval)
+	if wait := due.Sub(now); wait > 0 {
+		select {
+		case <-stop:
+			return false
+		case <-p.after(wait):
+		}
+	} else {
+		atomic.AddUint64(&p.late, 1)
+		if behind := int64(-wait / p.interval); behind > int64(p.MaxCatchUp) {
+			p.next += behind
+			atomic.AddUint64(&p.skipped, uint64(behind))
+			if p.OnUnderrun != nil {
+				p.OnUnderrun(int(behind))
+			}
+		}
+	}
+	p.next++
+	atomic.AddUint64(&p.frames, 1)
+	return true
+}
+
+// Reset restarts the schedule, so that the next frame is due immediately. It
+// should be called when the producer resumes after it has intentionally
+// stopped sending frames (e.g. when a stream is unpaused).
+func (p *AudioPacer) Reset() {
+	p.started = false
+}
+
+// Stats returns the number of frames that the pacer has scheduled. It can be
+// called from any goroutine.
+func (p *AudioPacer) Stats() AudioPacerStats {
+	return AudioPacerStats{
+		Frames:  atomic.LoadUint64(&p.frames),
+		Late:    atomic.LoadUint64(&p.late),
+		Skipped: atomic.LoadUint64(&p.skipped),
+	}
+}
@@ -0,0 +1,92 @@
+package gumble
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only advances when the pacer waits, or when
+// the test advances it.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.t = c.t.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func newTestPacer(clock *fakeClock) *AudioPacer {
+	p := NewAudioPacer(10 * time.Millisecond)
+	p.now = clock.now
+	p.after = clock.after
+	return p
+}
+
+func TestAudioPacer(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	p := newTestPacer(clock)
+	var underruns []int
+	p.OnUnderrun = func(skipped int) {
+		underruns = append(underruns, skipped)
+	}
+	start := clock.t
+
+	// Frames are scheduled at fixed offsets from the first frame, even if the
+	// producer takes part of the interval to produce each frame.
+	for i := 0; i < 5; i++ {
+		if !p.Wait(nil) {
+			t.Fatal("Wait returned false")
+		}
+		if want := start.Add(time.Duration(i) * 10 * time.Millisecond); !clock.t.Equal(want) {
+			t.Fatalf("frame %d sent at %v, want %v", i, clock.t.Sub(start), want.Sub(start))
+		}
+		clock.t = clock.t.Add(3 * time.Millisecond)
+	}
+
+	// A producer that is 3 frames late catches up without waiting.
+	clock.t = start.Add(75 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		before := clock.t
+		p.Wait(nil)
+		if !clock.t.Equal(before) {
+			t.Fatalf("catch-up frame %d waited", i)
+		}
+	}
+	p.Wait(nil)
+	if want := start.Add(80 * time.Millisecond); !clock.t.Equal(want) {
+		t.Fatalf("frame sent at %v, want 80ms", clock.t.Sub(start))
+	}
+	if len(underruns) != 0 {
+		t.Fatalf("unexpected underruns %v", underruns)
+	}
+
+	// A producer that is more than MaxCatchUp frames late skips the overdue
+	// frames, and the schedule continues from the current time.
+	clock.t = start.Add(205 * time.Millisecond)
+	p.Wait(nil)
+	if len(underruns) != 1 || underruns[0] != 11 {
+		t.Fatalf("got underruns %v, want [11]", underruns)
+	}
+	p.Wait(nil)
+	if want := start.Add(210 * time.Millisecond); !clock.t.Equal(want) {
+		t.Fatalf("frame sent at %v, want 210ms", clock.t.Sub(start))
+	}
+
+	stats := p.Stats()
+	if stats.Frames != 11 || stats.Late != 4 || stats.Skipped != 11 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if p.Wait(stop) {
+		t.Fatal("Wait returned true after stop was closed")
+	}
+}
@@ -0,0 +1,280 @@
+package gumble
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// PermissionDeniedError is the error returned by a Request that the server
+// denied.
+type PermissionDeniedError struct {
+	// Why the request was denied.
+	Type PermissionDeniedType
+	// The permission that was missing, if Type is PermissionDeniedPermission.
+	Permission Permission
+	// The channel and user that the denial refers to (can be nil).
+	Channel *Channel
+	User    *User
+	// The reason given by the server, or the offending name for
+	// PermissionDeniedInvalidChannelName and PermissionDeniedInvalidUserName.
+	Reason string
+}
+
+// Err returns the PermissionDeniedError that describes the event.
+func (e *PermissionDeniedEvent) Err() *PermissionDeniedError {
+	return &PermissionDeniedError{
+		Type:       e.Type,
+		Permission: e.Permission,
+		Channel:    e.Channel,
+		User:       e.User,
+		Reason:     e.String,
+	}
+}
+
+func (e *PermissionDeniedError) Error() string {
+	msg := "gumble: permission denied"
+	switch e.Type {
+	case PermissionDeniedPermission:
+		msg += " (permission " + strconv.FormatUint(uint64(e.Permission), 16) + ")"
+	case PermissionDeniedSuperUser:
+		msg += " (superuser)"
+	case PermissionDeniedInvalidChannelName:
+		msg += " (invalid channel name)"
+	case PermissionDeniedTextTooLong:
+		msg += " (text too long)"
+	case PermissionDeniedTemporaryChannel:
+		msg += " (temporary channel)"
+	case PermissionDeniedMissingCertificate:
+		msg += " (missing certificate)"
+	case PermissionDeniedInvalidUserName:
+		msg += " (invalid user name)"
+	case PermissionDeniedChannelFull:
+		msg += " (channel full)"
+	case PermissionDeniedNestingLimit:
+		msg += " (nesting limit)"
+	case PermissionDeniedChannelCountLimit:
+		msg += " (channel count limit)"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// RequestScope narrows down which PermissionDenied responses can be matched
+// to a Request. Zero-valued fields match any response.
+type RequestScope struct {
+	// The denial types that can be matched.
+	Types []PermissionDeniedType
+	// The permissions that can be matched by PermissionDeniedPermission
+	// responses.
+	Permission Permission
+	// The channel (compared by ID) and user (compared by session) that the
+	// request refers to. Responses that do not refer to a channel or user are
+	// still matched.
+	Channel *Channel
+	User    *User
+}
+
+func (s *RequestScope) match(e *PermissionDeniedEvent) bool {
+	if len(s.Types) > 0 {
+		found := false
+		for _, t := range s.Types {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.Permission != 0 && e.Type == PermissionDeniedPermission && s.Permission&e.Permission == 0 {
+		return false
+	}
+	if s.Channel != nil && e.Channel != nil && s.Channel.ID != e.Channel.ID {
+		return false
+	}
+	if s.User != nil && e.User != nil && s.User.Session != e.User.Session {
+		return false
+	}
+	return true
+}
+
+// Request is the result of messages sent to the server using Client.Track or
+// Client.SendRequest. The request is complete once the server has processed
+// the messages; if the server denied them, Err returns a
+// *PermissionDeniedError.
+type Request struct {
+	scope RequestScope
+	// The number of pings that the client must receive before the request is
+	// complete. Zero until the request's messages have been sent.
+	barrier uint64
+
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel that is closed when the request is complete.
+func (r *Request) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns nil if the request is not complete or succeeded, or the reason
+// it failed.
+func (r *Request) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the request is complete or ctx is done, and returns the
+// request's error.
+func (r *Request) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Request) finish(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// requestTracker matches PermissionDenied responses to pending requests.
+//
+// The server processes messages in order, so once a ping that was sent after a
+// request's messages has been answered, any denial of the request has already
+// been received.
+type requestTracker struct {
+	sync.Mutex
+	pending       []*Request
+	pingsSent     uint64
+	pingsReceived uint64
+	closed        bool
+}
+
+// Track calls f, which should send messages to the server (e.g. using
+// User.Kick or Channel.Add), and returns a Request that completes once the
+// server has processed them.
+//
+// If the server responds with a PermissionDenied message while the request is
+// pending, and the response is matched by scope, the request fails with a
+// *PermissionDeniedError. When multiple pending requests match a response, it
+// is assigned to the oldest one. The PermissionDeniedEvent is still passed to
+// the event listeners.
+func (c *Client) Track(scope RequestScope, f func()) *Request {
+	r := &Request{
+		scope: scope,
+		done:  make(chan struct{}),
+	}
+	t := &c.requests
+	t.Lock()
+	if t.closed || c.State() == StateDisconnected {
+		t.Unlock()
+		r.finish(errClientClosed)
+		return r
+	}
+	t.pending = append(t.pending, r)
+	t.Unlock()
+
+	f()
+
+	c.writePing(r)
+	return r
+}
+
+// SendRequest sends message to the server, and returns a Request that tracks
+// the result. It is equivalent to:
+//
+//	client.Track(scope, func() { client.Send(message) })
+//
+// The scope should describe the denials that message can cause (e.g. the
+// Channel and PermissionWrite for an ACL); an empty scope matches any
+// PermissionDenied response that arrives while the request is pending.
+func (c *Client) SendRequest(scope RequestScope, message Message) *Request {
+	return c.Track(scope, func() {
+		c.Send(message)
+	})
+}
+
+// writePing sends a ping to the server. If r is non-nil, it completes once the
+// ping has been answered.
+func (c *Client) writePing(r *Request) {
+	t := &c.requests
+	t.Lock()
+	defer t.Unlock()
+
+	t.pingsSent++
+	if r != nil {
+		r.barrier = t.pingsSent
+	}
+	packet := MumbleProto.Ping{
+		Timestamp:  proto.Uint64(uint64(time.Now().UnixNano())),
+		TcpPackets: proto.Uint32(atomic.LoadUint32(&c.tcpPacketsReceived)),
+		TcpPingAvg: proto.Float32(math.Float32frombits(atomic.LoadUint32(&c.tcpPingAvg))),
+		TcpPingVar: proto.Float32(math.Float32frombits(atomic.LoadUint32(&c.tcpPingVar))),
+	}
+	c.Conn.WriteProto(&packet)
+}
+
+// pingReceived completes the requests whose pings have been answered.
+func (c *Client) pingReceived() {
+	t := &c.requests
+	t.Lock()
+	defer t.Unlock()
+
+	t.pingsReceived++
+	pending := t.pending[:0]
+	for _, r := range t.pending {
+		if r.barrier != 0 && r.barrier <= t.pingsReceived {
+			r.finish(nil)
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	t.pending = pending
+}
+
+// denyRequest fails the oldest pending request that matches e. Requests whose
+// messages are still being sent are skipped, as e cannot be a response to
+// them.
+func (c *Client) denyRequest(e *PermissionDeniedEvent) {
+	t := &c.requests
+	t.Lock()
+	defer t.Unlock()
+
+	for i, r := range t.pending {
+		if r.barrier != 0 && r.scope.match(e) {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			r.finish(e.Err())
+			return
+		}
+	}
+}
+
+// closeRequests fails all pending requests.
+func (c *Client) closeRequests() {
+	t := &c.requests
+	t.Lock()
+	defer t.Unlock()
+
+	t.closed = true
+	for _, r := range t.pending {
+		r.finish(errClientClosed)
+	}
+	t.pending = nil
+}
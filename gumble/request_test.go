@@ -0,0 +1,89 @@
+package gumble
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+func TestRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	c := &Client{
+		Config:   NewConfig(),
+		Conn:     NewConn(client),
+		Users:    Users{},
+		Channels: Channels{},
+		state:    uint32(StateSynced),
+	}
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")})
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(0), Name: proto.String("A")})
+	root, a := c.Channels[0], c.Channels[1]
+
+	// A ping sent before the requests must not complete them.
+	c.writePing(nil)
+	r1 := c.Track(RequestScope{Channel: a}, func() {})
+	r2 := c.Track(RequestScope{Channel: root}, func() {})
+	r3 := c.SendRequest(RequestScope{Types: []PermissionDeniedType{PermissionDeniedTextTooLong}}, &TextMessage{Message: "hi"})
+
+	handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	select {
+	case <-r1.Done():
+		t.Fatal("request completed by earlier ping")
+	default:
+	}
+
+	handle(t, (*Client).handlePermissionDenied, c, &MumbleProto.PermissionDenied{
+		Type:       MumbleProto.PermissionDenied_Permission.Enum(),
+		ChannelId:  proto.Uint32(0),
+		Permission: proto.Uint32(uint32(PermissionMakeChannel)),
+		Reason:     proto.String("no"),
+	})
+	err := r2.Wait(context.Background())
+	if denied, ok := err.(*PermissionDeniedError); !ok || denied.Channel != root || denied.Permission != PermissionMakeChannel || denied.Reason != "no" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	}
+	if err := r1.Wait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := r3.Wait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRequestUnsent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	c := &Client{
+		Config:   NewConfig(),
+		Conn:     NewConn(client),
+		Users:    Users{},
+		Channels: Channels{},
+		state:    uint32(StateSynced),
+	}
+
+	// A denial that arrives before the request's messages have been sent
+	// belongs to an earlier message.
+	r := c.Track(RequestScope{}, func() {
+		handle(t, (*Client).handlePermissionDenied, c, &MumbleProto.PermissionDenied{
+			Type: MumbleProto.PermissionDenied_TextTooLong.Enum(),
+		})
+	})
+	handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	if err := r.Wait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package gumble
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Snapshot is an immutable copy of the client's user and channel state at a
+// point in time. A Snapshot (and the UserStates and ChannelStates it contains)
+// is never modified, so it can be read from any goroutine without calling
+// Client.Do.
+type Snapshot struct {
+	// The version of the client state that the snapshot was created from. The
+	// version increases each time the client's users or channels change.
+	Version uint64
+
+	self     *UserState
+	users    map[uint32]*UserState
+	channels map[uint32]*ChannelState
+}
+
+// UserState is an immutable copy of a User.
+type UserState struct {
+	Session    uint32
+	UserID     uint32
+	Registered bool
+	Name       string
+	// The ID of the channel that the user is in.
+	ChannelID uint32
+
+	Muted           bool
+	Deafened        bool
+	Suppressed      bool
+	SelfMuted       bool
+	SelfDeafened    bool
+	PrioritySpeaker bool
+	Recording       bool
+
+	Comment     string
+	CommentHash []byte
+	Hash        string
+	Texture     []byte
+	TextureHash []byte
+}
+
+// ChannelState is an immutable copy of a Channel.
+type ChannelState struct {
+	ID uint32
+	// The ID of the parent channel. Zero for the root channel.
+	ParentID        uint32
+	Name            string
+	Description     string
+	DescriptionHash []byte
+	MaxUsers        uint32
+	Position        int32
+	Temporary       bool
+
+	// The IDs of the channel's children and linked channels, and the sessions
+	// of the users in the channel, in ascending order.
+	ChildIDs     []uint32
+	LinkIDs      []uint32
+	UserSessions []uint32
+}
+
+// IsRoot returns true if the channel is the server's root channel.
+func (c *ChannelState) IsRoot() bool {
+	return c.ID == 0
+}
+
+// Self returns the client's own user, or nil if the client has not been
+// synced with the server.
+func (s *Snapshot) Self() *UserState {
+	return s.self
+}
+
+// User returns the user with the given session, or nil if the user does not
+// exist.
+func (s *Snapshot) User(session uint32) *UserState {
+	return s.users[session]
+}
+
+// Channel returns the channel with the given ID, or nil if the channel does
+// not exist.
+func (s *Snapshot) Channel(id uint32) *ChannelState {
+	return s.channels[id]
+}
+
+// Users returns all of the users, ordered by session.
+func (s *Snapshot) Users() []*UserState {
+	users := make([]*UserState, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Session < users[j].Session
+	})
+	return users
+}
+
+// Channels returns all of the channels, ordered by ID.
+func (s *Snapshot) Channels() []*ChannelState {
+	channels := make([]*ChannelState, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return channels
+}
+
+// Find returns the channel whose path (by channel name) from the root channel
+// is equal to the arguments passed, or nil if the channel does not exist.
+func (s *Snapshot) Find(names ...string) *ChannelState {
+	channel := s.channels[0]
+	for _, name := range names {
+		if channel == nil {
+			return nil
+		}
+		var next *ChannelState
+		for _, id := range channel.ChildIDs {
+			if child := s.channels[id]; child != nil && child.Name == name {
+				next = child
+				break
+			}
+		}
+		channel = next
+	}
+	return channel
+}
+
+// Snapshot returns an immutable snapshot of the client's users and channels.
+//
+// Snapshots are copy-on-write: calling Snapshot again without any state
+// changes returns the same snapshot, and users and channels that have not
+// changed since the previous snapshot are shared with it.
+func (c *Client) Snapshot() *Snapshot {
+	version := atomic.LoadUint64(&c.stateVersion)
+	if s, _ := c.snapshot.Load().(*Snapshot); s != nil && s.Version == version {
+		return s
+	}
+
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+	c.volatile.RLock()
+	defer c.volatile.RUnlock()
+
+	prev, _ := c.snapshot.Load().(*Snapshot)
+	version = atomic.LoadUint64(&c.stateVersion)
+	if prev != nil && prev.Version == version {
+		return prev
+	}
+
+	s := &Snapshot{
+		Version:  version,
+		users:    make(map[uint32]*UserState, len(c.Users)),
+		channels: make(map[uint32]*ChannelState, len(c.Channels)),
+	}
+	for session, user := range c.Users {
+		if prev != nil && !c.dirtyUsers[session] {
+			if state := prev.users[session]; state != nil {
+				s.users[session] = state
+				continue
+			}
+		}
+		s.users[session] = newUserState(user)
+	}
+	for id, channel := range c.Channels {
+		if prev != nil && !c.dirtyChannels[id] {
+			if state := prev.channels[id]; state != nil {
+				s.channels[id] = state
+				continue
+			}
+		}
+		s.channels[id] = newChannelState(channel)
+	}
+	if c.Self != nil {
+		s.self = s.users[c.Self.Session]
+	}
+	c.dirtyUsers = nil
+	c.dirtyChannels = nil
+
+	c.snapshot.Store(s)
+	return s
+}
+
+// touchUser marks the user as changed since the last snapshot. It must be
+// called with volatile held.
+func (c *Client) touchUser(user *User) {
+	if user == nil {
+		return
+	}
+	if c.dirtyUsers == nil {
+		c.dirtyUsers = make(map[uint32]bool)
+	}
+	c.dirtyUsers[user.Session] = true
+}
+
+// touchChannel marks the channel as changed since the last snapshot. It must
+// be called with volatile held.
+func (c *Client) touchChannel(channel *Channel) {
+	if channel == nil {
+		return
+	}
+	if c.dirtyChannels == nil {
+		c.dirtyChannels = make(map[uint32]bool)
+	}
+	c.dirtyChannels[channel.ID] = true
+}
+
+// advanceState increments the state version. It must be called with volatile
+// held, after the state has been changed.
+func (c *Client) advanceState() {
+	atomic.AddUint64(&c.stateVersion, 1)
+}
+
+func newUserState(user *User) *UserState {
+	state := &UserState{
+		Session:         user.Session,
+		UserID:          user.UserID,
+		Registered:      user.IsRegistered(),
+		Name:            user.Name,
+		Muted:           user.Muted,
+		Deafened:        user.Deafened,
+		Suppressed:      user.Suppressed,
+		SelfMuted:       user.SelfMuted,
+		SelfDeafened:    user.SelfDeafened,
+		PrioritySpeaker: user.PrioritySpeaker,
+		Recording:       user.Recording,
+		Comment:         user.Comment,
+		CommentHash:     user.CommentHash,
+		Hash:            user.Hash,
+		Texture:         user.Texture,
+		TextureHash:     user.TextureHash,
+	}
+	if user.Channel != nil {
+		state.ChannelID = user.Channel.ID
+	}
+	return state
+}
+
+func newChannelState(channel *Channel) *ChannelState {
+	state := &ChannelState{
+		ID:              channel.ID,
+		Name:            channel.Name,
+		Description:     channel.Description,
+		DescriptionHash: channel.DescriptionHash,
+		MaxUsers:        channel.MaxUsers,
+		Position:        channel.Position,
+		Temporary:       channel.Temporary,
+	}
+	if channel.Parent != nil {
+		state.ParentID = channel.Parent.ID
+	}
+	for id := range channel.Children {
+		state.ChildIDs = append(state.ChildIDs, id)
+	}
+	for id := range channel.Links {
+		state.LinkIDs = append(state.LinkIDs, id)
+	}
+	for session := range channel.Users {
+		state.UserSessions = append(state.UserSessions, session)
+	}
+	sortIDs(state.ChildIDs)
+	sortIDs(state.LinkIDs)
+	sortIDs(state.UserSessions)
+	return state
+}
+
+func sortIDs(ids []uint32) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
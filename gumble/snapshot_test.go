@@ -0,0 +1,56 @@
+package gumble
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+func handle(t *testing.T, handler func(*Client, []byte) error, c *Client, packet proto.Message) {
+	buffer, err := proto.Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(c, buffer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := &Client{
+		Config:   NewConfig(),
+		Users:    Users{},
+		Channels: Channels{},
+	}
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")})
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(0), Name: proto.String("A")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(5), Name: proto.String("alice")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(6), Name: proto.String("bob")})
+
+	s1 := c.Snapshot()
+	if s1 != c.Snapshot() {
+		t.Fatal("unchanged state returned a new snapshot")
+	}
+	if root := s1.Find(); len(root.UserSessions) != 2 || len(root.ChildIDs) != 1 {
+		t.Fatalf("unexpected root channel: %+v", root)
+	}
+
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(5), ChannelId: proto.Uint32(1)})
+	s2 := c.Snapshot()
+	if s2.Version <= s1.Version {
+		t.Errorf("version did not advance: %d, %d", s1.Version, s2.Version)
+	}
+	if s1.User(5).ChannelID != 0 || s2.User(5).ChannelID != 1 {
+		t.Error("user channel not updated")
+	}
+	if s1.User(6) != s2.User(6) {
+		t.Error("unchanged user was copied")
+	}
+	if a := s2.Find("A"); len(a.UserSessions) != 1 || a.UserSessions[0] != 5 {
+		t.Errorf("unexpected channel: %+v", a)
+	}
+	if len(s1.Find().UserSessions) != 2 {
+		t.Error("old snapshot was modified")
+	}
+}
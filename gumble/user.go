@@ -1,6 +1,9 @@
 package gumble
 
 import (
+	"context"
+	"errors"
+
 	"github.com/golang/protobuf/proto"
 	"layeh.com/gumble/gumble/MumbleProto"
 )
@@ -32,14 +35,14 @@ type User struct {
 	Recording bool
 
 	// The user's comment. Contains the empty string if the user does not have a
-	// comment, or if the comment needs to be requested.
+	// comment, or if the comment needs to be requested (see CommentContext).
 	Comment string
 	// The user's comment hash. nil if User.Comment has been populated.
 	CommentHash []byte
 	// The hash of the user's certificate (can be empty).
 	Hash string
 	// The user's texture (avatar). nil if the user does not have a
-	// texture, or if the texture needs to be requested.
+	// texture, or if the texture needs to be requested (see TextureContext).
 	Texture []byte
 	// The user's texture hash. nil if User.Texture has been populated.
 	TextureHash []byte
@@ -49,6 +52,10 @@ type User struct {
 
 	client  *Client
 	decoder AudioDecoder
+	// owner is the client that the user belongs to. Unlike client, it is not
+	// cleared when the user disconnects, so it can be read without holding
+	// client.volatile.
+	owner *Client
 }
 
 // SetTexture sets the user's texture.
@@ -113,6 +120,46 @@ func (u *User) Move(channel *Channel) {
 	u.client.Conn.WriteProto(&packet)
 }
 
+// MoveContext moves the user to the given channel, and blocks until the server
+// has processed the move, ctx is done, or the client disconnects. If the server
+// denied the move, a *PermissionDeniedError is returned.
+//
+// This method must not be called from inside of an event listener.
+func (u *User) MoveContext(ctx context.Context, channel *Channel) error {
+	client := u.client
+	if client == nil {
+		return errUserDisconnected
+	}
+	scope := RequestScope{
+		Types: []PermissionDeniedType{
+			PermissionDeniedPermission,
+			PermissionDeniedChannelFull,
+			PermissionDeniedTemporaryChannel,
+		},
+		Permission: PermissionMove | PermissionEnter,
+		// The server refers to the target channel, and to the moved user.
+		Channel: channel,
+		User:    u,
+	}
+	if err := client.Track(scope, func() { u.Move(channel) }).Wait(ctx); err != nil {
+		return err
+	}
+
+	// The server sends the user's new state before it answers the request.
+	var err error
+	client.Do(func() {
+		switch {
+		case u.client == nil:
+			err = errUserDisconnected
+		case channel.client == nil:
+			err = errChannelRemoved
+		case u.Channel != channel:
+			err = errors.New("gumble: user was not moved")
+		}
+	})
+	return err
+}
+
 // Kick will kick the user from the server.
 func (u *User) Kick(reason string) {
 	packet := MumbleProto.UserRemove{
@@ -0,0 +1,143 @@
+package gumble
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// requestClient returns a synced client whose user (session 1) is in the root
+// channel, with channels 1 and 2, and a channel that receives the types of
+// the packets that the client sends.
+func requestClient(t *testing.T) (*Client, <-chan uint16) {
+	conn, server := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	packets := make(chan uint16, 10)
+	go func() {
+		serverConn := NewConn(server)
+		for {
+			pType, _, err := serverConn.ReadPacket()
+			if err != nil {
+				return
+			}
+			packets <- pType
+		}
+	}()
+
+	c := &Client{
+		Config:      NewConfig(),
+		Conn:        NewConn(conn),
+		Users:       Users{},
+		Channels:    Channels{},
+		permissions: map[uint32]*Permission{},
+		state:       uint32(StateSynced),
+		end:         make(chan struct{}),
+	}
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(0), Name: proto.String("Root")})
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(1), Parent: proto.Uint32(0), Name: proto.String("A")})
+	handle(t, (*Client).handleChannelState, c, &MumbleProto.ChannelState{ChannelId: proto.Uint32(2), Parent: proto.Uint32(0), Name: proto.String("B")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), Name: proto.String("a")})
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(2), Name: proto.String("b")})
+	c.Self = c.Users[1]
+	return c, packets
+}
+
+// expectPacket waits for the client to send a packet of type pType, and
+// discards the packets sent before it.
+func expectPacket(t *testing.T, packets <-chan uint16, pType uint16) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-packets:
+			if p == pType {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for packet type %d", pType)
+		}
+	}
+}
+
+func TestMoveContext(t *testing.T) {
+	c, packets := requestClient(t)
+	self, a, b := c.Self, c.Channels[1], c.Channels[2]
+
+	move := func(channel *Channel) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- self.MoveContext(context.Background(), channel)
+		}()
+		// The move, and the ping that completes the request.
+		expectPacket(t, packets, 9)
+		expectPacket(t, packets, 3)
+		return result
+	}
+	wait := func(result <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("MoveContext did not return")
+			return nil
+		}
+	}
+
+	// The server moves the user.
+	result := move(a)
+	handle(t, (*Client).handleUserState, c, &MumbleProto.UserState{Session: proto.Uint32(1), ChannelId: proto.Uint32(1)})
+	handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	if err := wait(result); err != nil || self.Channel != a {
+		t.Fatalf("move failed: %v", err)
+	}
+
+	// The server denies the move.
+	result = move(b)
+	handle(t, (*Client).handlePermissionDenied, c, &MumbleProto.PermissionDenied{
+		Type:       MumbleProto.PermissionDenied_Permission.Enum(),
+		ChannelId:  proto.Uint32(2),
+		Session:    proto.Uint32(1),
+		Permission: proto.Uint32(uint32(PermissionEnter)),
+	})
+	handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	err := wait(result)
+	if denied, ok := err.(*PermissionDeniedError); !ok || denied.Channel != b || denied.Permission != PermissionEnter {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The server ignores the move. Denials of other requests, which refer to
+	// another channel or user, are not matched to the move.
+	result = move(b)
+	handle(t, (*Client).handlePermissionDenied, c, &MumbleProto.PermissionDenied{
+		Type:       MumbleProto.PermissionDenied_Permission.Enum(),
+		ChannelId:  proto.Uint32(1),
+		Session:    proto.Uint32(1),
+		Permission: proto.Uint32(uint32(PermissionEnter)),
+	})
+	handle(t, (*Client).handlePermissionDenied, c, &MumbleProto.PermissionDenied{
+		Type:       MumbleProto.PermissionDenied_Permission.Enum(),
+		ChannelId:  proto.Uint32(2),
+		Session:    proto.Uint32(2),
+		Permission: proto.Uint32(uint32(PermissionMove)),
+	})
+	handle(t, (*Client).handlePing, c, &MumbleProto.Ping{})
+	if err := wait(result); err == nil || self.Channel != a {
+		t.Fatalf("expected error for ignored move, got %v", err)
+	} else if _, ok := err.(*PermissionDeniedError); ok {
+		t.Fatalf("move failed with unrelated denial: %v", err)
+	}
+
+	// The client disconnects.
+	c.closeRequests()
+	if err := self.MoveContext(context.Background(), b); err == nil {
+		t.Fatal("expected error after disconnect")
+	}
+}
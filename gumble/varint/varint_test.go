@@ -30,3 +30,30 @@ func TestRange(t *testing.T) {
 	fn(10282934828342)
 	fn(1028293482834200000)
 }
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{0x7F})
+	f.Add([]byte{0xBF, 0xFF})
+	// math.MinInt64, which Encode used to recurse on until it ran out of
+	// buffer.
+	f.Add([]byte{0xF4, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0xF8, 0xF8, 0xFD})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		val, n := Decode(b)
+		if n < 0 || n > len(b) {
+			t.Fatalf("Decode(%v) read %d bytes", b, n)
+		}
+		if n == 0 {
+			return
+		}
+
+		var buf [MaxVarintLen]byte
+		size := Encode(buf[:], val)
+		if size == 0 {
+			return
+		}
+		if decoded, m := Decode(buf[:size]); decoded != val || m != size {
+			t.Fatalf("Encode(%d) = %v, which decodes to %d", val, buf[:size], decoded)
+		}
+	})
+}
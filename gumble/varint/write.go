@@ -16,6 +16,13 @@ func Encode(b []byte, value int64) int {
 		b[0] = 0xFC | byte(^value&0xFF)
 		return 1
 	}
+	// The magnitude of math.MinInt64 cannot be represented, so it is encoded
+	// as a 64-bit number rather than a negative recursive varint.
+	if value == math.MinInt64 {
+		b[0] = 0xF4
+		binary.BigEndian.PutUint64(b[1:], uint64(value))
+		return 9
+	}
 	// 111110__ + varint Negative recursive varint
 	if value < 0 {
 		b[0] = 0xF8
@@ -0,0 +1,150 @@
+package gumbleaudio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Ogg page header flags.
+const (
+	oggFirst = 0x02
+	oggLast  = 0x04
+)
+
+const oggHeaderSize = 27
+
+var (
+	errNotOgg      = errors.New("gumbleaudio: not an Ogg file")
+	errOggChecksum = errors.New("gumbleaudio: Ogg page checksum mismatch")
+)
+
+// oggCRCTable is the table for the CRC-32 variant used by Ogg (polynomial
+// 0x04c11db7, not reflected, initial value 0).
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func oggCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggReader reads the packets of the first logical bitstream in an Ogg file.
+// Pages of other bitstreams are skipped.
+type oggReader struct {
+	r       *bufio.Reader
+	started bool
+	serial  uint32
+
+	// The lacing values and data of the current page that have not been
+	// read, and whether it is the last page of the bitstream.
+	segments []byte
+	data     []byte
+	last     bool
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// readPage reads the next page of the bitstream.
+func (o *oggReader) readPage() error {
+	for {
+		var header [oggHeaderSize]byte
+		if _, err := io.ReadFull(o.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && !o.started) {
+				return errNotOgg
+			}
+			return err
+		}
+		if string(header[0:4]) != "OggS" || header[4] != 0 {
+			return errNotOgg
+		}
+		flags := header[5]
+		serial := binary.LittleEndian.Uint32(header[14:18])
+		checksum := binary.LittleEndian.Uint32(header[22:26])
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(o.r, segments); err != nil {
+			return errNotOgg
+		}
+		length := 0
+		for _, l := range segments {
+			length += int(l)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return errNotOgg
+		}
+
+		binary.LittleEndian.PutUint32(header[22:26], 0)
+		crc := oggCRC(0, header[:])
+		crc = oggCRC(crc, segments)
+		crc = oggCRC(crc, data)
+		if crc != checksum {
+			return errOggChecksum
+		}
+
+		if !o.started {
+			if flags&oggFirst == 0 {
+				return errNotOgg
+			}
+			o.started = true
+			o.serial = serial
+		}
+		if serial != o.serial {
+			continue
+		}
+		o.segments = segments
+		o.data = data
+		o.last = flags&oggLast != 0
+		return nil
+	}
+}
+
+// readPacket returns the next packet of the bitstream, or io.EOF after the
+// last packet.
+func (o *oggReader) readPacket() ([]byte, error) {
+	var packet []byte
+	partial := false
+	for {
+		if len(o.segments) == 0 {
+			if o.last {
+				return nil, io.EOF
+			}
+			if err := o.readPage(); err != nil {
+				if err == io.EOF && partial {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+		}
+		for len(o.segments) > 0 {
+			l := int(o.segments[0])
+			o.segments = o.segments[1:]
+			packet = append(packet, o.data[:l]...)
+			o.data = o.data[l:]
+			if l < 255 {
+				return packet, nil
+			}
+			partial = true
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gumbleaudio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	errNotOggOpus        = errors.New("gumbleaudio: not an Ogg Opus file")
+	errOpusUnsupported   = errors.New("gumbleaudio: unsupported Opus channel mapping")
+	errOpusInvalidPacket = errors.New("gumbleaudio: invalid Opus packet")
+)
+
+// opusMaxPacketDuration is the maximum duration of an Opus packet.
+const opusMaxPacketDuration = 120 * time.Millisecond
+
+// sourceOggOpus
+
+type sourceOggOpus struct {
+	closer
+	ogg *oggReader
+}
+
+// SourceOggOpus reads the headers of the Ogg Opus file r, and returns a source
+// of its packets. The packets are sent as they are, without being decoded and
+// re-encoded, so Stream.Volume has no effect. Only mono and stereo files
+// (channel mapping family 0) are supported. If r is an io.Closer, it is
+// closed when the stream stops.
+func SourceOggOpus(r io.Reader) (Source, error) {
+	ogg := newOggReader(r)
+
+	// The identification header (RFC 7845, section 5.1).
+	head, err := ogg.readPacket()
+	if err != nil {
+		if err == errOggChecksum {
+			return nil, err
+		}
+		return nil, errNotOggOpus
+	}
+	if len(head) < 19 || !bytes.HasPrefix(head, []byte("OpusHead")) || head[8]>>4 != 0 {
+		return nil, errNotOggOpus
+	}
+	if channels, family := head[9], head[18]; family != 0 || channels == 0 || channels > 2 {
+		return nil, errOpusUnsupported
+	}
+
+	// The comment header.
+	tags, err := ogg.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(tags, []byte("OpusTags")) {
+		return nil, errNotOggOpus
+	}
+
+	return &sourceOggOpus{
+		closer: closer{r: r},
+		ogg:    ogg,
+	}, nil
+}
+
+func (s *sourceOggOpus) readPacket() ([]byte, time.Duration, error) {
+	packet, err := s.ogg.readPacket()
+	if err != nil {
+		return nil, 0, err
+	}
+	duration, err := opusPacketDuration(packet)
+	if err != nil {
+		return nil, 0, err
+	}
+	return packet, duration, nil
+}
+
+// opusFrameDurations are the frame durations of each configuration number
+// (the first five bits of the TOC byte) of an Opus packet (RFC 6716, section
+// 3.1).
+var opusFrameDurations = [32]time.Duration{
+	// SILK-only
+	10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+	// Hybrid
+	10 * time.Millisecond, 20 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond,
+	// CELT-only
+	2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+}
+
+// opusPacketDuration returns the duration of the audio in an Opus packet.
+func opusPacketDuration(packet []byte) (time.Duration, error) {
+	if len(packet) < 1 {
+		return 0, errOpusInvalidPacket
+	}
+	toc := packet[0]
+	var frames int
+	switch toc & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errOpusInvalidPacket
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+	duration := opusFrameDurations[toc>>3] * time.Duration(frames)
+	if duration == 0 || duration > opusMaxPacketDuration {
+		return 0, errOpusInvalidPacket
+	}
+	return duration, nil
+}
@@ -0,0 +1,253 @@
+package gumbleaudio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"layeh.com/gumble/gumble"
+)
+
+// Source is a Stream source.
+type Source interface {
+	// close closes the source's reader, if it is an io.Closer. It can be
+	// called more than once.
+	close()
+}
+
+// pcmSource is a source of mono samples at gumble.AudioSampleRate, which are
+// encoded with the client's audio codec.
+type pcmSource interface {
+	Source
+	// read fills samples, and returns the number of samples read. Samples
+	// are scaled to the range of an int16. Fewer than len(samples) are only
+	// read if an error (e.g. io.EOF) is returned.
+	read(samples []float32) (int, error)
+}
+
+// opusSource is a source of packets that are already encoded with Opus.
+type opusSource interface {
+	Source
+	readPacket() ([]byte, time.Duration, error)
+}
+
+// closer closes an io.Reader once, if it is an io.Closer.
+type closer struct {
+	r    io.Reader
+	once sync.Once
+}
+
+func (c *closer) close() {
+	c.once.Do(func() {
+		if rc, ok := c.r.(io.Closer); ok {
+			rc.Close()
+		}
+	})
+}
+
+// sampleFormat is the encoding of PCM samples.
+type sampleFormat int
+
+const (
+	formatUint8 sampleFormat = iota
+	formatInt16
+	formatInt24
+	formatInt32
+	formatFloat32
+	formatFloat64
+)
+
+// size returns the number of bytes in a sample.
+func (f sampleFormat) size() int {
+	switch f {
+	case formatUint8:
+		return 1
+	case formatInt16:
+		return 2
+	case formatInt24:
+		return 3
+	case formatInt32, formatFloat32:
+		return 4
+	}
+	return 8
+}
+
+// decode decodes a little-endian sample, scaled to the range of an int16.
+func (f sampleFormat) decode(b []byte) float32 {
+	switch f {
+	case formatUint8:
+		return (float32(b[0]) - 128) * 256
+	case formatInt16:
+		return float32(int16(binary.LittleEndian.Uint16(b)))
+	case formatInt24:
+		return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)) / (1 << 16)
+	case formatInt32:
+		return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 16)
+	case formatFloat32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)) * -math.MinInt16
+	}
+	return float32(math.Float64frombits(binary.LittleEndian.Uint64(b)) * -math.MinInt16)
+}
+
+// pcmDecoder reads interleaved PCM frames, and mixes their channels into mono
+// samples.
+type pcmDecoder struct {
+	r        *bufio.Reader
+	format   sampleFormat
+	channels int
+	frame    []byte
+	// The number of bytes of PCM data that remain, or -1 if the data
+	// continues until the end of r.
+	remaining int64
+}
+
+func newPCMDecoder(r *bufio.Reader, format sampleFormat, channels int, length int64) *pcmDecoder {
+	return &pcmDecoder{
+		r:         r,
+		format:    format,
+		channels:  channels,
+		frame:     make([]byte, format.size()*channels),
+		remaining: length,
+	}
+}
+
+// next returns the next sample. An incomplete frame at the end of the data is
+// discarded.
+func (d *pcmDecoder) next() (float32, error) {
+	if d.remaining >= 0 {
+		if d.remaining < int64(len(d.frame)) {
+			return 0, io.EOF
+		}
+		d.remaining -= int64(len(d.frame))
+	}
+	if _, err := io.ReadFull(d.r, d.frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	size := d.format.size()
+	var sum float32
+	for i := 0; i < len(d.frame); i += size {
+		sum += d.format.decode(d.frame[i : i+size])
+	}
+	return sum / float32(d.channels), nil
+}
+
+// resampler converts samples to gumble.AudioSampleRate by linear
+// interpolation.
+type resampler struct {
+	src func() (float32, error)
+	// The number of source samples per output sample.
+	step float64
+	// The position of the next output sample, relative to x0. x1 is the
+	// source sample after x0.
+	pos     float64
+	x0, x1  float32
+	started bool
+	// The error returned by src when reading x1.
+	err error
+}
+
+func newResampler(src func() (float32, error), sampleRate int) *resampler {
+	return &resampler{
+		src:  src,
+		step: float64(sampleRate) / gumble.AudioSampleRate,
+	}
+}
+
+func (r *resampler) next() (float32, error) {
+	if !r.started {
+		x, err := r.src()
+		if err != nil {
+			return 0, err
+		}
+		r.started = true
+		r.x0 = x
+		r.advance()
+	}
+	for r.pos >= 1 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pos--
+		r.x0 = r.x1
+		r.advance()
+	}
+	sample := r.x0 + (r.x1-r.x0)*float32(r.pos)
+	r.pos += r.step
+	return sample, nil
+}
+
+// advance reads x1. At the end of the source, x1 repeats x0.
+func (r *resampler) advance() {
+	r.x1, r.err = r.src()
+	if r.err != nil {
+		r.x1 = r.x0
+	}
+}
+
+// sourcePCM
+
+type sourcePCM struct {
+	closer
+	next func() (float32, error)
+	err  error
+}
+
+// SourcePCM is a source of raw signed 16-bit little-endian PCM (i.e. ffmpeg's
+// s16le format) with the given sample rate and number of interleaved
+// channels. Channels are mixed to mono, and the audio is resampled to
+// gumble.AudioSampleRate. If r is an io.Closer, it is closed when the stream
+// stops.
+func SourcePCM(r io.Reader, sampleRate, channels int) Source {
+	s := &sourcePCM{
+		closer: closer{r: r},
+	}
+	if sampleRate <= 0 || channels <= 0 {
+		s.err = errors.New("gumbleaudio: invalid PCM sample rate or channel count")
+		return s
+	}
+	s.next = pcmSampleReader(bufio.NewReader(r), formatInt16, sampleRate, channels, -1)
+	return s
+}
+
+// pcmSampleReader returns a function that reads mono samples at
+// gumble.AudioSampleRate from PCM data of length bytes (or -1 if unknown).
+func pcmSampleReader(r *bufio.Reader, format sampleFormat, sampleRate, channels int, length int64) func() (float32, error) {
+	decoder := newPCMDecoder(r, format, channels, length)
+	if sampleRate == gumble.AudioSampleRate {
+		return decoder.next
+	}
+	return newResampler(decoder.next, sampleRate).next
+}
+
+func (s *sourcePCM) read(samples []float32) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for i := range samples {
+		sample, err := s.next()
+		if err != nil {
+			return i, err
+		}
+		samples[i] = sample
+	}
+	return len(samples), nil
+}
+
+// clampSample converts a sample to an int16, clipping it to the range of an
+// int16.
+func clampSample(x float32) int16 {
+	switch {
+	case x > math.MaxInt16:
+		return math.MaxInt16
+	case x < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(x)
+}
@@ -0,0 +1,117 @@
+package gumbleaudio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+)
+
+// wavFile returns a WAV file with the given format and data.
+func wavFile(code, channels, sampleRate, bits int, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+16+8+8+len(data)))
+	b.WriteString("WAVE")
+	// An unknown chunk, which is skipped.
+	b.WriteString("LIST")
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString("fmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, uint16(code))
+	binary.Write(&b, binary.LittleEndian, uint16(channels))
+	binary.Write(&b, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&b, binary.LittleEndian, uint32(sampleRate*channels*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(channels*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(bits))
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func readAll(t *testing.T, source Source) []float32 {
+	var samples []float32
+	buffer := make([]float32, 100)
+	for {
+		n, err := source.(pcmSource).read(buffer)
+		samples = append(samples, buffer[:n]...)
+		if err == io.EOF {
+			return samples
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSourceWAV(t *testing.T) {
+	tests := []struct {
+		name       string
+		code, bits int
+		frame      []byte
+	}{
+		{"uint8", wavFormatPCM, 8, []byte{0xC0, 0x40}},
+		{"int16", wavFormatPCM, 16, []byte{0x00, 0x40, 0x00, 0xC0}},
+		{"int24", wavFormatPCM, 24, []byte{0x00, 0x00, 0x40, 0x00, 0x00, 0xC0}},
+		{"int32", wavFormatPCM, 32, []byte{0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0xC0}},
+		{"float32", wavFormatFloat, 32, append(float32Bytes(0.5), float32Bytes(-0.5)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// test.frame is a stereo frame with the left channel at half
+			// scale and the right channel at negative half scale, which mix
+			// to silence. Its first half is a mono frame at half scale.
+			data := bytes.Repeat(test.frame, 480)
+			source, err := SourceWAV(bytes.NewReader(wavFile(test.code, 2, 48000, test.bits, data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples := readAll(t, source)
+			if len(samples) != 480 || samples[0] != 0 {
+				t.Fatalf("got %d samples starting with %v, want 480 silent samples", len(samples), samples[0])
+			}
+
+			source, err = SourceWAV(bytes.NewReader(wavFile(test.code, 1, 48000, test.bits, test.frame[:len(test.frame)/2])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples = readAll(t, source)
+			if len(samples) != 1 || samples[0] != 0x4000 {
+				t.Fatalf("got samples %v, want [16384]", samples)
+			}
+		})
+	}
+
+	if _, err := SourceWAV(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00AVI "))); err != errNotWAV {
+		t.Errorf("got error %v for non-WAV file", err)
+	}
+	if _, err := SourceWAV(bytes.NewReader(wavFile(2, 1, 48000, 4, nil))); err != errWAVUnsupported {
+		t.Errorf("got error %v for ADPCM file", err)
+	}
+}
+
+func float32Bytes(f float32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], math.Float32bits(f))
+	return b[:]
+}
+
+func TestSourcePCMResample(t *testing.T) {
+	// One second of a 24kHz ramp is resampled to one second at 48kHz, with
+	// interpolated samples between the original samples.
+	var data bytes.Buffer
+	for i := 0; i < 24000; i++ {
+		binary.Write(&data, binary.LittleEndian, int16(i%1000))
+	}
+	samples := readAll(t, SourcePCM(&data, 24000, 1))
+	if n := len(samples); n < 47998 || n > 48000 {
+		t.Fatalf("got %d samples, want 48000", n)
+	}
+	for i, want := range []float32{0, 0.5, 1, 1.5, 2} {
+		if samples[i] != want {
+			t.Fatalf("sample %d is %v, want %v", i, samples[i], want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package gumbleaudio plays audio files and streams to a gumble client
+// without ffmpeg.
+//
+// Raw PCM (SourcePCM) and WAV (SourceWAV) sources are decoded and resampled
+// to gumble.AudioSampleRate in Go, and encoded with the client's audio codec.
+// Ogg Opus sources (SourceOggOpus) are sent as-is, without being decoded and
+// re-encoded.
+//
+//	f, err := os.Open("announcement.wav")
+//	if err != nil {
+//		return err
+//	}
+//	source, err := gumbleaudio.SourceWAV(f)
+//	if err != nil {
+//		f.Close()
+//		return err
+//	}
+//	stream := gumbleaudio.New(client, source)
+//	if err := stream.Play(); err != nil {
+//		return err
+//	}
+//	stream.Wait()
+package gumbleaudio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"layeh.com/gumble/gumble"
+)
+
+// State represents the state of a Stream.
+type State int32
+
+// Valid states of Stream.
+const (
+	StateInitial State = iota + 1
+	StatePlaying
+	StatePaused
+	StateStopped
+)
+
+// Stream is an audio stream that sends a Source to the server.
+//
+// A stream can only be used once; it cannot be started after it is stopped.
+type Stream struct {
+	elapsed int64
+
+	// Playback volume (can be changed while the source is playing). It has no
+	// effect on sources that are sent without being re-encoded (i.e.
+	// SourceOggOpus).
+	Volume float32
+	// Audio source (cannot be changed after stream starts).
+	Source Source
+
+	client *gumble.Client
+	state  State
+	// quit is closed to stop the current playback goroutine, which closes
+	// exited when it returns.
+	quit, exited chan struct{}
+
+	l  sync.Mutex
+	wg sync.WaitGroup
+}
+
+// New returns a new Stream for the given gumble Client and Source.
+func New(client *gumble.Client, source Source) *Stream {
+	return &Stream{
+		client: client,
+		Volume: 1.0,
+		Source: source,
+		state:  StateInitial,
+	}
+}
+
+// Play begins playing, or resumes a paused stream.
+func (s *Stream) Play() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	switch s.state {
+	case StatePaused:
+		s.state = StatePlaying
+		s.start()
+		return nil
+	case StatePlaying:
+		return errors.New("gumbleaudio: stream already playing")
+	case StateStopped:
+		return errors.New("gumbleaudio: stream has stopped")
+	}
+
+	// fresh stream
+	if s.Source == nil {
+		return errors.New("gumbleaudio: nil source")
+	}
+	s.wg.Add(1)
+	s.state = StatePlaying
+	s.start()
+	return nil
+}
+
+// start starts the playback goroutine. s.l must be held.
+func (s *Stream) start() {
+	s.quit = make(chan struct{})
+	s.exited = make(chan struct{})
+	go s.process(s.quit, s.exited)
+}
+
+// halt stops the playback goroutine and waits for it to return. s.l must be
+// held; it is released while waiting.
+func (s *Stream) halt() {
+	close(s.quit)
+	exited := s.exited
+	s.l.Unlock()
+	<-exited
+	s.l.Lock()
+}
+
+// State returns the state of the stream.
+func (s *Stream) State() State {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.state
+}
+
+// Pause pauses a playing stream.
+func (s *Stream) Pause() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.state != StatePlaying {
+		return errors.New("gumbleaudio: stream is not playing")
+	}
+	s.state = StatePaused
+	s.halt()
+	return nil
+}
+
+// Stop stops the stream, and closes its source.
+func (s *Stream) Stop() error {
+	s.l.Lock()
+	switch s.state {
+	case StateStopped, StateInitial:
+		s.l.Unlock()
+		return errors.New("gumbleaudio: stream is not playing nor paused")
+	case StatePlaying:
+		// Closing the source interrupts a read that is blocking the playback
+		// goroutine.
+		s.Source.close()
+		s.halt()
+	}
+	s.cleanup()
+	s.l.Unlock()
+	s.Wait()
+	return nil
+}
+
+// Wait returns once the stream has stopped playing.
+func (s *Stream) Wait() {
+	s.wg.Wait()
+}
+
+// Elapsed returns the amount of audio that has been played by the stream.
+func (s *Stream) Elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.elapsed))
+}
+
+// cleanup closes the source and moves the stream to StateStopped. s.l must be
+// held.
+func (s *Stream) cleanup() {
+	if s.state == StateStopped {
+		return
+	}
+	s.Source.close()
+	s.state = StateStopped
+	s.wg.Done()
+}
+
+func (s *Stream) process(quit, exited chan struct{}) {
+	defer close(exited)
+
+	var err error
+	switch source := s.Source.(type) {
+	case pcmSource:
+		err = s.processPCM(source, quit)
+	case opusSource:
+		err = s.processOpus(source, quit)
+	}
+
+	select {
+	case <-quit:
+		// Paused or stopped.
+		return
+	default:
+	}
+	if err == io.EOF {
+		s.client.Logger().Debug("gumbleaudio: end of stream")
+	} else {
+		s.client.Logger().Warn("gumbleaudio: failed to read audio", gumble.LogKeyError, err)
+	}
+	s.l.Lock()
+	if s.state == StatePlaying {
+		s.cleanup()
+	}
+	s.l.Unlock()
+}
+
+// processPCM sends frames of samples read from source until quit is closed,
+// or source returns an error.
+func (s *Stream) processPCM(source pcmSource, quit chan struct{}) error {
+	interval := s.client.Config.AudioInterval
+	frameSize := s.client.Config.AudioFrameSize()
+
+	samples := make([]float32, frameSize)
+
+	outgoing := s.client.AudioOutgoing()
+	defer close(outgoing)
+
+	pacer := newPacer(s.client, interval)
+	for pacer.Wait(quit) {
+		n, err := source.read(samples)
+		if n > 0 {
+			frame := make(gumble.AudioBuffer, frameSize)
+			volume := s.Volume
+			for i, sample := range samples[:n] {
+				frame[i] = clampSample(sample * volume)
+			}
+			outgoing <- frame
+			atomic.AddInt64(&s.elapsed, int64(interval))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processOpus sends packets read from source until quit is closed, or source
+// returns an error.
+func (s *Stream) processOpus(source opusSource, quit chan struct{}) error {
+	outgoing := s.client.AudioOutgoingOpus()
+	defer close(outgoing)
+
+	// Packets vary in duration, so the pacer schedules 10ms units, and each
+	// packet is sent once the units of the previous packet have passed.
+	const unit = gumble.AudioDefaultInterval
+	pacer := newPacer(s.client, unit)
+	if !pacer.Wait(quit) {
+		return nil
+	}
+	var ahead time.Duration
+	for {
+		for ; ahead >= unit; ahead -= unit {
+			if !pacer.Wait(quit) {
+				return nil
+			}
+		}
+		data, duration, err := source.readPacket()
+		if err != nil {
+			return err
+		}
+		select {
+		case outgoing <- gumble.OpusPacket{Data: data, Duration: duration}:
+		case <-quit:
+			return nil
+		}
+		ahead += duration
+		atomic.AddInt64(&s.elapsed, int64(duration))
+	}
+}
+
+// newPacer returns a pacer for the given interval, which logs underruns.
+func newPacer(client *gumble.Client, interval time.Duration) *gumble.AudioPacer {
+	pacer := gumble.NewAudioPacer(interval)
+	pacer.OnUnderrun = func(skipped int) {
+		client.Logger().Warn("gumbleaudio: audio underrun", "skipped", skipped)
+	}
+	return pacer
+}
@@ -0,0 +1,122 @@
+package gumbleaudio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/varint"
+	"layeh.com/gumble/gumbleaudio"
+	"layeh.com/gumble/gumbletest"
+)
+
+// oggPage returns an Ogg page containing packets.
+func oggPage(flags byte, sequence uint32, packets ...[]byte) []byte {
+	var segments, data []byte
+	for _, packet := range packets {
+		n := len(packet)
+		for ; n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(n))
+		data = append(data, packet...)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	header[5] = flags
+	binary.LittleEndian.PutUint32(header[14:], 1)
+	binary.LittleEndian.PutUint32(header[18:], sequence)
+	header[26] = byte(len(segments))
+	page := append(append(header, segments...), data...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	return page
+}
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestStreamOggOpus(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), 0, 0, 0, 0, 0, 0, 0, 0)
+	// 20ms CELT packets, the second of which is large enough to be split
+	// across segments.
+	packets := [][]byte{
+		{0xF8, 1},
+		append([]byte{0xF8}, bytes.Repeat([]byte{2}, 300)...),
+		{0xF8, 3},
+	}
+	var file []byte
+	file = append(file, oggPage(0x02, 0, head)...)
+	file = append(file, oggPage(0, 1, tags)...)
+	file = append(file, oggPage(0, 2, packets[:2]...)...)
+	file = append(file, oggPage(0x04, 3, packets[2])...)
+
+	source, err := gumbleaudio.SourceOggOpus(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := server.Dial(gumble.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	stream := gumbleaudio.New(client, source)
+	start := time.Now()
+	if err := stream.Play(); err != nil {
+		t.Fatal(err)
+	}
+	stream.Wait()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("stream ended after %v, want at least 40ms", elapsed)
+	}
+	if elapsed := stream.Elapsed(); elapsed != 60*time.Millisecond {
+		t.Errorf("got elapsed %v, want 60ms", elapsed)
+	}
+
+	for i, packet := range packets {
+		p, err := server.Expect(5*time.Second, func(p *gumbletest.Packet) bool {
+			return p.Type == 1
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Data[0]>>5 != 4 {
+			t.Fatalf("packet %d has codec %d, want Opus", i, p.Data[0]>>5)
+		}
+		data := p.Data[1:]
+		sequence, n := varint.Decode(data)
+		data = data[n:]
+		length, n := varint.Decode(data)
+		data = data[n:]
+		if sequence != int64(i*2) {
+			t.Errorf("packet %d has sequence %d, want %d", i, sequence, i*2)
+		}
+		if final := length&0x2000 != 0; final != (i == len(packets)-1) {
+			t.Errorf("packet %d has final flag %v", i, final)
+		}
+		if !bytes.Equal(data[:length&0x1FFF], packet) {
+			t.Errorf("packet %d was modified", i)
+		}
+	}
+}
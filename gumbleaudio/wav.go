@@ -0,0 +1,138 @@
+package gumbleaudio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// WAV format codes.
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+var (
+	errNotWAV            = errors.New("gumbleaudio: not a WAV file")
+	errWAVNoData         = errors.New("gumbleaudio: WAV file has no data")
+	errWAVInvalidFormat  = errors.New("gumbleaudio: invalid WAV format")
+	errWAVUnsupported    = errors.New("gumbleaudio: unsupported WAV sample format")
+	errWAVFormatTooLarge = errors.New("gumbleaudio: WAV format chunk is too large")
+)
+
+// SourceWAV reads the header of the WAV file r, and returns a source of its
+// audio. Integer PCM samples of 8, 16, 24 and 32 bits and floating point
+// samples of 32 and 64 bits are supported. Channels are mixed to mono, and
+// the audio is resampled to gumble.AudioSampleRate. If r is an io.Closer, it
+// is closed when the stream stops.
+func SourceWAV(r io.Reader) (Source, error) {
+	br := bufio.NewReader(r)
+
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, errNotWAV
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errNotWAV
+	}
+
+	var format *wavFormat
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return nil, errWAVNoData
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size > 1<<10 {
+				return nil, errWAVFormatTooLarge
+			}
+			data := make([]byte, size+size&1)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, errWAVInvalidFormat
+			}
+			f, err := parseWAVFormat(data[:size])
+			if err != nil {
+				return nil, err
+			}
+			format = f
+		case "data":
+			if format == nil {
+				return nil, errWAVInvalidFormat
+			}
+			// Files that are written while they are streamed may not know
+			// the length of their data.
+			if size == 0 || size == 0xFFFFFFFF {
+				size = -1
+			}
+			return &sourcePCM{
+				closer: closer{r: r},
+				next:   pcmSampleReader(br, format.sampleFormat, format.sampleRate, format.channels, size),
+			}, nil
+		default:
+			if _, err := io.CopyN(ioutil.Discard, br, size+size&1); err != nil {
+				return nil, errWAVNoData
+			}
+		}
+	}
+}
+
+// wavFormat is the content of a WAV file's format chunk.
+type wavFormat struct {
+	sampleFormat sampleFormat
+	sampleRate   int
+	channels     int
+}
+
+func parseWAVFormat(data []byte) (*wavFormat, error) {
+	if len(data) < 16 {
+		return nil, errWAVInvalidFormat
+	}
+	code := binary.LittleEndian.Uint16(data[0:2])
+	channels := int(binary.LittleEndian.Uint16(data[2:4]))
+	sampleRate := int(binary.LittleEndian.Uint32(data[4:8]))
+	blockAlign := int(binary.LittleEndian.Uint16(data[12:14]))
+	bits := int(binary.LittleEndian.Uint16(data[14:16]))
+	if code == wavFormatExtensible {
+		// The format code is the first two bytes of the sub-format GUID.
+		if len(data) < 40 {
+			return nil, errWAVInvalidFormat
+		}
+		code = binary.LittleEndian.Uint16(data[24:26])
+	}
+	if channels == 0 || sampleRate == 0 {
+		return nil, errWAVInvalidFormat
+	}
+
+	var format sampleFormat
+	switch {
+	case code == wavFormatPCM && bits == 8:
+		format = formatUint8
+	case code == wavFormatPCM && bits == 16:
+		format = formatInt16
+	case code == wavFormatPCM && bits == 24:
+		format = formatInt24
+	case code == wavFormatPCM && bits == 32:
+		format = formatInt32
+	case code == wavFormatFloat && bits == 32:
+		format = formatFloat32
+	case code == wavFormatFloat && bits == 64:
+		format = formatFloat64
+	default:
+		return nil, errWAVUnsupported
+	}
+	if blockAlign != format.size()*channels {
+		return nil, errWAVUnsupported
+	}
+	return &wavFormat{
+		sampleFormat: format,
+		sampleRate:   sampleRate,
+		channels:     channels,
+	}, nil
+}
@@ -0,0 +1,10 @@
+// Package gumbleffmpeg plays media to a gumble client through ffmpeg.
+//
+// A Stream plays a single Source; a Player plays a queue of Tracks. Sources
+// are created with SourceFile, SourceReader, SourceExec and SourceURL, and
+// can be given extra ffmpeg input options and audio filters with
+// SourceWithInput and SourceWithFilters.
+//
+// Source is an exported interface: other packages can implement new kinds of
+// sources with its Arguments, Start and Done methods.
+package gumbleffmpeg
@@ -0,0 +1,93 @@
+package gumbleffmpeg
+
+import (
+	"math"
+	"strconv"
+
+	"layeh.com/gumble/gumble"
+)
+
+// DefaultLoudness is the target integrated loudness, in LUFS, recommended by
+// EBU R128. It can be assigned to Stream.Loudness.
+const DefaultLoudness = -23
+
+// Parameters of the loudnorm filter other than the integrated loudness
+// target: the maximum true peak, in dBTP, and the loudness range target, in
+// LU.
+const (
+	loudnormTruePeak = -1.5
+	loudnormRange    = 11
+)
+
+// loudnormFilter returns the ffmpeg filter that normalizes the loudness of
+// the audio to target LUFS.
+func loudnormFilter(target float64) string {
+	return "loudnorm=I=" + strconv.FormatFloat(target, 'f', -1, 64) +
+		":TP=" + strconv.FormatFloat(loudnormTruePeak, 'f', -1, 64) +
+		":LRA=" + strconv.Itoa(loudnormRange)
+}
+
+// volumeRampSamples is the number of samples over which a change in
+// Stream.Volume is applied (50ms).
+const volumeRampSamples = gumble.AudioSampleRate * gumble.AudioChannels / 20
+
+// volumeRamp applies a volume to samples, ramping linearly to the new volume
+// when it changes, so that changes do not produce audible clicks.
+type volumeRamp struct {
+	started bool
+	gain    float32
+	target  float32
+	step    float32
+}
+
+// next returns the gain for the next sample, given the requested volume.
+func (r *volumeRamp) next(volume float32) float32 {
+	if !r.started {
+		r.started = true
+		r.gain, r.target = volume, volume
+		return volume
+	}
+	if volume != r.target {
+		r.target = volume
+		r.step = (volume - r.gain) / volumeRampSamples
+	}
+	if r.gain != r.target {
+		r.gain += r.step
+		if (r.step > 0 && r.gain > r.target) || (r.step < 0 && r.gain < r.target) || r.step == 0 {
+			r.gain = r.target
+		}
+	}
+	return r.gain
+}
+
+// limiterThreshold is the level, relative to full scale, above which the soft
+// limiter compresses samples (about -2 dBFS).
+const limiterThreshold = 0.8
+
+// softLimit compresses samples above limiterThreshold smoothly, so that they
+// approach but never exceed full scale.
+func softLimit(sample float32) float32 {
+	const fullScale = -math.MinInt16
+	x := float64(sample) / fullScale
+	sign := 1.0
+	if x < 0 {
+		sign, x = -1, -x
+	}
+	if x <= limiterThreshold {
+		return sample
+	}
+	const knee = 1 - limiterThreshold
+	return float32(sign * (limiterThreshold + knee*math.Tanh((x-limiterThreshold)/knee)) * fullScale)
+}
+
+// clampSample converts a sample to an int16, clipping it to the range of an
+// int16.
+func clampSample(x float32) int16 {
+	switch {
+	case x > math.MaxInt16:
+		return math.MaxInt16
+	case x < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(x)
+}
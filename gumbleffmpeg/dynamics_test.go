@@ -0,0 +1,119 @@
+package gumbleffmpeg
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLoudnormFilter(t *testing.T) {
+	tests := []struct {
+		target float64
+		filter string
+	}{
+		{DefaultLoudness, "loudnorm=I=-23:TP=-1.5:LRA=11"},
+		{-16, "loudnorm=I=-16:TP=-1.5:LRA=11"},
+		{-14.5, "loudnorm=I=-14.5:TP=-1.5:LRA=11"},
+	}
+	for _, test := range tests {
+		if filter := loudnormFilter(test.target); filter != test.filter {
+			t.Errorf("loudnormFilter(%v) = %q, expected %q", test.target, filter, test.filter)
+		}
+	}
+}
+
+func TestVolumeRamp(t *testing.T) {
+	const n = volumeRampSamples
+	tests := []struct {
+		name    string
+		initial float32
+		volume  float32
+		samples int
+		gain    float32
+	}{
+		{"constant", 0.5, 0.5, 10, 0.5},
+		{"down, quarter", 1, 0, n / 4, 0.75},
+		{"down, half", 1, 0, n / 2, 0.5},
+		{"down, complete", 1, 0, n, 0},
+		{"down, after", 1, 0, 2 * n, 0},
+		{"up, half", 0, 2, n / 2, 1},
+		{"up, complete", 0, 2, n, 2},
+		{"up, after", 0, 2, 2 * n, 2},
+	}
+	for _, test := range tests {
+		var r volumeRamp
+		if gain := r.next(test.initial); gain != test.initial {
+			t.Errorf("%s: initial gain %v, expected %v", test.name, gain, test.initial)
+		}
+		var gain float32
+		for i := 0; i < test.samples; i++ {
+			previous := gain
+			gain = r.next(test.volume)
+			// The gain never overshoots the volume.
+			if i > 0 && (gain-previous)*(test.volume-test.initial) < 0 {
+				t.Errorf("%s: gain moved away from the volume at sample %d", test.name, i)
+			}
+		}
+		if math.Abs(float64(gain-test.gain)) > 1e-3 {
+			t.Errorf("%s: gain %v after %d samples, expected %v", test.name, gain, test.samples, test.gain)
+		}
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	const threshold = limiterThreshold * -math.MinInt16
+	tests := []struct {
+		sample   float32
+		min, max float32
+	}{
+		{0, 0, 0},
+		{1000, 1000, 1000},
+		{-1000, -1000, -1000},
+		{threshold, threshold, threshold},
+		{-threshold, -threshold, -threshold},
+		{math.MaxInt16, threshold, math.MaxInt16},
+		{math.MinInt16, math.MinInt16, -threshold},
+		{2 * math.MaxInt16, math.MaxInt16 - 100, -math.MinInt16},
+		{1e9, math.MaxInt16, -math.MinInt16},
+		{-1e9, math.MinInt16, math.MinInt16},
+	}
+	for _, test := range tests {
+		if limited := softLimit(test.sample); limited < test.min || limited > test.max {
+			t.Errorf("softLimit(%v) = %v, expected [%v, %v]", test.sample, limited, test.min, test.max)
+		}
+	}
+
+	// The limiter is monotonic, and symmetric around zero.
+	previous := softLimit(0)
+	for sample := float32(0); sample < 3*math.MaxInt16; sample += 100 {
+		limited := softLimit(sample)
+		if limited < previous {
+			t.Fatalf("softLimit(%v) = %v, less than the previous sample (%v)", sample, limited, previous)
+		}
+		if softLimit(-sample) != -limited {
+			t.Fatalf("softLimit(%v) = %v, expected %v", -sample, softLimit(-sample), -limited)
+		}
+		previous = limited
+	}
+}
+
+func TestClampSample(t *testing.T) {
+	tests := []struct {
+		sample float32
+		value  int16
+	}{
+		{0, 0},
+		{1000.7, 1000},
+		{-1000.7, -1000},
+		{math.MaxInt16, math.MaxInt16},
+		{math.MaxInt16 + 1, math.MaxInt16},
+		{math.MinInt16, math.MinInt16},
+		{math.MinInt16 - 1, math.MinInt16},
+		{1e9, math.MaxInt16},
+		{-1e9, math.MinInt16},
+	}
+	for _, test := range tests {
+		if value := clampSample(test.sample); value != test.value {
+			t.Errorf("clampSample(%v) = %v, expected %v", test.sample, value, test.value)
+		}
+	}
+}
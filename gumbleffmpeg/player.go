@@ -0,0 +1,707 @@
+package gumbleffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"layeh.com/gumble/gumble"
+)
+
+// Track is an item in a Player's queue. Exactly one of File, URL and Exec
+// must be set.
+type Track struct {
+	// A name for the track, for display purposes.
+	Title string `json:"title,omitempty"`
+	// The file to play (see SourceFile).
+	File string `json:"file,omitempty"`
+	// The URL to play (see SourceURL). The connection is re-established if it
+	// is lost.
+	URL string `json:"url,omitempty"`
+	// A command whose output is played (see SourceExec). The first element is
+	// the command name.
+	Exec []string `json:"exec,omitempty"`
+}
+
+func (t *Track) source() (Source, error) {
+	n := 0
+	for _, set := range []bool{t.File != "", t.URL != "", len(t.Exec) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("gumbleffmpeg: track must have one of a file, a URL or a command")
+	}
+	switch {
+	case t.File != "":
+		return SourceFile(t.File), nil
+	case t.URL != "":
+		return &SourceURL{URL: t.URL, Reconnect: true}, nil
+	}
+	return SourceExec(t.Exec[0], t.Exec[1:]...), nil
+}
+
+// LoopMode specifies what a Player does when a track ends.
+type LoopMode int
+
+// Loop modes.
+const (
+	// LoopNone plays each track in the queue once.
+	LoopNone LoopMode = iota
+	// LoopOne repeats the current track.
+	LoopOne
+	// LoopAll moves each track to the end of the queue once it has been
+	// played.
+	LoopAll
+)
+
+// PlayerEventType specifies the type of a PlayerEvent.
+type PlayerEventType int
+
+// Player event types.
+const (
+	// TrackStart means that the track has started playing.
+	TrackStart PlayerEventType = iota + 1
+	// TrackEnd means that the track has ended, or was skipped or stopped.
+	TrackEnd
+	// TrackError means that the track could not be played, or ffmpeg failed
+	// while playing it. The player continues with the next track.
+	TrackError
+)
+
+// PlayerEvent is the event that is passed to Player.OnEvent.
+type PlayerEvent struct {
+	Player *Player
+	Type   PlayerEventType
+	Track  *Track
+	// The reason for TrackError events.
+	Err error
+}
+
+// Player plays a queue of tracks through ffmpeg.
+//
+// The next track's ffmpeg process is started while the current track is
+// playing, so that there is no gap between tracks.
+type Player struct {
+	// Command to execute to play tracks. Defaults to "ffmpeg".
+	Command string
+	// The loudness normalization target and limiter setting of each track
+	// (see Stream.Loudness and Stream.Limit).
+	Loudness float64
+	Limit    bool
+
+	// OnEvent, if non-nil, is called when a track starts, ends, or fails.
+	// Events are delivered one at a time, in the order in which they happen,
+	// from the player's goroutine or from a goroutine calling one of the
+	// player's methods; OnEvent is never called concurrently with itself. It
+	// should not block, and it can call the player's methods.
+	OnEvent func(e *PlayerEvent)
+
+	// StateFile, if non-empty, is the file to which the queue, the current
+	// track and its position, and the loop mode are written whenever they
+	// change (and when the player is paused or stopped). Restore reads it
+	// back.
+	StateFile string
+
+	client *gumble.Client
+
+	mu      sync.Mutex
+	state   State
+	loop    LoopMode
+	volume  float32
+	queue   []*Track
+	current *Track
+	stream  *Stream
+	// The stream prepared for next, which is the track that plays after
+	// current.
+	next       *Stream
+	nextTrack  *Track
+	stop, done chan struct{}
+	events     []*PlayerEvent
+	// Has the queue or the current track changed since the last flush?
+	dirty bool
+	// Is a goroutine delivering events?
+	delivering bool
+}
+
+// NewPlayer returns a new Player with an empty queue.
+func NewPlayer(client *gumble.Client) *Player {
+	return &Player{
+		Command: "ffmpeg",
+		client:  client,
+		state:   StateStopped,
+		volume:  1.0,
+	}
+}
+
+// Enqueue adds tracks to the end of the queue.
+func (p *Player) Enqueue(tracks ...*Track) {
+	p.mu.Lock()
+	p.queue = append(p.queue, tracks...)
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+}
+
+// Dequeue removes the track at index i from the queue, and returns it.
+func (p *Player) Dequeue(i int) (*Track, error) {
+	p.mu.Lock()
+	if i < 0 || i >= len(p.queue) {
+		p.mu.Unlock()
+		return nil, errors.New("gumbleffmpeg: queue index out of range")
+	}
+	track := p.queue[i]
+	p.queue = append(p.queue[:i], p.queue[i+1:]...)
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+	return track, nil
+}
+
+// Move moves the track at index from to index to, shifting the tracks in
+// between.
+func (p *Player) Move(from, to int) error {
+	p.mu.Lock()
+	if from < 0 || from >= len(p.queue) || to < 0 || to >= len(p.queue) {
+		p.mu.Unlock()
+		return errors.New("gumbleffmpeg: queue index out of range")
+	}
+	track := p.queue[from]
+	p.queue = append(p.queue[:from], p.queue[from+1:]...)
+	p.queue = append(p.queue[:to], append([]*Track{track}, p.queue[to:]...)...)
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+	return nil
+}
+
+// Shuffle randomly reorders the queue.
+func (p *Player) Shuffle() {
+	p.mu.Lock()
+	rand.Shuffle(len(p.queue), func(i, j int) {
+		p.queue[i], p.queue[j] = p.queue[j], p.queue[i]
+	})
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+}
+
+// Clear removes all tracks from the queue. The current track keeps playing.
+func (p *Player) Clear() {
+	p.mu.Lock()
+	p.queue = nil
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+}
+
+// Queue returns the tracks in the queue, not including the current track.
+func (p *Player) Queue() []*Track {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Track(nil), p.queue...)
+}
+
+// Current returns the track that is playing or paused, or nil.
+func (p *Player) Current() *Track {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// State returns StatePlaying, StatePaused, or StateStopped.
+func (p *Player) State() State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// SetLoop sets the player's loop mode.
+func (p *Player) SetLoop(mode LoopMode) {
+	p.mu.Lock()
+	p.loop = mode
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+}
+
+// Loop returns the player's loop mode.
+func (p *Player) Loop() LoopMode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loop
+}
+
+// SetVolume sets the playback volume of the current and following tracks.
+func (p *Player) SetVolume(volume float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.volume = volume
+	if p.stream != nil {
+		p.stream.SetVolume(volume)
+	}
+	if p.next != nil {
+		p.next.SetVolume(volume)
+	}
+}
+
+// Position returns the playback position of the current track.
+func (p *Player) Position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream == nil {
+		return 0
+	}
+	return p.stream.Position()
+}
+
+// Seek moves the playback position of the current track (see Stream.Seek).
+func (p *Player) Seek(offset time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream == nil {
+		return errors.New("gumbleffmpeg: no track is playing")
+	}
+	return p.stream.Seek(offset)
+}
+
+// Play starts playing the queue, or resumes the current track if the player
+// is paused.
+func (p *Player) Play() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state {
+	case StatePlaying:
+		return errors.New("gumbleffmpeg: player already playing")
+	case StateStopped:
+		if p.current == nil && len(p.queue) == 0 {
+			return errors.New("gumbleffmpeg: queue is empty")
+		}
+	}
+	p.state = StatePlaying
+	previous := p.done
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(previous, p.stop, p.done)
+	return nil
+}
+
+// Pause pauses the current track.
+func (p *Player) Pause() error {
+	p.mu.Lock()
+	if p.state != StatePlaying {
+		p.mu.Unlock()
+		return errors.New("gumbleffmpeg: player is not playing")
+	}
+	p.state = StatePaused
+	p.halt()
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+	return nil
+}
+
+// Stop stops the current track. The track is put back at the front of the
+// queue, so that the next Play starts it from the beginning.
+func (p *Player) Stop() error {
+	p.mu.Lock()
+	if p.state == StateStopped {
+		p.mu.Unlock()
+		return errors.New("gumbleffmpeg: player is not playing nor paused")
+	}
+	if p.state == StatePlaying {
+		p.halt()
+	}
+	p.state = StateStopped
+	if p.current != nil {
+		p.queue = append([]*Track{p.current}, p.queue...)
+		p.endTrack(nil)
+	}
+	p.discardNext()
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+	return nil
+}
+
+// Skip ends the current track, and continues with the next track in the
+// queue. In LoopOne mode, the next track is played rather than the current
+// track being repeated.
+func (p *Player) Skip() error {
+	p.mu.Lock()
+	if p.current == nil {
+		p.mu.Unlock()
+		return errors.New("gumbleffmpeg: no track is playing")
+	}
+	if p.loop == LoopAll {
+		p.queue = append(p.queue, p.current)
+	}
+	p.endTrack(nil)
+	p.changed()
+	p.mu.Unlock()
+	p.flush()
+	return nil
+}
+
+// halt tells the playback goroutine to stop. It does not wait, so that it can
+// be called from OnEvent; the next playback goroutine waits for the previous
+// one to exit instead. p.mu must be held.
+func (p *Player) halt() {
+	close(p.stop)
+	p.stop = nil
+}
+
+// run sends the audio of the current track, and advances through the queue,
+// until stop is closed or the queue runs out.
+func (p *Player) run(previous, stop, done chan struct{}) {
+	defer close(done)
+	if previous != nil {
+		<-previous
+	}
+
+	interval := p.client.Config.AudioInterval
+
+	outgoing := p.client.AudioOutgoing()
+	defer close(outgoing)
+
+	pacer := newPacer(p.client)
+	for pacer.Wait(stop) {
+		// Read a frame, moving on to the next track when the current one
+		// ends, so that no frame is left empty between tracks.
+		var frame gumble.AudioBuffer
+		for frame == nil {
+			p.mu.Lock()
+			if p.stop != stop {
+				p.mu.Unlock()
+				return
+			}
+			if p.stream == nil && !p.advance() {
+				p.state = StateStopped
+				p.stop = nil
+				p.changed()
+				p.mu.Unlock()
+				p.flush()
+				return
+			}
+			stream := p.stream
+			p.mu.Unlock()
+			p.flush()
+
+			var ok bool
+			frame, ok = stream.readFrame(interval)
+			if !ok {
+				p.mu.Lock()
+				if p.stream == stream {
+					p.finishTrack()
+				}
+				p.mu.Unlock()
+				p.flush()
+			} else if frame == nil {
+				// The track was seeked; try again on the next frame.
+				break
+			}
+		}
+		if frame != nil {
+			outgoing <- frame
+		}
+	}
+}
+
+// advance starts the next track. It returns false if there is none. p.mu
+// must be held.
+func (p *Player) advance() bool {
+	for {
+		var track *Track
+		if p.current != nil {
+			// Restart a track that was paused before Restore, or that is
+			// repeated.
+			track = p.current
+		} else if len(p.queue) > 0 {
+			track = p.queue[0]
+			p.queue = p.queue[1:]
+		} else {
+			return false
+		}
+
+		var stream *Stream
+		var err error
+		if p.next != nil && p.nextTrack == track {
+			stream = p.next
+			p.next, p.nextTrack = nil, nil
+		} else {
+			stream, err = p.newStream(track)
+		}
+		if err == nil {
+			stream.l.Lock()
+			err = stream.begin()
+			stream.l.Unlock()
+		}
+		p.current = track
+		if err != nil {
+			p.current = nil
+			p.emit(TrackError, track, err)
+			p.changed()
+			continue
+		}
+		p.stream = stream
+		p.emit(TrackStart, track, nil)
+		p.changed()
+		return true
+	}
+}
+
+// finishTrack is called when the current track's stream has ended. p.mu
+// must be held.
+func (p *Player) finishTrack() {
+	track, stream := p.current, p.stream
+	err := stream.Err()
+	p.stream = nil
+	p.current = nil
+	if err != nil {
+		p.emit(TrackError, track, err)
+	} else {
+		p.emit(TrackEnd, track, nil)
+	}
+	// Tracks that fail are not repeated, so that a broken track cannot make
+	// the player loop endlessly.
+	if err == nil {
+		switch p.loop {
+		case LoopOne:
+			p.current = track
+		case LoopAll:
+			p.queue = append(p.queue, track)
+		}
+	}
+	p.changed()
+}
+
+// endTrack stops the current track. p.mu must be held.
+func (p *Player) endTrack(err error) {
+	track, stream := p.current, p.stream
+	p.current, p.stream = nil, nil
+	if stream != nil {
+		stream.Stop()
+	}
+	if track != nil {
+		p.emit(TrackEnd, track, err)
+	}
+}
+
+// upcoming returns the track that plays after the current one, or nil. p.mu
+// must be held.
+func (p *Player) upcoming() *Track {
+	switch {
+	case p.loop == LoopOne && p.current != nil:
+		return p.current
+	case len(p.queue) > 0:
+		return p.queue[0]
+	case p.loop == LoopAll && p.current != nil:
+		return p.current
+	}
+	return nil
+}
+
+// discardNext stops the prepared stream, if any. p.mu must be held.
+func (p *Player) discardNext() {
+	if p.next != nil {
+		p.next.discard()
+		p.next, p.nextTrack = nil, nil
+	}
+}
+
+func (p *Player) newStream(track *Track) (*Stream, error) {
+	source, err := track.source()
+	if err != nil {
+		return nil, err
+	}
+	stream := New(p.client, source)
+	stream.Command = p.Command
+	stream.Volume = p.volume
+	stream.Loudness = p.Loudness
+	stream.Limit = p.Limit
+	return stream, nil
+}
+
+// emit queues an event, which is delivered by flush. p.mu must be held.
+func (p *Player) emit(t PlayerEventType, track *Track, err error) {
+	p.events = append(p.events, &PlayerEvent{
+		Player: p,
+		Type:   t,
+		Track:  track,
+		Err:    err,
+	})
+}
+
+// flush delivers the queued events and, after a change, starts ffmpeg for the
+// upcoming track and saves the state, without holding p.mu. If another
+// goroutine is flushing (including a call from OnEvent), the work is left for
+// it, so that events are delivered in order. p.mu must not be held.
+func (p *Player) flush() {
+	p.mu.Lock()
+	if p.delivering {
+		p.mu.Unlock()
+		return
+	}
+	p.delivering = true
+	for len(p.events) > 0 || p.dirty {
+		if len(p.events) > 0 {
+			events := p.events
+			p.events = nil
+			p.mu.Unlock()
+			if p.OnEvent != nil {
+				for _, e := range events {
+					p.OnEvent(e)
+				}
+			}
+			p.mu.Lock()
+			continue
+		}
+
+		p.dirty = false
+		// The upcoming track is only prepared while a track is playing.
+		var track *Track
+		if p.current != nil && p.stream != nil {
+			track = p.upcoming()
+		}
+		var stale, next *Stream
+		if p.next != nil && p.nextTrack != track {
+			stale = p.next
+			p.next, p.nextTrack = nil, nil
+		}
+		if track != nil && p.next == nil {
+			next, _ = p.newStream(track)
+		}
+		stateFile := p.StateFile
+		var state playerState
+		if stateFile != "" {
+			state = p.savedState()
+		}
+		p.mu.Unlock()
+
+		if stale != nil {
+			stale.discard()
+		}
+		if next != nil {
+			next.l.Lock()
+			err := next.prepare()
+			next.l.Unlock()
+			if err != nil {
+				next = nil
+			}
+		}
+		if stateFile != "" {
+			if err := saveState(stateFile, &state); err != nil {
+				p.client.Logger().Warn("gumbleffmpeg: failed to save player state", gumble.LogKeyError, err)
+			}
+		}
+
+		p.mu.Lock()
+		if next != nil {
+			if p.next == nil && p.current != nil && p.stream != nil && p.upcoming() == track {
+				next.SetVolume(p.volume)
+				p.next, p.nextTrack = next, track
+			} else {
+				// The queue changed while ffmpeg was starting.
+				p.mu.Unlock()
+				next.discard()
+				p.mu.Lock()
+			}
+		}
+	}
+	p.delivering = false
+	p.mu.Unlock()
+}
+
+// changed is called after the queue or the current track changes; flush then
+// prepares the upcoming track and saves the state. p.mu must be held.
+func (p *Player) changed() {
+	p.dirty = true
+}
+
+// playerState is the format of Player.StateFile.
+type playerState struct {
+	Loop     LoopMode      `json:"loop"`
+	Current  *Track        `json:"current,omitempty"`
+	Position time.Duration `json:"position,omitempty"`
+	Queue    []*Track      `json:"queue"`
+}
+
+// savedState returns the player's state, as it is saved to StateFile. p.mu
+// must be held.
+func (p *Player) savedState() playerState {
+	state := playerState{
+		Loop:    p.loop,
+		Current: p.current,
+		Queue:   append([]*Track(nil), p.queue...),
+	}
+	if p.stream != nil {
+		state.Position = p.stream.Position()
+	}
+	return state
+}
+
+// saveState writes state to name.
+func saveState(name string, state *playerState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Restore reads the state saved in StateFile, replacing the player's queue
+// and loop mode. If a track was playing when the state was saved, it becomes
+// the current track, and the next Play resumes it from the saved position.
+// It is not an error if StateFile does not exist.
+func (p *Player) Restore() error {
+	data, err := ioutil.ReadFile(p.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state playerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != StateStopped {
+		return errors.New("gumbleffmpeg: player is not stopped")
+	}
+	p.discardNext()
+	p.loop = state.Loop
+	p.queue = state.Queue
+	p.current = nil
+	if state.Current != nil {
+		p.current = state.Current
+		if state.Position > 0 {
+			if stream, err := p.newStream(state.Current); err == nil {
+				stream.Offset = state.Position
+				p.next, p.nextTrack = stream, state.Current
+			}
+		}
+	}
+	return nil
+}
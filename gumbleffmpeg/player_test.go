@@ -0,0 +1,208 @@
+package gumbleffmpeg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbletest"
+)
+
+// testEncoder records the last frame that was sent.
+type testEncoder struct {
+	mu   sync.Mutex
+	last []int16
+}
+
+func (*testEncoder) ID() int { return 4 }
+
+func (e *testEncoder) Encode(pcm []int16, frameSize, maxDataBytes int) ([]byte, error) {
+	e.mu.Lock()
+	e.last = append(e.last[:0], pcm...)
+	e.mu.Unlock()
+	return []byte{0}, nil
+}
+
+func (*testEncoder) Reset() {}
+
+func (e *testEncoder) lastFrame() []int16 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]int16(nil), e.last...)
+}
+
+// testClient returns a client connected to a gumbletest server.
+func testClient(t *testing.T) *gumble.Client {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client, err := server.Dial(gumble.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	return client
+}
+
+// testPlayer returns a Player that plays tracks with a fake ffmpeg command
+// running script, and a channel that receives its events as strings (e.g.
+// "start a").
+func testPlayer(t *testing.T, script string) (*Player, <-chan string, *testEncoder) {
+	client := testClient(t)
+	encoder := &testEncoder{}
+	client.AudioEncoder = encoder
+
+	p := NewPlayer(client)
+	p.Command = testCommand(t, script)
+	events := make(chan string, 100)
+	var delivering int32
+	p.OnEvent = func(e *PlayerEvent) {
+		if !atomic.CompareAndSwapInt32(&delivering, 0, 1) {
+			t.Error("OnEvent called concurrently")
+		}
+		defer atomic.StoreInt32(&delivering, 0)
+		name := map[PlayerEventType]string{TrackStart: "start", TrackEnd: "end", TrackError: "error"}[e.Type]
+		events <- name + " " + e.Track.Title
+	}
+	t.Cleanup(func() { p.Stop() })
+	return p, events, encoder
+}
+
+func expectEvents(t *testing.T, events <-chan string, expected ...string) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %q, expected %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %q", want)
+		}
+	}
+}
+
+func waitStopped(t *testing.T, p *Player) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for p.State() != StateStopped {
+		if time.Now().After(deadline) {
+			t.Fatal("player did not stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPlayerQueue(t *testing.T) {
+	p, events, _ := testPlayer(t, "head -c 1920 /dev/zero")
+	if err := p.Play(); err == nil {
+		t.Fatal("expected error for empty queue")
+	}
+	p.Enqueue(&Track{Title: "invalid"}, &Track{Title: "a", File: "a"}, &Track{Title: "b", File: "b"})
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "error invalid", "start a", "end a", "start b", "end b")
+	waitStopped(t, p)
+	if p.Current() != nil || len(p.Queue()) != 0 {
+		t.Errorf("unexpected player state after queue ended: %+v, %v", p.Current(), p.Queue())
+	}
+}
+
+func TestPlayerError(t *testing.T) {
+	p, events, _ := testPlayer(t, `case "$*" in *bad*) exit 1;; esac; head -c 1920 /dev/zero`)
+	p.Enqueue(&Track{Title: "bad", File: "bad"}, &Track{Title: "good", File: "good"})
+	p.SetLoop(LoopOne)
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	// Tracks that fail are not repeated.
+	expectEvents(t, events, "start bad", "error bad", "start good", "end good", "start good")
+}
+
+func TestPlayerSkipStop(t *testing.T) {
+	p, events, _ := testPlayer(t, "exec cat /dev/zero")
+	onEvent := p.OnEvent
+	p.OnEvent = func(e *PlayerEvent) {
+		onEvent(e)
+		// The player's methods can be called from OnEvent.
+		if e.Type == TrackStart && e.Track.Title == "a" {
+			if err := p.Skip(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	a, b, c := &Track{Title: "a", File: "a"}, &Track{Title: "b", File: "b"}, &Track{Title: "c", File: "c"}
+	p.Enqueue(a, b, c)
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "start a", "end a", "start b")
+
+	if err := p.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "end b", "start c")
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "end c")
+	if p.State() != StateStopped || p.Current() != nil || !reflect.DeepEqual(p.Queue(), []*Track{c}) {
+		t.Errorf("unexpected player state after stop: %v, %+v, %v", p.State(), p.Current(), p.Queue())
+	}
+}
+
+func TestPlayerVolume(t *testing.T) {
+	// 50 frames of a constant signal.
+	data := make([]byte, 50*960)
+	for i := 0; i < len(data); i += 2 {
+		binary.LittleEndian.PutUint16(data[i:], 1000)
+	}
+	name := filepath.Join(t.TempDir(), "data")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, events, encoder := testPlayer(t, "cat "+name)
+	p.Enqueue(&Track{Title: "a", File: "a"})
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "start a")
+	p.SetVolume(0.5)
+	expectEvents(t, events, "end a")
+
+	frame := encoder.lastFrame()
+	if len(frame) == 0 || frame[len(frame)-1] != 500 {
+		t.Errorf("volume was not applied: last frame %v", frame)
+	}
+}
+
+func TestPlayerStateFile(t *testing.T) {
+	p, _, _ := testPlayer(t, "exit 1")
+	p.StateFile = filepath.Join(t.TempDir(), "state.json")
+	tracks := []*Track{
+		{Title: "a", File: "a"},
+		{Title: "b", URL: "http://example.com/b"},
+		{Title: "c", Exec: []string{"cat", "c"}},
+	}
+	p.Enqueue(tracks...)
+	p.SetLoop(LoopAll)
+
+	restored := NewPlayer(p.client)
+	restored.StateFile = p.StateFile
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Loop() != LoopAll || !reflect.DeepEqual(restored.Queue(), tracks) {
+		t.Errorf("unexpected restored state: %v, %v", restored.Loop(), restored.Queue())
+	}
+}
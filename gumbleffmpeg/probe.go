@@ -0,0 +1,367 @@
+package gumbleffmpeg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata is information about a source's media, as reported by ffprobe.
+// Fields that are not known are left empty.
+type Metadata struct {
+	Title  string
+	Artist string
+	Album  string
+	// The duration of the media. It is zero for live streams, and may be an
+	// estimate for sources that are piped to ffmpeg.
+	Duration time.Duration
+
+	// The audio codec (e.g. "mp3", "opus"), sample rate and number of
+	// channels of the media's first audio stream.
+	Codec      string
+	SampleRate int
+	Channels   int
+
+	// The embedded cover art (e.g. an ID3 APIC frame, or a FLAC picture
+	// block) and its MIME type (e.g. "image/jpeg"), or nil if the media has
+	// none.
+	Cover     []byte
+	CoverType string
+
+	// All of the media's tags. Keys are lowercase.
+	Tags map[string]string
+}
+
+// Probe returns the metadata of source, using the ffprobe and ffmpeg
+// commands (see Stream.Metadata).
+func Probe(source Source) (*Metadata, error) {
+	return probe("ffprobe", "ffmpeg", source)
+}
+
+// probeLimit is the maximum amount of data that is buffered from a reader
+// while it is probed. Probing fails if the commands need more data.
+var probeLimit = 16 << 20
+
+var errProbeLimit = errors.New("gumbleffmpeg: source is too large to be probed")
+
+// probeInput is the media that is passed to ffprobe and ffmpeg when a source
+// is probed.
+type probeInput struct {
+	// The input arguments (see Source.Arguments).
+	args []string
+	// If non-nil, the reader from which the media is read, as the standard
+	// input of each command.
+	r *probeReader
+	// If non-nil, the source that is started for each command, for sources
+	// that do not implement prober.
+	source Source
+}
+
+// output runs the command with the input arguments inserted between arg and
+// output, and returns its standard output.
+func (p *probeInput) output(name string, arg []string, output ...string) ([]byte, error) {
+	args := append(append(append([]string(nil), arg...), p.args...), output...)
+	cmd := exec.Command(name, args...)
+	if p.source != nil {
+		if err := p.source.Start(cmd); err != nil {
+			return nil, err
+		}
+		defer p.source.Done()
+	}
+	if p.r == nil {
+		return cmd.Output()
+	}
+
+	// The standard input is written by a goroutine that only waits for the
+	// probeReader, never for the underlying reader, so that it can be stopped
+	// once the command has exited.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &probeCursor{r: p.r}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(stdin, c)
+		stdin.Close()
+		close(copied)
+	}()
+	err = cmd.Wait()
+	c.cancel()
+	<-copied
+	if c.limited {
+		return nil, errProbeLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// probeReader buffers the data that is read from a reader while it is
+// probed, so that each command, and then the stream, can read it from the
+// start.
+//
+// The reader is read by one goroutine at a time, and only when a command
+// needs more data. A command that exits while the reader is blocked (e.g. on
+// a live stream) does not wait for the read to complete.
+type probeReader struct {
+	r io.Reader
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// The data that has been read from r.
+	buffer []byte
+	// The error returned by r.
+	err error
+	// Is a goroutine reading from r?
+	reading bool
+}
+
+func newProbeReader(r io.Reader) *probeReader {
+	p := &probeReader{
+		r: r,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// fill starts reading more data from r, if no read is in progress. p.mu must
+// be held.
+func (p *probeReader) fill() {
+	if p.reading {
+		return
+	}
+	p.reading = true
+	n := 32 * 1024
+	if rest := probeLimit - len(p.buffer); rest < n {
+		n = rest
+	}
+	go func() {
+		data := make([]byte, n)
+		n, err := p.r.Read(data)
+		p.mu.Lock()
+		p.buffer = append(p.buffer, data[:n]...)
+		p.err = err
+		p.reading = false
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+}
+
+// wait blocks until no read from r is in progress.
+func (p *probeReader) wait() {
+	p.mu.Lock()
+	for p.reading {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+}
+
+// rest returns a reader of all of the media read from r, including the data
+// that was read while probing. It must only be called once the probe's
+// commands have exited.
+func (p *probeReader) rest() io.Reader {
+	return &probeRest{r: p}
+}
+
+// probeRest reads the buffered data of a probeReader, and then the rest of
+// the underlying reader.
+type probeRest struct {
+	r   *probeReader
+	pos int
+}
+
+func (r *probeRest) Read(b []byte) (int, error) {
+	p := r.r
+	p.mu.Lock()
+	for r.pos >= len(p.buffer) && p.reading {
+		p.cond.Wait()
+	}
+	if r.pos < len(p.buffer) {
+		n := copy(b, p.buffer[r.pos:])
+		r.pos += n
+		p.mu.Unlock()
+		return n, nil
+	}
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return p.r.Read(b)
+}
+
+// probeCursor reads a probeReader from the start, for a single command.
+type probeCursor struct {
+	r   *probeReader
+	pos int
+	// Was the read cancelled?
+	cancelled bool
+	// Did the command read up to probeLimit?
+	limited bool
+}
+
+func (c *probeCursor) Read(b []byte) (int, error) {
+	p := c.r
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c.pos >= len(p.buffer) {
+		switch {
+		case c.cancelled:
+			return 0, io.EOF
+		case p.err != nil:
+			return 0, p.err
+		case len(p.buffer) >= probeLimit:
+			c.limited = true
+			return 0, io.EOF
+		}
+		p.fill()
+		p.cond.Wait()
+	}
+	n := copy(b, p.buffer[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+// cancel makes the pending and future reads return io.EOF.
+func (c *probeCursor) cancel() {
+	p := c.r
+	p.mu.Lock()
+	c.cancelled = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// ffprobeOutput is the output of ffprobe -show_format -show_streams.
+type ffprobeOutput struct {
+	Streams []struct {
+		Index       int               `json:"index"`
+		CodecName   string            `json:"codec_name"`
+		CodecType   string            `json:"codec_type"`
+		SampleRate  string            `json:"sample_rate"`
+		Channels    int               `json:"channels"`
+		Duration    string            `json:"duration"`
+		Disposition map[string]int    `json:"disposition"`
+		Tags        map[string]string `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+func probe(ffprobe, ffmpeg string, source Source) (*Metadata, error) {
+	if source == nil {
+		return nil, errors.New("gumbleffmpeg: nil source")
+	}
+	var metadata *Metadata
+	err := probeSource(source, func(input *probeInput) error {
+		var err error
+		metadata, err = probeInputMetadata(ffprobe, ffmpeg, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// probeSource calls f with the input from which the source's metadata is
+// read. Sources that do not implement prober are started for each command
+// that f runs.
+func probeSource(source Source, f func(*probeInput) error) error {
+	if p, ok := source.(prober); ok {
+		return p.probe(f)
+	}
+	return f(&probeInput{
+		args:   source.Arguments(),
+		source: source,
+	})
+}
+
+func probeInputMetadata(ffprobe, ffmpeg string, input *probeInput) (*Metadata, error) {
+	data, err := input.output(ffprobe, []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams"})
+	if err != nil {
+		return nil, err
+	}
+	var output ffprobeOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, errors.New("gumbleffmpeg: invalid ffprobe output")
+	}
+
+	metadata := &Metadata{
+		Tags: make(map[string]string),
+	}
+	addTags(metadata.Tags, output.Format.Tags)
+	metadata.Duration = parseDuration(output.Format.Duration)
+
+	cover := -1
+	audio := false
+	for _, stream := range output.Streams {
+		switch {
+		case stream.CodecType == "audio" && !audio:
+			audio = true
+			metadata.Codec = stream.CodecName
+			metadata.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+			metadata.Channels = stream.Channels
+			if metadata.Duration == 0 {
+				metadata.Duration = parseDuration(stream.Duration)
+			}
+			// Some formats (e.g. Ogg) store tags in the stream rather than the
+			// container.
+			addTags(metadata.Tags, stream.Tags)
+		case stream.CodecType == "video" && stream.Disposition["attached_pic"] == 1 && cover < 0:
+			cover = stream.Index
+		}
+	}
+	if !audio {
+		return nil, errors.New("gumbleffmpeg: source has no audio stream")
+	}
+	metadata.Title = metadata.Tags["title"]
+	metadata.Artist = metadata.Tags["artist"]
+	if metadata.Artist == "" {
+		metadata.Artist = metadata.Tags["album_artist"]
+	}
+	metadata.Album = metadata.Tags["album"]
+
+	if cover >= 0 {
+		image, err := input.output(ffmpeg, []string{"-v", "error"}, "-map", "0:"+strconv.Itoa(cover), "-c", "copy", "-frames:v", "1", "-f", "image2pipe", "-")
+		if err == nil && len(image) > 0 {
+			metadata.Cover = image
+			metadata.CoverType = http.DetectContentType(image)
+		}
+	}
+	return metadata, nil
+}
+
+// addTags adds the tags in src to dst, with lowercase keys. Tags that are
+// already in dst are not replaced.
+func addTags(dst, src map[string]string) {
+	for key, value := range src {
+		key = strings.ToLower(key)
+		if _, ok := dst[key]; !ok {
+			dst[key] = value
+		}
+	}
+}
+
+func parseDuration(s string) time.Duration {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,95 @@
+package gumbleffmpeg
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testProbeOutput = `{"streams":[{"index":0,"codec_type":"audio","codec_name":"mp3","sample_rate":"44100","channels":2}],"format":{"duration":"12.5","tags":{"TITLE":"Song","Artist":"Band"}}}`
+
+// testCommand writes a shell script to a temporary directory, and returns its
+// path.
+func testCommand(t *testing.T, script string) string {
+	name := filepath.Join(t.TempDir(), "command")
+	if err := ioutil.WriteFile(name, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// readerRest returns the reader of a SourceReader, for reading the data that
+// the stream would receive after the source has been probed.
+func readerRest(source Source) io.Reader {
+	return source.(*sourceReader).r
+}
+
+func TestProbeReader(t *testing.T) {
+	ffprobe := testCommand(t, "cat >/dev/null; echo '"+testProbeOutput+"'")
+	data := bytes.Repeat([]byte("media"), 100000)
+	source := SourceReader(ioutil.NopCloser(bytes.NewReader(data)))
+
+	metadata, err := probe(ffprobe, "false", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Title != "Song" || metadata.Artist != "Band" || metadata.Codec != "mp3" || metadata.SampleRate != 44100 || metadata.Channels != 2 || metadata.Duration != 12500*time.Millisecond {
+		t.Errorf("unexpected metadata: %+v", metadata)
+	}
+	rest, err := ioutil.ReadAll(readerRest(source))
+	if err != nil || !bytes.Equal(rest, data) {
+		t.Errorf("source data changed by probing (%d bytes, %v)", len(rest), err)
+	}
+}
+
+func TestProbeLimit(t *testing.T) {
+	defer func(limit int) { probeLimit = limit }(probeLimit)
+	probeLimit = 1024
+
+	ffprobe := testCommand(t, "cat >/dev/null; echo '"+testProbeOutput+"'")
+	data := bytes.Repeat([]byte("media"), 1000)
+	source := SourceReader(ioutil.NopCloser(bytes.NewReader(data)))
+
+	if _, err := probe(ffprobe, "false", source); err != errProbeLimit {
+		t.Fatalf("expected errProbeLimit, got %v", err)
+	}
+	rest, err := ioutil.ReadAll(readerRest(source))
+	if err != nil || !bytes.Equal(rest, data) {
+		t.Errorf("source data changed by probing (%d bytes, %v)", len(rest), err)
+	}
+}
+
+func TestProbeLiveReader(t *testing.T) {
+	ffprobe := testCommand(t, "head -c 3 >/dev/null; echo '"+testProbeOutput+"'")
+	r, w := io.Pipe()
+	source := SourceReader(r)
+	go w.Write([]byte("first"))
+
+	// The command exits while the source is waiting for more data, which must
+	// not block the probe.
+	done := make(chan error, 1)
+	go func() {
+		_, err := probe(ffprobe, "false", source)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("probe blocked on live reader")
+	}
+
+	go func() {
+		w.Write([]byte(" second"))
+		w.Close()
+	}()
+	rest, err := ioutil.ReadAll(readerRest(source))
+	if err != nil || string(rest) != "first second" {
+		t.Errorf("unexpected source data %q (%v)", rest, err)
+	}
+}
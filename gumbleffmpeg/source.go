@@ -1,16 +1,45 @@
 package gumbleffmpeg
 
 import (
+	"errors"
 	"io"
+	"net/http"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Source is a Stream source.
+// Source is a Stream source. It specifies the input from which ffmpeg reads
+// the media.
+//
+// Other packages can implement Source to add new kinds of sources. Sources
+// whose input is not seekable by ffmpeg (e.g. "-" with a reader set as the
+// standard input) should be aware that Start is called again when the stream
+// is seeked, and when the source is probed for its metadata.
 type Source interface {
-	// must include the -i <filename>
-	arguments() []string
-	start(*exec.Cmd) error
-	done()
+	// Arguments returns the ffmpeg arguments that specify the input. It must
+	// include "-i <input>", preceded by any input options.
+	Arguments() []string
+	// Start is called before ffmpeg is started, e.g. to set its standard
+	// input.
+	Start(cmd *exec.Cmd) error
+	// Done is called after ffmpeg has exited, or if it could not be started.
+	Done()
+}
+
+// prober is implemented by the sources in this package whose input cannot be
+// read more than once. It calls f with the input from which the source's
+// metadata is read.
+type prober interface {
+	probe(f func(*probeInput) error) error
+}
+
+// filterer is implemented by sources that add audio filters to the ffmpeg
+// command.
+type filterer interface {
+	filters() []string
 }
 
 // sourceFile
@@ -22,41 +51,63 @@ func SourceFile(filename string) Source {
 	return sourceFile(filename)
 }
 
-func (s sourceFile) arguments() []string {
+func (s sourceFile) Arguments() []string {
 	return []string{"-i", string(s)}
 }
 
-func (sourceFile) start(*exec.Cmd) error {
+func (sourceFile) Start(*exec.Cmd) error {
 	return nil
 }
 
-func (sourceFile) done() {
+func (sourceFile) Done() {
 }
 
 // sourceReader
 
 type sourceReader struct {
-	r io.ReadCloser
+	r       io.ReadCloser
+	started bool
 }
 
 // SourceReader is a ReadCloser source.
 func SourceReader(r io.ReadCloser) Source {
-	return &sourceReader{r}
+	return &sourceReader{r: r}
 }
 
-func (*sourceReader) arguments() []string {
+func (*sourceReader) Arguments() []string {
 	return []string{"-i", "-"}
 }
 
-func (s *sourceReader) start(cmd *exec.Cmd) error {
+func (s *sourceReader) Start(cmd *exec.Cmd) error {
+	s.started = true
 	cmd.Stdin = s.r
 	return nil
 }
 
-func (s *sourceReader) done() {
+func (s *sourceReader) Done() {
 	s.r.Close()
 }
 
+// probe reads the data that ffprobe needs from the reader. The data is kept,
+// and played before the rest of the reader.
+func (s *sourceReader) probe(f func(*probeInput) error) error {
+	if s.started {
+		return errors.New("gumbleffmpeg: reader source cannot be probed after it has started")
+	}
+	r := newProbeReader(s.r)
+	err := f(&probeInput{
+		args: s.Arguments(),
+		r:    r,
+	})
+	s.r = readCloser{r.rest(), s.r}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // sourceExec
 
 type sourceExec struct {
@@ -75,11 +126,11 @@ func SourceExec(name string, arg ...string) Source {
 	}
 }
 
-func (*sourceExec) arguments() []string {
+func (*sourceExec) Arguments() []string {
 	return []string{"-i", "-"}
 }
 
-func (s *sourceExec) start(cmd *exec.Cmd) error {
+func (s *sourceExec) Start(cmd *exec.Cmd) error {
 	s.cmd = exec.Command(s.name, s.arg...)
 	r, err := s.cmd.StdoutPipe()
 	if err != nil {
@@ -93,7 +144,30 @@ func (s *sourceExec) start(cmd *exec.Cmd) error {
 	return nil
 }
 
-func (s *sourceExec) done() {
+// probe runs the command separately from the stream, and reads the media from
+// its output.
+func (s *sourceExec) probe(f func(*probeInput) error) error {
+	cmd := exec.Command(s.name, s.arg...)
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	input := newProbeReader(r)
+	err = f(&probeInput{
+		args: s.Arguments(),
+		r:    input,
+	})
+	cmd.Process.Kill()
+	// The pipe must not be closed by Wait while it is being read.
+	input.wait()
+	cmd.Wait()
+	return err
+}
+
+func (s *sourceExec) Done() {
 	if s.cmd != nil {
 		if p := s.cmd.Process; p != nil {
 			p.Kill()
@@ -101,3 +175,115 @@ func (s *sourceExec) done() {
 		s.cmd.Wait()
 	}
 }
+
+// SourceURL is a source that ffmpeg reads from a URL (e.g. an HTTP stream or
+// an internet radio station).
+type SourceURL struct {
+	URL string
+	// Reconnect when the connection is lost, including for streams that are
+	// not seekable (e.g. live streams). ReconnectDelayMax is the maximum delay
+	// between reconnection attempts; zero uses ffmpeg's default.
+	Reconnect         bool
+	ReconnectDelayMax time.Duration
+	// HTTP headers sent with the request, and the value of the User-Agent
+	// header.
+	Header    http.Header
+	UserAgent string
+}
+
+// Arguments implements Source.
+func (s *SourceURL) Arguments() []string {
+	var args []string
+	if s.Reconnect {
+		args = append(args, "-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_on_network_error", "1")
+		if s.ReconnectDelayMax > 0 {
+			args = append(args, "-reconnect_delay_max", strconv.Itoa(int((s.ReconnectDelayMax+time.Second-1)/time.Second)))
+		}
+	}
+	if len(s.Header) > 0 {
+		keys := make([]string, 0, len(s.Header))
+		for key := range s.Header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		for _, key := range keys {
+			for _, value := range s.Header[key] {
+				b.WriteString(key + ": " + value + "\r\n")
+			}
+		}
+		args = append(args, "-headers", b.String())
+	}
+	if s.UserAgent != "" {
+		args = append(args, "-user_agent", s.UserAgent)
+	}
+	return append(args, "-i", s.URL)
+}
+
+// Start implements Source.
+func (*SourceURL) Start(*exec.Cmd) error {
+	return nil
+}
+
+// Done implements Source.
+func (*SourceURL) Done() {
+}
+
+// sourceOptions
+
+type sourceOptions struct {
+	Source
+	input  []string
+	filter []string
+}
+
+// SourceWithInput returns a source that passes the given input options (e.g.
+// "-f", "s16le", "-ar", "44100") to ffmpeg before the input of source.
+func SourceWithInput(source Source, args ...string) Source {
+	return &sourceOptions{
+		Source: source,
+		input:  args,
+	}
+}
+
+// SourceWithFilters returns a source whose audio is passed through the given
+// ffmpeg audio filters (e.g. "atempo=1.25", "highpass=f=200"). The filters
+// are joined into a single -af filter chain, which is applied before loudness
+// normalization (see Stream.Loudness).
+func SourceWithFilters(source Source, filters ...string) Source {
+	return &sourceOptions{
+		Source: source,
+		filter: filters,
+	}
+}
+
+func (s *sourceOptions) Arguments() []string {
+	return append(append([]string(nil), s.input...), s.Source.Arguments()...)
+}
+
+func (s *sourceOptions) filters() []string {
+	var filters []string
+	if f, ok := s.Source.(filterer); ok {
+		filters = f.filters()
+	}
+	return append(filters, s.filter...)
+}
+
+func (s *sourceOptions) probe(f func(*probeInput) error) error {
+	return probeSource(s.Source, func(input *probeInput) error {
+		input.args = append(append([]string(nil), s.input...), input.args...)
+		return f(input)
+	})
+}
+
+// baseSource returns the source wrapped by SourceWithInput and
+// SourceWithFilters.
+func baseSource(source Source) Source {
+	for {
+		options, ok := source.(*sourceOptions)
+		if !ok {
+			return source
+		}
+		source = options.Source
+	}
+}
@@ -0,0 +1,115 @@
+package gumbleffmpeg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSourceArguments(t *testing.T) {
+	file := SourceFile("a.mp3")
+	tests := []struct {
+		source  Source
+		args    []string
+		filters []string
+	}{
+		{file, []string{"-i", "a.mp3"}, nil},
+		{SourceReader(ioutil.NopCloser(nil)), []string{"-i", "-"}, nil},
+		{SourceExec("cat", "a.mp3"), []string{"-i", "-"}, nil},
+		{&SourceURL{URL: "http://example.com/a.mp3"}, []string{"-i", "http://example.com/a.mp3"}, nil},
+		{
+			SourceWithInput(file, "-f", "mp3"),
+			[]string{"-f", "mp3", "-i", "a.mp3"},
+			nil,
+		},
+		{
+			SourceWithInput(SourceWithInput(file, "-f", "mp3"), "-re"),
+			[]string{"-re", "-f", "mp3", "-i", "a.mp3"},
+			nil,
+		},
+		{
+			SourceWithFilters(file, "atempo=1.25", "highpass=f=200"),
+			[]string{"-i", "a.mp3"},
+			[]string{"atempo=1.25", "highpass=f=200"},
+		},
+		{
+			SourceWithFilters(SourceWithInput(SourceWithFilters(file, "atempo=1.25"), "-re"), "highpass=f=200"),
+			[]string{"-re", "-i", "a.mp3"},
+			[]string{"atempo=1.25", "highpass=f=200"},
+		},
+	}
+	for _, test := range tests {
+		if args := test.source.Arguments(); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%#v: got arguments %q, expected %q", test.source, args, test.args)
+		}
+		var filters []string
+		if f, ok := test.source.(filterer); ok {
+			filters = f.filters()
+		}
+		if !reflect.DeepEqual(filters, test.filters) {
+			t.Errorf("%#v: got filters %q, expected %q", test.source, filters, test.filters)
+		}
+	}
+
+	wrapped := SourceWithFilters(SourceWithInput(file, "-re"), "atempo=1.25")
+	if base := baseSource(wrapped); base != file {
+		t.Errorf("baseSource returned %#v, expected %#v", base, file)
+	}
+}
+
+func TestSourceStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		source Source
+	}{
+		{"reader", SourceReader(ioutil.NopCloser(strings.NewReader("media")))},
+		{"exec", SourceExec("printf", "media")},
+		{"options", SourceWithFilters(SourceWithInput(SourceExec("printf", "media"), "-re"), "atempo=1.25")},
+	}
+	for _, test := range tests {
+		// The source's input is the standard input of ffmpeg.
+		cmd := exec.Command("cat")
+		if err := test.source.Start(cmd); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		output, err := cmd.Output()
+		test.source.Done()
+		if err != nil || string(output) != "media" {
+			t.Errorf("%s: ffmpeg read %q (%v), expected %q", test.name, output, err, "media")
+		}
+	}
+}
+
+func TestSourceReaderProbeAfterStart(t *testing.T) {
+	source := SourceReader(ioutil.NopCloser(bytes.NewReader(nil)))
+	if err := source.Start(exec.Command("true")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := probe("true", "true", source); err == nil {
+		t.Error("expected error probing a started reader source")
+	}
+}
+
+func TestStreamFilters(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "args")
+	s := New(testClient(t), SourceWithFilters(&SourceURL{URL: "http://example.com/a.mp3", UserAgent: "gumble"}, "atempo=1.25"))
+	s.Command = testCommand(t, `echo "$*" >`+log)
+	s.Loudness = DefaultLoudness
+	if err := s.Play(); err != nil {
+		t.Fatal(err)
+	}
+	s.Wait()
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-user_agent gumble -i http://example.com/a.mp3 -af atempo=1.25,loudnorm=I=-23:TP=-1.5:LRA=11 -ac 1 -ar 48000 -f s16le -"
+	if args := strings.TrimSpace(string(data)); args != expected {
+		t.Errorf("got arguments %q, expected %q", args, expected)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,20 +32,42 @@ const (
 type Stream struct {
 	// Command to execute to play the file. Defaults to "ffmpeg".
 	Command string
-	// Playback volume (can be changed while the source is playing).
+	// Command to execute to probe the source's metadata. Defaults to
+	// "ffprobe".
+	ProbeCommand string
+	// Playback volume. It is read before each frame, so it can be changed
+	// while the stream is playing (SetVolume does so safely from another
+	// goroutine); changes are applied gradually over a short ramp.
 	Volume float32
+	// Target integrated loudness in LUFS (e.g. DefaultLoudness), to which
+	// ffmpeg's loudnorm filter normalizes the source. Zero disables
+	// normalization. Volume is applied after normalization.
+	Loudness float64
+	// Whether to compress samples that approach full scale with a soft
+	// limiter, rather than clipping them.
+	Limit bool
 	// Audio source (cannot be changed after stream starts).
 	Source Source
 	// Starting offset.
 	Offset time.Duration
 
 	client  *gumble.Client
-	cmd     *exec.Cmd
-	pipe    io.ReadCloser
+	decoder *decoder
 	pause   chan struct{}
+	ramp    volumeRamp
 	elapsed int64
+	// The media position at which the current ffmpeg process started, and the
+	// amount of audio that has been played from it.
+	offset int64
+	played int64
 
 	state State
+	// The error that the last ffmpeg process exited with.
+	err error
+
+	probeOnce   sync.Once
+	metadata    *Metadata
+	metadataErr error
 
 	l  sync.Mutex
 	wg sync.WaitGroup
@@ -53,12 +76,13 @@ type Stream struct {
 // New returns a new Stream for the given gumble Client and Source.
 func New(client *gumble.Client, source Source) *Stream {
 	return &Stream{
-		client:  client,
-		Volume:  1.0,
-		Source:  source,
-		Command: "ffmpeg",
-		pause:   make(chan struct{}),
-		state:   StateInitial,
+		client:       client,
+		Volume:       1.0,
+		Source:       source,
+		Command:      "ffmpeg",
+		ProbeCommand: "ffprobe",
+		pause:        make(chan struct{}),
+		state:        StateInitial,
 	}
 }
 
@@ -83,28 +107,181 @@ func (s *Stream) Play() error {
 		return errors.New("gumbleffmpeg: nil source")
 	}
 
-	args := s.Source.arguments()
-	if s.Offset > 0 {
-		args = append([]string{"-ss", strconv.FormatFloat(s.Offset.Seconds(), 'f', -1, 64)}, args...)
+	if err := s.begin(); err != nil {
+		return err
+	}
+	go s.process()
+	return nil
+}
+
+// prepare starts ffmpeg ahead of time, so that playback can begin without
+// delay. s.l must be held.
+func (s *Stream) prepare() error {
+	if s.decoder != nil {
+		return nil
+	}
+	if s.Source == nil {
+		return errors.New("gumbleffmpeg: nil source")
+	}
+	return s.start(s.Offset)
+}
+
+// begin moves a fresh stream to StatePlaying, without starting process. s.l
+// must be held.
+func (s *Stream) begin() error {
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	s.wg.Add(1)
+	s.state = StatePlaying
+	return nil
+}
+
+// discard stops ffmpeg if it was started by prepare, and moves the stream to
+// StateStopped. It must only be called on streams in StateInitial.
+func (s *Stream) discard() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.decoder != nil {
+		s.kill()
+	}
+	s.state = StateStopped
+}
+
+// start starts ffmpeg at the given media offset. s.l must be held.
+func (s *Stream) start(offset time.Duration) error {
+	args := append([]string(nil), s.Source.Arguments()...)
+	if offset > 0 {
+		args = append([]string{"-ss", strconv.FormatFloat(offset.Seconds(), 'f', -1, 64)}, args...)
+	}
+	var filters []string
+	if f, ok := s.Source.(filterer); ok {
+		filters = f.filters()
+	}
+	if s.Loudness != 0 {
+		filters = append(filters, loudnormFilter(s.Loudness))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
 	}
 	args = append(args, "-ac", strconv.Itoa(gumble.AudioChannels), "-ar", strconv.Itoa(gumble.AudioSampleRate), "-f", "s16le", "-")
 	cmd := exec.Command(s.Command, args...)
-	var err error
-	s.pipe, err = cmd.StdoutPipe()
+	pipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	if err := s.Source.start(cmd); err != nil {
+	if err := s.Source.Start(cmd); err != nil {
 		return err
 	}
 	if err := cmd.Start(); err != nil {
-		s.Source.done()
+		s.Source.Done()
 		return err
 	}
-	s.wg.Add(1)
-	s.cmd = cmd
-	s.state = StatePlaying
-	go s.process()
+	s.client.Logger().Debug("gumbleffmpeg: started ffmpeg", "args", args)
+	s.decoder = newDecoder(cmd, pipe, s.client.Config.AudioFrameSize()*2)
+	atomic.StoreInt64(&s.offset, int64(offset))
+	atomic.StoreInt64(&s.played, 0)
+	return nil
+}
+
+// kill stops the running ffmpeg process. s.l must be held.
+func (s *Stream) kill() {
+	if err := s.decoder.kill(); err != nil {
+		s.client.Logger().Debug("gumbleffmpeg: ffmpeg exited", gumble.LogKeyError, err)
+	}
+	s.Source.Done()
+}
+
+// decoder reads frames of audio from an ffmpeg process. Its goroutine owns
+// the process' output, and waits for the process once the output has been
+// read to the end; other goroutines only signal the process.
+type decoder struct {
+	cmd    *exec.Cmd
+	frames chan []byte
+	// The error that the output could not be read with, and the error that
+	// the process exited with. Valid once frames is closed.
+	readErr error
+	err     error
+}
+
+func newDecoder(cmd *exec.Cmd, pipe io.Reader, frameBytes int) *decoder {
+	d := &decoder{
+		cmd:    cmd,
+		frames: make(chan []byte),
+	}
+	go d.run(pipe, frameBytes)
+	return d
+}
+
+func (d *decoder) run(pipe io.Reader, frameBytes int) {
+	defer close(d.frames)
+	for {
+		frame := make([]byte, frameBytes)
+		if _, err := io.ReadFull(pipe, frame); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				d.readErr = err
+				d.cmd.Process.Kill()
+			}
+			break
+		}
+		d.frames <- frame
+	}
+	d.err = d.cmd.Wait()
+}
+
+// kill stops the process, discards its remaining output, and returns the
+// error it exited with.
+func (d *decoder) kill() error {
+	d.cmd.Process.Kill()
+	for range d.frames {
+	}
+	return d.err
+}
+
+// Err returns the error that ffmpeg exited with, if the stream ended because
+// ffmpeg failed (e.g. because the source could not be opened).
+func (s *Stream) Err() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.err
+}
+
+// Seek moves the playback position of the stream to offset. If the stream is
+// playing or paused, ffmpeg is restarted at the new position, and the stream
+// remains playing or paused. If the stream has not been started, Offset is
+// set instead.
+//
+// Sources created with SourceReader cannot be seeked once the stream has
+// started. If ffmpeg cannot be restarted, the stream is stopped.
+func (s *Stream) Seek(offset time.Duration) error {
+	if offset < 0 {
+		return errors.New("gumbleffmpeg: negative seek offset")
+	}
+	s.l.Lock()
+	switch s.state {
+	case StateInitial:
+		s.Offset = offset
+		s.l.Unlock()
+		return nil
+	case StateStopped:
+		s.l.Unlock()
+		return errors.New("gumbleffmpeg: stream has stopped")
+	}
+	if _, ok := baseSource(s.Source).(*sourceReader); ok {
+		s.l.Unlock()
+		return errors.New("gumbleffmpeg: source cannot be seeked")
+	}
+
+	// process notices that the decoder has been replaced, and continues
+	// reading from the new one.
+	s.kill()
+	if err := s.start(offset); err != nil {
+		s.state = StateStopped
+		s.wg.Done()
+		s.l.Unlock()
+		return err
+	}
+	s.l.Unlock()
 	return nil
 }
 
@@ -115,6 +292,14 @@ func (s *Stream) State() State {
 	return s.state
 }
 
+// SetVolume sets the playback volume. It can be called while the stream is
+// playing.
+func (s *Stream) SetVolume(volume float32) {
+	s.l.Lock()
+	s.Volume = volume
+	s.l.Unlock()
+}
+
 // Pause pauses a playing stream.
 func (s *Stream) Pause() error {
 	s.l.Lock()
@@ -151,39 +336,116 @@ func (s *Stream) Elapsed() time.Duration {
 	return time.Duration(atomic.LoadInt64(&s.elapsed))
 }
 
+// Position returns the current media position of the stream, i.e. the
+// starting offset (or the offset of the last Seek) plus the amount of audio
+// that has been played since.
+func (s *Stream) Position() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.offset) + atomic.LoadInt64(&s.played))
+}
+
+// Metadata returns the metadata of the stream's source, as reported by
+// ProbeCommand (cover art is extracted with Command). The result is cached
+// after the first call.
+//
+// Sources created with SourceReader must be probed before the stream is
+// started; the data read while probing is buffered, and played from the
+// start. Probing fails if more than 16 MiB of the reader would need to be
+// buffered. Sources created with SourceExec run their command an additional
+// time to be probed.
+func (s *Stream) Metadata() (*Metadata, error) {
+	s.probeOnce.Do(func() {
+		s.metadata, s.metadataErr = probe(s.ProbeCommand, s.Command, s.Source)
+	})
+	return s.metadata, s.metadataErr
+}
+
+// Duration returns the duration of the stream's source (see Metadata).
+func (s *Stream) Duration() (time.Duration, error) {
+	metadata, err := s.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	if metadata.Duration == 0 {
+		return 0, errors.New("gumbleffmpeg: unknown source duration")
+	}
+	return metadata.Duration, nil
+}
+
 func (s *Stream) process() {
 	// s.state has been set to StatePlaying
 
 	interval := s.client.Config.AudioInterval
-	frameSize := s.client.Config.AudioFrameSize()
-
-	byteBuffer := make([]byte, frameSize*2)
 
 	outgoing := s.client.AudioOutgoing()
 	defer close(outgoing)
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.pause:
+	pacer := newPacer(s.client)
+	for pacer.Wait(s.pause) {
+		frame, ok := s.readFrame(interval)
+		if !ok {
 			return
-		case <-ticker.C:
-			if _, err := io.ReadFull(s.pipe, byteBuffer); err != nil {
-				s.l.Lock()
-				s.cleanup()
-				return
-			}
-			int16Buffer := make([]int16, frameSize)
-			for i := range int16Buffer {
-				float := float32(int16(binary.LittleEndian.Uint16(byteBuffer[i*2 : (i+1)*2])))
-				int16Buffer[i] = int16(s.Volume * float)
+		}
+		if frame != nil {
+			outgoing <- frame
+		}
+	}
+}
+
+// newPacer returns a pacer for the client's audio interval, which logs
+// underruns.
+func newPacer(client *gumble.Client) *gumble.AudioPacer {
+	pacer := gumble.NewAudioPacer(client.Config.AudioInterval)
+	pacer.OnUnderrun = func(skipped int) {
+		client.Logger().Warn("gumbleffmpeg: audio underrun", "skipped", skipped)
+	}
+	return pacer
+}
+
+// readFrame reads the next frame of audio from ffmpeg. It returns a nil frame
+// if the stream was seeked while reading, and false once the stream has ended.
+func (s *Stream) readFrame(interval time.Duration) (gumble.AudioBuffer, bool) {
+	s.l.Lock()
+	decoder := s.decoder
+	s.l.Unlock()
+	buffer, ok := <-decoder.frames
+	if !ok {
+		s.l.Lock()
+		if s.decoder != decoder && s.state != StateStopped {
+			// The stream was seeked.
+			s.l.Unlock()
+			return nil, true
+		}
+		if s.state != StateStopped {
+			if decoder.readErr != nil {
+				s.client.Logger().Warn("gumbleffmpeg: failed to read audio", gumble.LogKeyError, decoder.readErr)
+			} else {
+				s.client.Logger().Debug("gumbleffmpeg: end of stream")
+				s.err = decoder.err
 			}
-			atomic.AddInt64(&s.elapsed, int64(interval))
-			outgoing <- gumble.AudioBuffer(int16Buffer)
 		}
+		s.cleanup()
+		return nil, false
+	}
+	s.l.Lock()
+	volume, limit := s.Volume, s.Limit
+	s.l.Unlock()
+	int16Buffer := make([]int16, len(buffer)/2)
+	for i := range int16Buffer {
+		float := float32(int16(binary.LittleEndian.Uint16(buffer[i*2:(i+1)*2]))) * s.ramp.next(volume)
+		if limit {
+			float = softLimit(float)
+		}
+		int16Buffer[i] = clampSample(float)
+	}
+	s.l.Lock()
+	seeked := s.decoder != decoder
+	s.l.Unlock()
+	if seeked {
+		return nil, true
 	}
+	atomic.AddInt64(&s.elapsed, int64(interval))
+	atomic.AddInt64(&s.played, int64(interval))
+	return gumble.AudioBuffer(int16Buffer), true
 }
 
 func (s *Stream) cleanup() {
@@ -192,9 +454,7 @@ func (s *Stream) cleanup() {
 	if s.state == StateStopped {
 		return
 	}
-	s.cmd.Process.Kill()
-	s.cmd.Wait()
-	s.Source.done()
+	s.kill()
 	for len(s.pause) > 0 {
 		<-s.pause
 	}
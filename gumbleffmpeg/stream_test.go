@@ -0,0 +1,142 @@
+package gumbleffmpeg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceURLArguments(t *testing.T) {
+	tests := []struct {
+		source *SourceURL
+		args   []string
+	}{
+		{
+			&SourceURL{URL: "http://example.com/a.mp3"},
+			[]string{"-i", "http://example.com/a.mp3"},
+		},
+		{
+			&SourceURL{URL: "u", Reconnect: true},
+			[]string{"-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_on_network_error", "1", "-i", "u"},
+		},
+		{
+			&SourceURL{URL: "u", Reconnect: true, ReconnectDelayMax: 1500 * time.Millisecond},
+			[]string{"-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_on_network_error", "1", "-reconnect_delay_max", "2", "-i", "u"},
+		},
+		{
+			&SourceURL{URL: "u", ReconnectDelayMax: time.Second},
+			[]string{"-i", "u"},
+		},
+		{
+			&SourceURL{
+				URL:       "u",
+				Header:    http.Header{"X-B": {"2"}, "X-A": {"1", "3"}},
+				UserAgent: "gumble",
+			},
+			[]string{"-headers", "X-A: 1\r\nX-A: 3\r\nX-B: 2\r\n", "-user_agent", "gumble", "-i", "u"},
+		},
+	}
+	for _, test := range tests {
+		if args := test.source.Arguments(); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%+v: got %q, expected %q", test.source, args, test.args)
+		}
+	}
+}
+
+func TestStreamSeek(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "args")
+	s := New(testClient(t), SourceWithFilters(SourceWithInput(SourceFile("a.mp3"), "-f", "mp3"), "atempo=1.25"))
+	s.Command = testCommand(t, `echo "$*" >>`+log+`; exec cat /dev/zero`)
+	s.Offset = 1500 * time.Millisecond
+
+	if err := s.Play(); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, s, s.Offset)
+	// Seeking while the stream is reading from ffmpeg, and while it is
+	// paused.
+	if err := s.Seek(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if position := s.Position(); position < 30*time.Second {
+		t.Errorf("position %v after seeking to 30s", position)
+	}
+	waitPosition(t, s, 30*time.Second)
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Seek(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Play(); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, s, 0)
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := " -f mp3 -i a.mp3 -af atempo=1.25 -ac 1 -ar 48000 -f s16le -"
+	expected := []string{"-ss 1.5" + output, "-ss 30" + output, output[1:]}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("got arguments %q, expected %q", lines, expected)
+	}
+}
+
+func TestStreamVolumeField(t *testing.T) {
+	// 50 frames of a constant signal.
+	data := make([]byte, 50*960)
+	for i := 0; i < len(data); i += 2 {
+		binary.LittleEndian.PutUint16(data[i:], 1000)
+	}
+	name := filepath.Join(t.TempDir(), "data")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := testClient(t)
+	encoder := &testEncoder{}
+	client.AudioEncoder = encoder
+
+	s := New(client, SourceFile("a"))
+	s.Command = testCommand(t, "cat "+name)
+	if err := s.Play(); err != nil {
+		t.Fatal(err)
+	}
+	waitPosition(t, s, 100*time.Millisecond)
+	// Writing the field while the stream is paused does not race with
+	// playback.
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	s.Volume = 0.5
+	if err := s.Play(); err != nil {
+		t.Fatal(err)
+	}
+	s.Wait()
+
+	frame := encoder.lastFrame()
+	if len(frame) == 0 || frame[len(frame)-1] != 500 {
+		t.Errorf("volume was not applied: last frame %v", frame)
+	}
+}
+
+// waitPosition waits until the stream has played audio past offset.
+func waitPosition(t *testing.T, s *Stream, offset time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Position() <= offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream did not play past %v", offset)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
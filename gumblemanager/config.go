@@ -0,0 +1,120 @@
+package gumblemanager
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+	"layeh.com/gumble/gumble"
+)
+
+// ServerConfig describes the connection to one server.
+type ServerConfig struct {
+	// The name that identifies the server in events, log messages and
+	// metrics. It must be unique within a Manager.
+	Name string `yaml:"name"`
+	// The server address. If no port is given, gumble.DefaultPort is used.
+	Address string `yaml:"address"`
+
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password,omitempty"`
+	Tokens   []string `yaml:"tokens,omitempty"`
+
+	// Skip server certificate verification.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// The user certificate and key files (PEM). If Key is empty, the key is
+	// read from Certificate.
+	Certificate string `yaml:"certificate,omitempty"`
+	Key         string `yaml:"key,omitempty"`
+}
+
+// configFile is the format of the file read by ReadConfig.
+type configFile struct {
+	Servers []ServerConfig `yaml:"servers"`
+}
+
+// ReadConfig reads server configurations in YAML format:
+//
+//	servers:
+//	  - name: eu
+//	    address: eu.example.com
+//	    username: bot
+//	  - name: us
+//	    address: us.example.com:64739
+//	    username: bot
+//	    certificate: bot.pem
+func ReadConfig(r io.Reader) ([]ServerConfig, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var file configFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(file.Servers))
+	for i := range file.Servers {
+		server := &file.Servers[i]
+		if err := server.validate(); err != nil {
+			return nil, err
+		}
+		if names[server.Name] {
+			return nil, errors.New("gumblemanager: duplicate server name " + strconv.Quote(server.Name))
+		}
+		names[server.Name] = true
+	}
+	return file.Servers, nil
+}
+
+// LoadConfig reads server configurations from the named file (see
+// ReadConfig).
+func LoadConfig(filename string) ([]ServerConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadConfig(f)
+}
+
+func (s *ServerConfig) validate() error {
+	if s.Name == "" {
+		return errors.New("gumblemanager: server name is empty")
+	}
+	if s.Address == "" {
+		return errors.New("gumblemanager: server " + strconv.Quote(s.Name) + " has no address")
+	}
+	return nil
+}
+
+// address returns the server address, with the default port added if it has
+// none.
+func (s *ServerConfig) address() string {
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return net.JoinHostPort(s.Address, strconv.Itoa(gumble.DefaultPort))
+	}
+	return s.Address
+}
+
+func (s *ServerConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: s.Insecure,
+	}
+	if s.Certificate != "" {
+		key := s.Key
+		if key == "" {
+			key = s.Certificate
+		}
+		certificate, err := tls.LoadX509KeyPair(s.Certificate, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, certificate)
+	}
+	return config, nil
+}
@@ -0,0 +1,418 @@
+// Package gumblemanager runs gumble clients for many servers in one process.
+//
+// A Manager connects to each configured server, reconnects when a connection
+// is lost, and fans the clients' events in to a single channel, tagged with
+// the server's name. The clients share the Manager's Logger and metrics
+// Collector. Audio codecs are registered process-wide (see
+// gumble.RegisterAudioCodec), so all managed clients use the same codecs.
+//
+//	servers, err := gumblemanager.LoadConfig("servers.yaml")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	manager := gumblemanager.New()
+//	for _, server := range servers {
+//		manager.Add(server)
+//	}
+//	events := manager.Events()
+//	go func() {
+//		for e := range events {
+//			if m, ok := e.Event.(*gumble.TextMessageEvent); ok {
+//				log.Printf("%s: %s", e.Server, m.Message)
+//			}
+//		}
+//	}()
+//	manager.Run(ctx)
+package gumblemanager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumblemetrics"
+	"layeh.com/gumble/gumbleutil"
+)
+
+// LogKeyServer is the attribute key of the server name in log messages.
+const LogKeyServer = "server"
+
+// Default Manager settings.
+const (
+	DefaultDialTimeout = 30 * time.Second
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = time.Minute
+)
+
+// ServerEvent is an event from one of a Manager's clients.
+type ServerEvent struct {
+	// The name of the server that the event came from.
+	Server string
+	// The client event. Its users and channels are snapshots (see
+	// gumble.Listeners.AttachAsync).
+	Event gumble.Event
+}
+
+// Manager owns the clients of a set of servers.
+type Manager struct {
+	// Configure, if non-nil, is called before each connection attempt to
+	// customize the server's Config, e.g. to attach event listeners. A new
+	// Config is created for each attempt.
+	Configure func(server *ServerConfig, config *gumble.Config)
+
+	// Logger, if non-nil, is used by all clients. Each message is tagged with
+	// the server name (see LogKeyServer).
+	Logger gumble.Logger
+	// Metrics, if non-nil, collects the metrics of all clients under their
+	// server names.
+	Metrics *gumblemetrics.Collector
+
+	// The timeout of each connection attempt, and the minimum and maximum
+	// delay between reconnection attempts. The delay doubles after each
+	// failed attempt. If zero, the defaults are used.
+	DialTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	mu       sync.Mutex
+	servers  map[string]*server
+	ctx      context.Context
+	stopped  bool
+	wg       sync.WaitGroup
+	forward  bool
+	events   chan ServerEvent
+	stopping chan struct{}
+	// eventsMu is held for reading while events are sent, so that events can
+	// be closed safely.
+	eventsMu     sync.RWMutex
+	eventsClosed bool
+}
+
+type server struct {
+	config ServerConfig
+	cancel context.CancelFunc
+	// done is closed when the server's supervisor returns.
+	done   chan struct{}
+	client *gumble.Client
+}
+
+// New returns a new Manager with no servers.
+func New() *Manager {
+	return &Manager{
+		servers:  make(map[string]*server),
+		events:   make(chan ServerEvent, gumble.AsyncDefaultQueueSize),
+		stopping: make(chan struct{}),
+	}
+}
+
+// Add adds a server to the manager. If the manager is running, the server is
+// connected to immediately.
+func (m *Manager) Add(config ServerConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.servers[config.Name] != nil {
+		return errors.New("gumblemanager: duplicate server name " + strconv.Quote(config.Name))
+	}
+	s := &server{
+		config: config,
+	}
+	m.servers[config.Name] = s
+	if m.ctx != nil && !m.stopped {
+		m.start(s)
+	}
+	return nil
+}
+
+// Remove disconnects from the named server and removes it from the manager.
+// It blocks until the server's connection attempt, if any, has finished.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	s := m.servers[name]
+	delete(m.servers, name)
+	m.mu.Unlock()
+	if s == nil {
+		return errors.New("gumblemanager: unknown server " + strconv.Quote(name))
+	}
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	if m.Metrics != nil {
+		m.Metrics.Remove(name)
+	}
+	return nil
+}
+
+// Servers returns the names of the manager's servers, sorted.
+func (m *Manager) Servers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.servers))
+	for name := range m.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Client returns the client that is connected to the named server, or nil if
+// the server is not connected.
+func (m *Manager) Client(name string) *gumble.Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.servers[name]; s != nil {
+		return s.client
+	}
+	return nil
+}
+
+// Events returns the channel that receives the events of all clients. It
+// must be called before Run; clients that connected earlier do not forward
+// their events. The channel is closed when Run returns.
+//
+// Each client queues its events while the channel is not being read. When a
+// client's queue is full, its oldest event is dropped and a warning is
+// logged.
+func (m *Manager) Events() <-chan ServerEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forward = true
+	return m.events
+}
+
+// Run connects to the manager's servers, and keeps them connected until ctx
+// is done. The clients are then disconnected, and Run returns ctx.Err(). Run
+// can only be called once.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.ctx != nil {
+		m.mu.Unlock()
+		return errors.New("gumblemanager: manager has already been run")
+	}
+	m.ctx = ctx
+	for _, s := range m.servers {
+		m.start(s)
+	}
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+	close(m.stopping)
+	m.wg.Wait()
+
+	m.eventsMu.Lock()
+	m.eventsClosed = true
+	close(m.events)
+	m.eventsMu.Unlock()
+	return ctx.Err()
+}
+
+// start starts the server's supervisor. m.mu must be held.
+func (m *Manager) start(s *server) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	m.wg.Add(1)
+	go m.supervise(ctx, s)
+}
+
+func (m *Manager) setClient(s *server, client *gumble.Client) {
+	m.mu.Lock()
+	s.client = client
+	m.mu.Unlock()
+}
+
+// supervise keeps the server connected until ctx is done.
+func (m *Manager) supervise(ctx context.Context, s *server) {
+	defer m.wg.Done()
+	defer close(s.done)
+	logger := m.logger(s.config.Name)
+
+	minBackoff, maxBackoff := m.MinBackoff, m.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	backoff := minBackoff
+
+	for {
+		client, disconnected, err := m.connect(ctx, s, logger)
+		if err != nil {
+			logger.Warn("gumblemanager: failed to connect", gumble.LogKeyError, err)
+		} else {
+			if ctx.Err() != nil {
+				// The server was removed while connecting.
+				client.Disconnect()
+				m.setClient(s, nil)
+				return
+			}
+			backoff = minBackoff
+
+			var e *gumble.DisconnectEvent
+			select {
+			case e = <-disconnected:
+			case <-ctx.Done():
+				client.Disconnect()
+				<-disconnected
+			}
+			m.setClient(s, nil)
+			if ctx.Err() != nil {
+				return
+			}
+			if e.Type == gumble.DisconnectBanned {
+				logger.Error("gumblemanager: banned from server, not reconnecting", gumble.LogKeyReason, e.String)
+				return
+			}
+			logger.Warn("gumblemanager: disconnected from server", gumble.LogKeyReason, e.String)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connect connects to the server. The returned channel receives the client's
+// DisconnectEvent.
+func (m *Manager) connect(ctx context.Context, s *server, logger gumble.Logger) (*gumble.Client, <-chan *gumble.DisconnectEvent, error) {
+	tlsConfig, err := s.config.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := gumble.NewConfig()
+	config.Username = s.config.Username
+	config.Password = s.config.Password
+	config.Tokens = gumble.AccessTokens(s.config.Tokens)
+	config.Logger = logger
+
+	disconnected := make(chan *gumble.DisconnectEvent, 1)
+	config.Attach(gumbleutil.Listener{
+		// This listener is attached first, so that the client is available
+		// to the other listeners and consumers of the ConnectEvent.
+		Connect: func(e *gumble.ConnectEvent) {
+			if ctx.Err() != nil {
+				return
+			}
+			m.setClient(s, e.Client)
+			if m.Metrics != nil {
+				m.Metrics.Set(s.config.Name, e.Client)
+			}
+		},
+		Disconnect: func(e *gumble.DisconnectEvent) {
+			disconnected <- e
+		},
+	})
+	if m.Configure != nil {
+		m.Configure(&s.config, config)
+	}
+	m.mu.Lock()
+	forward := m.forward
+	m.mu.Unlock()
+	if forward {
+		config.AttachAsync(&forwarder{m: m, server: s.config.Name}, gumble.AsyncOptions{
+			Overflow: gumble.AsyncOverflowDropOldest,
+			OnDrop: func(interface{}) {
+				logger.Warn("gumblemanager: event queue full, event dropped")
+			},
+		})
+	}
+
+	dialTimeout := m.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+	}
+	client, err := gumble.DialWithDialer(dialer, s.config.address(), config, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, disconnected, nil
+}
+
+// send sends an event to the events channel, unless the manager is stopping.
+func (m *Manager) send(e ServerEvent) {
+	m.eventsMu.RLock()
+	defer m.eventsMu.RUnlock()
+	if m.eventsClosed {
+		return
+	}
+	select {
+	case m.events <- e:
+	case <-m.stopping:
+	}
+}
+
+func (m *Manager) logger(name string) gumble.Logger {
+	if m.Logger == nil {
+		return gumble.NopLogger{}
+	}
+	return serverLogger{
+		logger: m.Logger,
+		server: name,
+	}
+}
+
+// forwarder sends a client's events to the manager's events channel.
+type forwarder struct {
+	m      *Manager
+	server string
+}
+
+func (f *forwarder) forward(e gumble.Event) {
+	f.m.send(ServerEvent{
+		Server: f.server,
+		Event:  e,
+	})
+}
+
+func (f *forwarder) OnConnect(e *gumble.ConnectEvent)                   { f.forward(e) }
+func (f *forwarder) OnDisconnect(e *gumble.DisconnectEvent)             { f.forward(e) }
+func (f *forwarder) OnTextMessage(e *gumble.TextMessageEvent)           { f.forward(e) }
+func (f *forwarder) OnUserChange(e *gumble.UserChangeEvent)             { f.forward(e) }
+func (f *forwarder) OnChannelChange(e *gumble.ChannelChangeEvent)       { f.forward(e) }
+func (f *forwarder) OnPermissionDenied(e *gumble.PermissionDeniedEvent) { f.forward(e) }
+func (f *forwarder) OnUserList(e *gumble.UserListEvent)                 { f.forward(e) }
+func (f *forwarder) OnACL(e *gumble.ACLEvent)                           { f.forward(e) }
+func (f *forwarder) OnBanList(e *gumble.BanListEvent)                   { f.forward(e) }
+func (f *forwarder) OnContextActionChange(e *gumble.ContextActionChangeEvent) {
+	f.forward(e)
+}
+func (f *forwarder) OnServerConfig(e *gumble.ServerConfigEvent) { f.forward(e) }
+
+// serverLogger adds the server name to each message.
+type serverLogger struct {
+	logger gumble.Logger
+	server string
+}
+
+func (l serverLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{LogKeyServer, l.server}, args...)
+}
+
+func (l serverLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.args(args)...) }
+func (l serverLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.args(args)...) }
+func (l serverLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.args(args)...) }
+func (l serverLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.args(args)...) }
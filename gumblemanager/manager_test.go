@@ -0,0 +1,166 @@
+package gumblemanager
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumblemetrics"
+	"layeh.com/gumble/gumbletest"
+	"layeh.com/gumble/gumbleutil"
+)
+
+func TestManager(t *testing.T) {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	accept := func() {
+		go func() {
+			if err := server.Accept(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	m := New()
+	m.Metrics = gumblemetrics.NewCollector()
+	m.MinBackoff = 10 * time.Millisecond
+	if err := m.Add(ServerConfig{Name: "a", Address: server.Addr(), Username: "bot", Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(ServerConfig{Name: "a", Address: server.Addr()}); err == nil {
+		t.Fatal("added duplicate server")
+	}
+	events := m.Events()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	accept()
+	go func() {
+		done <- m.Run(ctx)
+	}()
+
+	expect := func(want gumble.EventType) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Server != "a" {
+					t.Fatalf("unexpected server %q", e.Server)
+				}
+				var filter gumble.EventFilter
+				filter.Types = want
+				if filter.Match(e.Event) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for event %v", want)
+			}
+		}
+	}
+	expect(gumble.EventConnect)
+
+	accept()
+	server.Disconnect()
+	expect(gumble.EventDisconnect)
+	expect(gumble.EventConnect)
+	if m.Client("a") == nil {
+		t.Error("client is not connected")
+	}
+
+	var buf bytes.Buffer
+	m.Metrics.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `gumble_reconnects_total{client="a"} 1`) {
+		t.Errorf("reconnect was not counted:\n%s", buf.String())
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range events {
+	}
+	if m.Client("a") != nil {
+		t.Error("client is still connected")
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	servers, err := ReadConfig(strings.NewReader(`
+servers:
+  - name: eu
+    address: eu.example.com
+    username: bot
+  - name: us
+    address: us.example.com:64739
+    username: bot
+    tokens: [a, b]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[0].address() != "eu.example.com:64738" || servers[1].address() != "us.example.com:64739" || len(servers[1].Tokens) != 2 {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+
+	if _, err := ReadConfig(strings.NewReader("servers:\n  - name: a\n    address: x\n  - name: a\n    address: y\n")); err == nil {
+		t.Error("duplicate server names were accepted")
+	}
+}
+
+func TestManagerRemove(t *testing.T) {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Accept()
+
+	m := New()
+	m.Metrics = gumblemetrics.NewCollector()
+	connected := make(chan *gumble.Client, 1)
+	m.Configure = func(_ *ServerConfig, config *gumble.Config) {
+		config.Attach(gumbleutil.Listener{
+			Connect: func(e *gumble.ConnectEvent) {
+				connected <- m.Client("a")
+			},
+		})
+	}
+	if err := m.Add(ServerConfig{Name: "a", Address: server.Addr(), Username: "bot", Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	select {
+	case client := <-connected:
+		if client == nil {
+			t.Fatal("client was not set before the connect event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+
+	if err := m.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Client("a") != nil {
+		t.Error("client is still connected")
+	}
+	var buf bytes.Buffer
+	m.Metrics.WriteTo(&buf)
+	if strings.Contains(buf.String(), `client="a"`) {
+		t.Errorf("metrics were not removed:\n%s", buf.String())
+	}
+	if err := m.Remove("a"); err == nil {
+		t.Error("removed unknown server")
+	}
+}
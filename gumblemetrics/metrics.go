@@ -0,0 +1,245 @@
+// Package gumblemetrics exports gumble client statistics in the Prometheus
+// text exposition format and through expvar.
+//
+// A Collector holds a set of named clients:
+//
+//	collector := gumblemetrics.NewCollector()
+//	collector.Set("bot", client)
+//	http.Handle("/metrics", collector)
+//
+// When a client reconnects, the new *gumble.Client should be passed to Set
+// under the same name; the replacement is counted as a reconnect.
+package gumblemetrics
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"layeh.com/gumble/gumble"
+)
+
+type entry struct {
+	client     *gumble.Client
+	reconnects uint64
+}
+
+// Collector collects the metrics of a set of named clients. It is safe for
+// concurrent use.
+type Collector struct {
+	mu      sync.Mutex
+	clients map[string]*entry
+}
+
+// NewCollector returns a new, empty Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		clients: make(map[string]*entry),
+	}
+}
+
+// Set adds client to the collector under the given name. If a different
+// client was previously set under the name, it is replaced and the name's
+// reconnect count is incremented.
+func (c *Collector) Set(name string, client *gumble.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.clients[name]; ok {
+		if e.client != client {
+			e.client = client
+			e.reconnects++
+		}
+		return
+	}
+	c.clients[name] = &entry{client: client}
+}
+
+// Remove removes the client with the given name from the collector.
+func (c *Collector) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, name)
+}
+
+type sample struct {
+	name       string
+	metrics    gumble.Metrics
+	connected  bool
+	reconnects uint64
+}
+
+// collect returns the current metrics of the clients, sorted by name.
+func (c *Collector) collect() []sample {
+	c.mu.Lock()
+	samples := make([]sample, 0, len(c.clients))
+	clients := make([]*gumble.Client, 0, len(c.clients))
+	for name, e := range c.clients {
+		samples = append(samples, sample{name: name, reconnects: e.reconnects})
+		clients = append(clients, e.client)
+	}
+	c.mu.Unlock()
+
+	for i, client := range clients {
+		samples[i].metrics = client.Metrics()
+		samples[i].connected = client.State() != gumble.StateDisconnected
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].name < samples[j].name
+	})
+	return samples
+}
+
+// ServeHTTP writes the collector's metrics in the Prometheus text exposition
+// format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the collector's metrics to w in the Prometheus text
+// exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	samples := c.collect()
+	b := &writer{w: bufio.NewWriter(w)}
+
+	b.family("gumble_connected", "gauge", "Whether the client is connected to the server.")
+	for _, s := range samples {
+		v := 0.0
+		if s.connected {
+			v = 1
+		}
+		b.value("gumble_connected", s.name, "", v)
+	}
+	b.family("gumble_reconnects_total", "counter", "The number of times the client was replaced by a new connection.")
+	for _, s := range samples {
+		b.value("gumble_reconnects_total", s.name, "", float64(s.reconnects))
+	}
+	b.family("gumble_ping_average_milliseconds", "gauge", "The average TCP ping time to the server.")
+	for _, s := range samples {
+		b.value("gumble_ping_average_milliseconds", s.name, "", float64(s.metrics.PingAverage))
+	}
+	b.family("gumble_ping_variance_milliseconds", "gauge", "The variance of the TCP ping time to the server.")
+	for _, s := range samples {
+		b.value("gumble_ping_variance_milliseconds", s.name, "", float64(s.metrics.PingVariance))
+	}
+	b.family("gumble_packets_received_total", "counter", "The number of control packets received, by packet type.")
+	for _, s := range samples {
+		b.packets("gumble_packets_received_total", s.name, s.metrics.PacketsReceived)
+	}
+	b.family("gumble_packets_sent_total", "counter", "The number of control packets sent, by packet type.")
+	for _, s := range samples {
+		b.packets("gumble_packets_sent_total", s.name, s.metrics.PacketsSent)
+	}
+	b.family("gumble_voice_frames_encoded_total", "counter", "The number of voice frames encoded and sent.")
+	for _, s := range samples {
+		b.value("gumble_voice_frames_encoded_total", s.name, "", float64(s.metrics.VoiceFramesEncoded))
+	}
+	b.family("gumble_voice_frames_decoded_total", "counter", "The number of voice frames received and decoded.")
+	for _, s := range samples {
+		b.value("gumble_voice_frames_decoded_total", s.name, "", float64(s.metrics.VoiceFramesDecoded))
+	}
+	b.family("gumble_voice_decode_errors_total", "counter", "The number of received voice frames that could not be decoded.")
+	for _, s := range samples {
+		b.value("gumble_voice_decode_errors_total", s.name, "", float64(s.metrics.VoiceDecodeErrors))
+	}
+	b.family("gumble_voice_frames_dropped_total", "counter", "The number of voice frames that were dropped.")
+	for _, s := range samples {
+		b.value("gumble_voice_frames_dropped_total", s.name, "", float64(s.metrics.VoiceFramesDropped))
+	}
+	b.family("gumble_users", "gauge", "The number of users connected to the server.")
+	for _, s := range samples {
+		b.value("gumble_users", s.name, "", float64(s.metrics.Users))
+	}
+	b.family("gumble_channels", "gauge", "The number of channels on the server.")
+	for _, s := range samples {
+		b.value("gumble_channels", s.name, "", float64(s.metrics.Channels))
+	}
+
+	if b.err == nil {
+		b.err = b.w.Flush()
+	}
+	return b.n, b.err
+}
+
+// Var returns an expvar.Var that reports the collector's metrics as a JSON
+// object keyed by client name.
+func (c *Collector) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		samples := c.collect()
+		m := make(map[string]interface{}, len(samples))
+		for _, s := range samples {
+			m[s.name] = map[string]interface{}{
+				"connected":            s.connected,
+				"reconnects":           s.reconnects,
+				"ping_average_ms":      s.metrics.PingAverage,
+				"ping_variance_ms":     s.metrics.PingVariance,
+				"packets_received":     s.metrics.PacketsReceived,
+				"packets_sent":         s.metrics.PacketsSent,
+				"voice_frames_encoded": s.metrics.VoiceFramesEncoded,
+				"voice_frames_decoded": s.metrics.VoiceFramesDecoded,
+				"voice_decode_errors":  s.metrics.VoiceDecodeErrors,
+				"voice_frames_dropped": s.metrics.VoiceFramesDropped,
+				"users":                s.metrics.Users,
+				"channels":             s.metrics.Channels,
+			}
+		}
+		return m
+	})
+}
+
+// Publish publishes the collector's Var under the given name. Like
+// expvar.Publish, it panics if the name is already registered.
+func (c *Collector) Publish(name string) {
+	expvar.Publish(name, c.Var())
+}
+
+// writer writes the Prometheus text format, remembering the first error.
+type writer struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (b *writer) write(s string) {
+	if b.err != nil {
+		return
+	}
+	n, err := b.w.WriteString(s)
+	b.n += int64(n)
+	b.err = err
+}
+
+func (b *writer) family(name, typ, help string) {
+	b.write("# HELP " + name + " " + help + "\n# TYPE " + name + " " + typ + "\n")
+}
+
+func (b *writer) value(name, client, packetType string, v float64) {
+	s := name + `{client="` + escapeLabel(client) + `"`
+	if packetType != "" {
+		s += `,type="` + escapeLabel(packetType) + `"`
+	}
+	s += "} " + strconv.FormatFloat(v, 'g', -1, 64) + "\n"
+	b.write(s)
+}
+
+func (b *writer) packets(name, client string, counts map[string]uint64) {
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		b.value(name, client, t, float64(counts[t]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,238 @@
+package gumblemetrics_test
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumblemetrics"
+	"layeh.com/gumble/gumbletest"
+	"layeh.com/gumble/gumbleutil"
+)
+
+// testCodec "decodes" each byte of a frame to a sample, and fails to decode
+// frames that start with 0xff.
+type testCodec struct{}
+
+func (testCodec) ID() int                         { return 4 }
+func (testCodec) NewEncoder() gumble.AudioEncoder { return nil }
+func (testCodec) NewDecoder() gumble.AudioDecoder { return testCodec{} }
+func (testCodec) Reset()                          {}
+
+func (testCodec) Decode(data []byte, frameSize int) ([]int16, error) {
+	if len(data) > 0 && data[0] == 0xff {
+		return nil, errors.New("invalid frame")
+	}
+	pcm := make([]int16, len(data))
+	for i, b := range data {
+		pcm[i] = int16(b)
+	}
+	return pcm, nil
+}
+
+// testClient dials server with a listener that reports text messages and
+// disconnects on the returned channels.
+func testClient(t *testing.T, server *gumbletest.Server) (*gumble.Client, <-chan string, <-chan struct{}) {
+	t.Helper()
+	messages := make(chan string, 10)
+	disconnected := make(chan struct{})
+	config := gumble.NewConfig()
+	config.Attach(gumbleutil.Listener{
+		TextMessage: func(e *gumble.TextMessageEvent) {
+			messages <- e.Message
+		},
+		Disconnect: func(e *gumble.DisconnectEvent) {
+			close(disconnected)
+		},
+	})
+	client, err := server.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, messages, disconnected
+}
+
+// syncClient waits until the client has handled every packet that server sent
+// before the call, by sending a text message and waiting for its event.
+func syncClient(t *testing.T, server *gumbletest.Server, messages <-chan string) {
+	t.Helper()
+	if err := server.Send(gumbletest.TextMessage(0, "sync", server.Session())); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for text message")
+	}
+}
+
+func waitDisconnect(t *testing.T, disconnected <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+}
+
+func output(t *testing.T, c *gumblemetrics.Collector) string {
+	t.Helper()
+	var b bytes.Buffer
+	n, err := c.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, b.Len())
+	}
+	return b.String()
+}
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 64)
+}
+
+func TestCollector(t *testing.T) {
+	gumble.RegisterAudioCodec(4, testCodec{})
+
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Send(gumbletest.ChannelState(1, 0, "Lobby"))
+	alice := server.AddUser("Alice", 1)
+
+	client, messages, disconnected := testClient(t, server)
+	defer client.Disconnect()
+
+	collector := gumblemetrics.NewCollector()
+	collector.Set("bot \"one\"\\\n", client)
+	const label = `{client="bot \"one\"\\\n"}`
+
+	if out := output(t, collector); !strings.Contains(out, "gumble_connected"+label+" 1\n") ||
+		!strings.Contains(out, "gumble_users"+label+" 2\n") ||
+		!strings.Contains(out, "gumble_channels"+label+" 2\n") {
+		t.Fatalf("unexpected output after connecting:\n%s", out)
+	}
+
+	server.Send(gumbletest.ChannelState(2, 1, "AFK"))
+	server.AddUser("Bob", 2)
+	if err := server.SendAudio(alice, 0, []byte{1, 2, 3}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SendAudio(alice, 1, []byte{0xff}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SendAudio(99, 0, []byte{1}, false); err != nil {
+		t.Fatal(err)
+	}
+	syncClient(t, server, messages)
+
+	if err := server.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnect(t, disconnected)
+
+	// The client's statistics no longer change once it has disconnected; only
+	// the ping time and the number of pings depend on timing.
+	m := client.Metrics()
+	expected := `# HELP gumble_connected Whether the client is connected to the server.
+# TYPE gumble_connected gauge
+gumble_connected` + label + ` 0
+# HELP gumble_reconnects_total The number of times the client was replaced by a new connection.
+# TYPE gumble_reconnects_total counter
+gumble_reconnects_total` + label + ` 0
+# HELP gumble_ping_average_milliseconds The average TCP ping time to the server.
+# TYPE gumble_ping_average_milliseconds gauge
+gumble_ping_average_milliseconds` + label + ` ` + formatFloat(m.PingAverage) + `
+# HELP gumble_ping_variance_milliseconds The variance of the TCP ping time to the server.
+# TYPE gumble_ping_variance_milliseconds gauge
+gumble_ping_variance_milliseconds` + label + ` ` + formatFloat(m.PingVariance) + `
+# HELP gumble_packets_received_total The number of control packets received, by packet type.
+# TYPE gumble_packets_received_total counter
+gumble_packets_received_total{client="bot \"one\"\\\n",type="ChannelState"} 3
+gumble_packets_received_total{client="bot \"one\"\\\n",type="CodecVersion"} 1
+gumble_packets_received_total{client="bot \"one\"\\\n",type="Ping"} ` + strconv.FormatUint(m.PacketsReceived["Ping"], 10) + `
+gumble_packets_received_total{client="bot \"one\"\\\n",type="ServerSync"} 1
+gumble_packets_received_total{client="bot \"one\"\\\n",type="TextMessage"} 1
+gumble_packets_received_total{client="bot \"one\"\\\n",type="UDPTunnel"} 3
+gumble_packets_received_total{client="bot \"one\"\\\n",type="UserState"} 3
+gumble_packets_received_total{client="bot \"one\"\\\n",type="Version"} 1
+# HELP gumble_packets_sent_total The number of control packets sent, by packet type.
+# TYPE gumble_packets_sent_total counter
+gumble_packets_sent_total{client="bot \"one\"\\\n",type="Authenticate"} 1
+gumble_packets_sent_total{client="bot \"one\"\\\n",type="Ping"} ` + strconv.FormatUint(m.PacketsSent["Ping"], 10) + `
+gumble_packets_sent_total{client="bot \"one\"\\\n",type="Version"} 1
+# HELP gumble_voice_frames_encoded_total The number of voice frames encoded and sent.
+# TYPE gumble_voice_frames_encoded_total counter
+gumble_voice_frames_encoded_total` + label + ` 0
+# HELP gumble_voice_frames_decoded_total The number of voice frames received and decoded.
+# TYPE gumble_voice_frames_decoded_total counter
+gumble_voice_frames_decoded_total` + label + ` 1
+# HELP gumble_voice_decode_errors_total The number of received voice frames that could not be decoded.
+# TYPE gumble_voice_decode_errors_total counter
+gumble_voice_decode_errors_total` + label + ` 1
+# HELP gumble_voice_frames_dropped_total The number of voice frames that were dropped.
+# TYPE gumble_voice_frames_dropped_total counter
+gumble_voice_frames_dropped_total` + label + ` 1
+# HELP gumble_users The number of users connected to the server.
+# TYPE gumble_users gauge
+gumble_users` + label + ` 3
+# HELP gumble_channels The number of channels on the server.
+# TYPE gumble_channels gauge
+gumble_channels` + label + ` 3
+`
+	if out := output(t, collector); out != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", out, expected)
+	}
+}
+
+func TestCollectorReconnect(t *testing.T) {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	first, _, disconnected := testClient(t, server)
+	defer first.Disconnect()
+
+	collector := gumblemetrics.NewCollector()
+	collector.Set("bot", first)
+	collector.Set("bot", first)
+	collector.Set("other", first)
+	if out := output(t, collector); !strings.Contains(out, "gumble_reconnects_total{client=\"bot\"} 0\n") {
+		t.Fatalf("setting the same client was counted as a reconnect:\n%s", out)
+	}
+
+	if err := server.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnect(t, disconnected)
+	if out := output(t, collector); !strings.Contains(out, "gumble_connected{client=\"bot\"} 0\n") {
+		t.Fatalf("disconnected client reported as connected:\n%s", out)
+	}
+
+	second, _, _ := testClient(t, server)
+	defer second.Disconnect()
+	collector.Set("bot", second)
+	collector.Remove("other")
+
+	out := output(t, collector)
+	for _, line := range []string{
+		"gumble_connected{client=\"bot\"} 1\n",
+		"gumble_reconnects_total{client=\"bot\"} 1\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output does not contain %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, `client="other"`) {
+		t.Errorf("removed client is still reported:\n%s", out)
+	}
+}
@@ -0,0 +1,198 @@
+package gumbleopenal
+
+import (
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbleopenal/internal/audio"
+)
+
+// CaptureMode determines when captured audio is transmitted.
+type CaptureMode int
+
+const (
+	// CaptureContinuous transmits all captured audio.
+	CaptureContinuous CaptureMode = iota
+	// CapturePushToTalk transmits captured audio while the push-to-talk key
+	// is down (see PushToTalkDown and PushToTalkUp).
+	CapturePushToTalk
+	// CaptureVoiceActivation transmits captured audio while it is loud enough
+	// to be speech (see SetVoiceActivation).
+	CaptureVoiceActivation
+)
+
+// VoiceActivation configures when CaptureVoiceActivation transmits audio.
+// Levels are the RMS level of an audio frame, in dBFS.
+type VoiceActivation struct {
+	// Transmission starts when the level rises above Speech.
+	Speech float64
+	// Transmission stops when the level has been below Silence for Hold.
+	Silence float64
+	Hold    time.Duration
+}
+
+// DefaultVoiceActivation is the default voice activation configuration.
+var DefaultVoiceActivation = VoiceActivation{
+	Speech:  -40,
+	Silence: -50,
+	Hold:    500 * time.Millisecond,
+}
+
+// captureState is the state of the capture controller.
+type captureState struct {
+	mode       CaptureMode
+	pushed     bool
+	muted      bool
+	activation VoiceActivation
+	// The last known self-mute state of the client's user.
+	selfMuted bool
+
+	transmitting bool
+	// The length of audio below the silence level while transmitting in
+	// CaptureVoiceActivation.
+	silence time.Duration
+}
+
+// SetCaptureMode sets when captured audio is transmitted. The default mode is
+// CaptureContinuous.
+func (s *Stream) SetCaptureMode(mode CaptureMode) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture.mode = mode
+	s.capture.pushed = false
+	s.capture.silence = 0
+}
+
+// CaptureMode returns when captured audio is transmitted.
+func (s *Stream) CaptureMode() CaptureMode {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	return s.capture.mode
+}
+
+// PushToTalkDown starts transmitting in CapturePushToTalk mode.
+func (s *Stream) PushToTalkDown() {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture.pushed = true
+}
+
+// PushToTalkUp stops transmitting in CapturePushToTalk mode. The last frame
+// of audio is sent as the end of the transmission.
+func (s *Stream) PushToTalkUp() {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture.pushed = false
+}
+
+// SetVoiceActivation sets when CaptureVoiceActivation transmits audio.
+func (s *Stream) SetVoiceActivation(activation VoiceActivation) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture.activation = activation
+}
+
+// SetMuted sets whether captured audio is muted locally, in all capture
+// modes. The client's self-mute state is updated to match, and changes to
+// the self-mute state (e.g. by calling User.SetSelfMuted) update the local
+// mute state.
+func (s *Stream) SetMuted(muted bool) {
+	s.captureMu.Lock()
+	s.capture.muted = muted
+	s.captureMu.Unlock()
+
+	s.client.Do(func() {
+		if self := s.client.Self; self != nil && self.SelfMuted != muted {
+			self.SetSelfMuted(muted)
+		}
+	})
+}
+
+// Muted returns whether captured audio is muted locally.
+func (s *Stream) Muted() bool {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	return s.capture.muted
+}
+
+// Transmitting returns whether captured audio is being transmitted.
+func (s *Stream) Transmitting() bool {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	return s.capture.transmitting
+}
+
+// transmit returns whether a captured frame, which is interval long, should
+// be transmitted.
+func (s *Stream) transmit(frame []int16, interval time.Duration) bool {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	c := &s.capture
+
+	transmit := false
+	switch c.mode {
+	case CaptureContinuous:
+		transmit = true
+	case CapturePushToTalk:
+		transmit = c.pushed
+	case CaptureVoiceActivation:
+		level := audio.FrameLevel(frame)
+		switch {
+		case level > c.activation.Speech:
+			transmit = true
+			c.silence = 0
+		case !c.transmitting:
+		case level > c.activation.Silence:
+			transmit = true
+			c.silence = 0
+		default:
+			c.silence += interval
+			transmit = c.silence < c.activation.Hold
+		}
+	}
+	if c.muted {
+		transmit = false
+	}
+	if !transmit {
+		c.silence = 0
+	}
+	c.transmitting = transmit
+	return transmit
+}
+
+// stopTransmitting records that captured audio is no longer transmitted.
+func (s *Stream) stopTransmitting() {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture.transmitting = false
+	s.capture.silence = 0
+}
+
+func (s *Stream) onConnect(e *gumble.ConnectEvent) {
+	if e.Client.Self == nil {
+		return
+	}
+	s.captureMu.Lock()
+	s.capture.selfMuted = e.Client.Self.SelfMuted
+	muted := s.capture.muted
+	s.captureMu.Unlock()
+	// The server does not remember the self-mute state between connections.
+	if muted && !e.Client.Self.SelfMuted {
+		e.Client.Self.SetSelfMuted(true)
+	}
+}
+
+// onSelfChange tracks the self-mute state of the client's user.
+func (s *Stream) onSelfChange(e *gumble.UserChangeEvent) {
+	if e.User != e.Client.Self || !e.Type.Has(gumble.UserChangeAudio) {
+		return
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	// The event may be caused by another change (e.g. the server muting the
+	// user), before the server has applied a call to SetMuted.
+	if e.User.SelfMuted != s.capture.selfMuted {
+		s.capture.selfMuted = e.User.SelfMuted
+		s.capture.muted = e.User.SelfMuted
+	}
+}
@@ -0,0 +1,162 @@
+package gumbleopenal
+
+/*
+#cgo linux LDFLAGS: -lopenal
+#cgo darwin LDFLAGS: -framework OpenAL
+#include <stdlib.h>
+#include <string.h>
+#ifdef __APPLE__
+#include <OpenAL/alc.h>
+#else
+#include <AL/alc.h>
+#endif
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/dchote/go-openal/openal"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbleopenal/internal/audio"
+)
+
+var (
+	ErrCaptureDevice  = errors.New("gumbleopenal: failed to open capture device")
+	ErrPlaybackDevice = errors.New("gumbleopenal: failed to open playback device")
+	ErrNoCapture      = errors.New("gumbleopenal: no capture device")
+)
+
+// CaptureDevices returns the names of the available capture devices.
+func CaptureDevices() []string {
+	return deviceList(C.alcGetString(nil, C.ALC_CAPTURE_DEVICE_SPECIFIER))
+}
+
+// PlaybackDevices returns the names of the available playback devices.
+func PlaybackDevices() []string {
+	extension := C.CString("ALC_ENUMERATE_ALL_EXT")
+	defer C.free(unsafe.Pointer(extension))
+	if C.alcIsExtensionPresent(nil, extension) != 0 {
+		return deviceList(C.alcGetString(nil, C.ALC_ALL_DEVICES_SPECIFIER))
+	}
+	return deviceList(C.alcGetString(nil, C.ALC_DEVICE_SPECIFIER))
+}
+
+// DefaultCaptureDevice returns the name of the default capture device.
+func DefaultCaptureDevice() string {
+	return C.GoString(C.alcGetString(nil, C.ALC_CAPTURE_DEFAULT_DEVICE_SPECIFIER))
+}
+
+// DefaultPlaybackDevice returns the name of the default playback device.
+func DefaultPlaybackDevice() string {
+	extension := C.CString("ALC_ENUMERATE_ALL_EXT")
+	defer C.free(unsafe.Pointer(extension))
+	if C.alcIsExtensionPresent(nil, extension) != 0 {
+		return C.GoString(C.alcGetString(nil, C.ALC_DEFAULT_ALL_DEVICES_SPECIFIER))
+	}
+	return C.GoString(C.alcGetString(nil, C.ALC_DEFAULT_DEVICE_SPECIFIER))
+}
+
+// deviceList returns the names in a list of device names, which are
+// separated by null characters and terminated by an empty name.
+func deviceList(list *C.ALCchar) []string {
+	if list == nil {
+		return nil
+	}
+	// Find the end of the list, so that it can be copied.
+	size := 0
+	for {
+		length := int(C.strlen((*C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(list)) + uintptr(size)))))
+		size += length + 1
+		if length == 0 {
+			break
+		}
+	}
+	return audio.DeviceList(C.GoBytes(unsafe.Pointer(list), C.int(size)))
+}
+
+// captureDevice is an open capture device.
+type captureDevice struct {
+	handle *C.ALCdevice
+}
+
+// openCapture opens the named capture device ("" for the default device),
+// which buffers frameSize samples of mono audio.
+func openCapture(name string, frameSize int) (*captureDevice, error) {
+	var cname *C.ALCchar
+	if name != "" {
+		cname = C.CString(name)
+		defer C.free(unsafe.Pointer(cname))
+	}
+	handle := C.alcCaptureOpenDevice(cname, gumble.AudioSampleRate, C.ALCenum(openal.FormatMono16), C.ALCsizei(frameSize))
+	if handle == nil {
+		return nil, ErrCaptureDevice
+	}
+	return &captureDevice{handle: handle}, nil
+}
+
+func (d *captureDevice) start() {
+	C.alcCaptureStart(d.handle)
+}
+
+func (d *captureDevice) stop() {
+	C.alcCaptureStop(d.handle)
+}
+
+func (d *captureDevice) close() {
+	C.alcCaptureCloseDevice(d.handle)
+}
+
+// capture fills buffer with captured samples. It returns false, and leaves
+// buffer unchanged, if fewer samples than the length of buffer are
+// available.
+func (d *captureDevice) capture(buffer []int16) bool {
+	var available C.ALCint
+	C.alcGetIntegerv(d.handle, C.ALC_CAPTURE_SAMPLES, 1, &available)
+	if int(available) < len(buffer) {
+		return false
+	}
+	C.alcCaptureSamples(d.handle, unsafe.Pointer(&buffer[0]), C.ALCsizei(len(buffer)))
+	return true
+}
+
+// playbackDevice is an open playback device, and the context created on it.
+type playbackDevice struct {
+	device  *C.ALCdevice
+	context *C.ALCcontext
+}
+
+// openPlayback opens the named playback device ("" for the default device),
+// and creates a context on it.
+func openPlayback(name string) (*playbackDevice, error) {
+	var cname *C.ALCchar
+	if name != "" {
+		cname = C.CString(name)
+		defer C.free(unsafe.Pointer(cname))
+	}
+	device := C.alcOpenDevice(cname)
+	if device == nil {
+		return nil, ErrPlaybackDevice
+	}
+	context := C.alcCreateContext(device, nil)
+	if context == nil {
+		C.alcCloseDevice(device)
+		return nil, ErrPlaybackDevice
+	}
+	return &playbackDevice{device: device, context: context}, nil
+}
+
+// activate makes the device's context the current context.
+func (d *playbackDevice) activate() {
+	C.alcMakeContextCurrent(d.context)
+}
+
+// close destroys the context, and closes the device.
+func (d *playbackDevice) close() {
+	if C.alcGetCurrentContext() == d.context {
+		C.alcMakeContextCurrent(nil)
+	}
+	C.alcDestroyContext(d.context)
+	C.alcCloseDevice(d.device)
+}
@@ -0,0 +1,157 @@
+package audio
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceList(t *testing.T) {
+	tests := []struct {
+		list  string
+		names []string
+	}{
+		{"", nil},
+		{"\x00", nil},
+		{"\x00\x00", nil},
+		{"OpenAL Soft\x00\x00", []string{"OpenAL Soft"}},
+		{"Built-in Audio\x00USB Headset\x00\x00", []string{"Built-in Audio", "USB Headset"}},
+		// Anything after the terminating empty name is ignored.
+		{"a\x00\x00b\x00\x00", []string{"a"}},
+		// A list that is missing its terminator ends with its last name.
+		{"a\x00b", []string{"a", "b"}},
+		{"a\x00b\x00", []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		if names := DeviceList([]byte(test.list)); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("DeviceList(%q) = %q, expected %q", test.list, names, test.names)
+		}
+	}
+}
+
+func TestPutSamples(t *testing.T) {
+	pcm := []int16{0, 1, -1, 0x1234, math.MaxInt16, math.MinInt16}
+	dst := make([]byte, len(pcm)*2+2)
+	for i := range dst {
+		dst[i] = 0xaa
+	}
+	n := PutSamples(dst, pcm)
+	if n != len(pcm)*2 {
+		t.Fatalf("PutSamples returned %d, expected %d", n, len(pcm)*2)
+	}
+	expected := []byte{
+		0x00, 0x00,
+		0x01, 0x00,
+		0xff, 0xff,
+		0x34, 0x12,
+		0xff, 0x7f,
+		0x00, 0x80,
+		0xaa, 0xaa,
+	}
+	if !reflect.DeepEqual(dst, expected) {
+		t.Errorf("PutSamples wrote % x, expected % x", dst, expected)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	names := []uint32{1, 2, 3}
+	b := NewBuffers(names)
+	names[0] = 99
+	if b.Queued() != 0 || len(b.Free()) != 3 {
+		t.Fatalf("new Buffers has %d queued and %d free buffers", b.Queued(), len(b.Free()))
+	}
+
+	queued := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		name, ok := b.Queue()
+		if !ok {
+			t.Fatalf("Queue failed with %d free buffers", 3-i)
+		}
+		if name < 1 || name > 3 || queued[name] {
+			t.Fatalf("Queue returned buffer %d, after %v", name, queued)
+		}
+		queued[name] = true
+	}
+	if _, ok := b.Queue(); ok {
+		t.Fatal("Queue succeeded with no free buffers")
+	}
+	if b.Queued() != 3 || len(b.Free()) != 0 {
+		t.Fatalf("Buffers has %d queued and %d free buffers, expected 3 and 0", b.Queued(), len(b.Free()))
+	}
+
+	b.Unqueued([]uint32{2})
+	if name, ok := b.Queue(); !ok || name != 2 {
+		t.Fatalf("Queue returned %d, %v after buffer 2 was unqueued", name, ok)
+	}
+	b.Unqueued(nil)
+	if _, ok := b.Queue(); ok {
+		t.Fatal("Queue succeeded after no buffers were unqueued")
+	}
+
+	b.Unqueued([]uint32{1, 2, 3})
+	if b.Queued() != 0 || len(b.Free()) != 3 {
+		t.Fatalf("Buffers has %d queued and %d free buffers, expected 0 and 3", b.Queued(), len(b.Free()))
+	}
+}
+
+func TestPanner(t *testing.T) {
+	var p Panner
+	for i := range panPositions {
+		if pan := p.Allocate(); pan != i {
+			t.Fatalf("Allocate returned %d, expected %d", pan, i)
+		}
+	}
+	// Every position is used once, so positions are reused in order.
+	if pan := p.Allocate(); pan != 0 {
+		t.Fatalf("Allocate returned %d, expected 0", pan)
+	}
+	p.Release(3)
+	if pan := p.Allocate(); pan != 3 {
+		t.Fatalf("Allocate returned %d after releasing 3", pan)
+	}
+	p.Release(0)
+	p.Release(0)
+	p.Release(5)
+	if pan := p.Allocate(); pan != 0 {
+		t.Fatalf("Allocate returned %d after releasing 0 twice", pan)
+	}
+	if pan := p.Allocate(); pan != 5 {
+		t.Fatalf("Allocate returned %d after releasing 5", pan)
+	}
+}
+
+func TestPanPosition(t *testing.T) {
+	for i, expected := range panPositions {
+		x, z := PanPosition(i)
+		if x != expected {
+			t.Errorf("PanPosition(%d) x = %v, expected %v", i, x, expected)
+		}
+		if d := math.Hypot(float64(x), float64(z)); z < 0 || math.Abs(d-1) > 1e-6 {
+			t.Errorf("PanPosition(%d) = (%v, %v), which is not in front of the listener on the unit circle", i, x, z)
+		}
+	}
+}
+
+func TestFrameLevel(t *testing.T) {
+	if level := FrameLevel(nil); !math.IsInf(level, -1) {
+		t.Errorf("FrameLevel(nil) = %v, expected -Inf", level)
+	}
+	if level := FrameLevel(make([]int16, 480)); !math.IsInf(level, -1) {
+		t.Errorf("FrameLevel of silence = %v, expected -Inf", level)
+	}
+	if level := FrameLevel([]int16{math.MinInt16, math.MinInt16}); level != 0 {
+		t.Errorf("FrameLevel of a full scale frame = %v, expected 0", level)
+	}
+
+	// A square wave at half of full scale is about 6 dB below full scale.
+	frame := make([]int16, 480)
+	for i := range frame {
+		frame[i] = 16384
+		if i%2 == 1 {
+			frame[i] = -16384
+		}
+	}
+	if level := FrameLevel(frame); math.Abs(level-20*math.Log10(0.5)) > 1e-9 {
+		t.Errorf("FrameLevel of a half scale square wave = %v, expected %v", level, 20*math.Log10(0.5))
+	}
+}
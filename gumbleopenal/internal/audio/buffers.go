@@ -0,0 +1,59 @@
+package audio
+
+import "encoding/binary"
+
+// PutSamples writes the 16-bit samples of pcm to dst in little-endian byte
+// order, which is the format of OpenAL's 16-bit buffers, and returns the
+// number of bytes written. dst must be at least twice as long as pcm.
+func PutSamples(dst []byte, pcm []int16) int {
+	for i, sample := range pcm {
+		binary.LittleEndian.PutUint16(dst[i*2:], uint16(sample))
+	}
+	return len(pcm) * 2
+}
+
+// Buffers keeps track of the buffers of an OpenAL source, which are
+// identified by their names. A buffer is free until it is queued on the
+// source, and becomes free again once the source has processed it and it has
+// been unqueued.
+type Buffers struct {
+	free   []uint32
+	queued int
+}
+
+// NewBuffers returns a Buffers in which all of the given buffers are free.
+func NewBuffers(names []uint32) *Buffers {
+	return &Buffers{
+		free: append([]uint32(nil), names...),
+	}
+}
+
+// Queue returns a free buffer, and records that it is queued. It returns
+// false if all of the buffers are queued.
+func (b *Buffers) Queue() (uint32, bool) {
+	if len(b.free) == 0 {
+		return 0, false
+	}
+	last := len(b.free) - 1
+	name := b.free[last]
+	b.free = b.free[:last]
+	b.queued++
+	return name, true
+}
+
+// Unqueued records that the given buffers have been unqueued from the
+// source, and are free.
+func (b *Buffers) Unqueued(names []uint32) {
+	b.free = append(b.free, names...)
+	b.queued -= len(names)
+}
+
+// Free returns the buffers that are free.
+func (b *Buffers) Free() []uint32 {
+	return b.free
+}
+
+// Queued returns the number of buffers that are queued.
+func (b *Buffers) Queued() int {
+	return b.queued
+}
@@ -0,0 +1,25 @@
+package audio
+
+import "bytes"
+
+// DeviceList parses a list of device names, as returned by alcGetString. The
+// names are separated by null characters, and the list is terminated by an
+// empty name.
+func DeviceList(list []byte) []string {
+	var names []string
+	for len(list) > 0 {
+		end := bytes.IndexByte(list, 0)
+		if end == 0 {
+			break
+		}
+		if end < 0 {
+			end = len(list)
+		}
+		names = append(names, string(list[:end]))
+		if end == len(list) {
+			break
+		}
+		list = list[end+1:]
+	}
+	return names
+}
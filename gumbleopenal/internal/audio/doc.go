@@ -0,0 +1,3 @@
+// Package audio contains the parts of gumbleopenal that do not depend on
+// OpenAL, so that they can be tested without it.
+package audio
@@ -0,0 +1,16 @@
+package audio
+
+import "math"
+
+// FrameLevel returns the RMS level of a frame, in dBFS.
+func FrameLevel(frame []int16) float64 {
+	if len(frame) == 0 {
+		return math.Inf(-1)
+	}
+	var sum float64
+	for _, sample := range frame {
+		x := float64(sample) / -math.MinInt16
+		sum += x * x
+	}
+	return 10 * math.Log10(sum/float64(len(frame)))
+}
@@ -0,0 +1,40 @@
+package audio
+
+import "math"
+
+// panPositions are the stereo positions, from -1 (left) to 1 (right), that
+// are given to speakers by Panner.
+var panPositions = [...]float32{0, -0.5, 0.5, -0.25, 0.25, -0.75, 0.75, -1, 1}
+
+// Panner spreads speakers across the stereo field. Speakers are given the
+// position that is used by the fewest other speakers, preferring earlier
+// positions, which are nearer the center.
+//
+// The zero value is ready for use.
+type Panner struct {
+	streams [len(panPositions)]int
+}
+
+// Allocate returns the index of a position for a new speaker.
+func (p *Panner) Allocate() int {
+	pan := 0
+	for i, n := range p.streams {
+		if n < p.streams[pan] {
+			pan = i
+		}
+	}
+	p.streams[pan]++
+	return pan
+}
+
+// Release releases a position that was returned by Allocate.
+func (p *Panner) Release(pan int) {
+	p.streams[pan]--
+}
+
+// PanPosition returns the position of the given pan index, as X (right) and
+// Z (forward) coordinates on the unit circle in front of the listener.
+func PanPosition(pan int) (x, z float32) {
+	x = panPositions[pan]
+	return x, float32(math.Sqrt(float64(1 - x*x)))
+}
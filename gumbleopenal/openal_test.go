@@ -0,0 +1,123 @@
+//go:build openal
+// +build openal
+
+package gumbleopenal
+
+// These tests use OpenAL, and so are only built with the openal build tag.
+// They need a playback device; OpenAL Soft's null backend can be selected by
+// setting ALSOFT_DRIVERS=null.
+
+import (
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbletest"
+	"layeh.com/gumble/gumbleutil"
+)
+
+// testCodec "decodes" each byte of a frame to a sample.
+type testCodec struct{}
+
+func (testCodec) ID() int                         { return 4 }
+func (testCodec) NewEncoder() gumble.AudioEncoder { return nil }
+func (testCodec) NewDecoder() gumble.AudioDecoder { return testCodec{} }
+func (testCodec) Reset()                          {}
+
+func (testCodec) Decode(data []byte, frameSize int) ([]int16, error) {
+	pcm := make([]int16, len(data))
+	for i, b := range data {
+		pcm[i] = int16(b) << 8
+	}
+	return pcm, nil
+}
+
+func TestDevices(t *testing.T) {
+	devices := PlaybackDevices()
+	if len(devices) == 0 {
+		t.Fatal("no playback devices")
+	}
+	for _, name := range devices {
+		if name == "" {
+			t.Errorf("empty playback device name in %q", devices)
+		}
+	}
+	t.Logf("playback devices: %q (default %q)", devices, DefaultPlaybackDevice())
+	t.Logf("capture devices: %q (default %q)", CaptureDevices(), DefaultCaptureDevice())
+}
+
+func TestPlayback(t *testing.T) {
+	gumble.RegisterAudioCodec(4, testCodec{})
+
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	alice := server.AddUser("Alice", 0)
+	bob := server.AddUser("Bob", 0)
+
+	messages := make(chan string, 10)
+	config := gumble.NewConfig()
+	config.Attach(gumbleutil.Listener{
+		TextMessage: func(e *gumble.TextMessageEvent) {
+			messages <- e.Message
+		},
+	})
+	client, err := server.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	stream, err := New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Destroy()
+	stream.SetPanning(true)
+
+	// send sends frames of audio from Alice and Bob, and waits until the
+	// client has passed them to the stream.
+	sequence := int64(0)
+	send := func(frames int, final bool) {
+		t.Helper()
+		frame := make([]byte, client.Config.AudioFrameSize())
+		for i := range frame {
+			frame[i] = byte(i)
+		}
+		for i := 0; i < frames; i++ {
+			last := final && i == frames-1
+			if err := server.SendAudio(alice, sequence, frame, last); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.SendAudio(bob, sequence, frame, last); err != nil {
+				t.Fatal(err)
+			}
+			sequence++
+		}
+		if err := server.Send(gumbletest.TextMessage(0, "sync", server.Session())); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for text message")
+		}
+		// Give the audio streams time to queue the frames.
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// More frames than a source has buffers are sent, so that some are
+	// dropped.
+	send(20, false)
+
+	if err := stream.SetPlaybackDevice(""); err != nil {
+		t.Fatal(err)
+	}
+	client.Do(func() {
+		stream.SetUserGain(client.Users[alice], 0.5)
+		stream.SetUserMuted(client.Users[bob], true)
+	})
+	send(5, true)
+}
@@ -0,0 +1,269 @@
+package gumbleopenal
+
+import (
+	"errors"
+
+	"github.com/dchote/go-openal/openal"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbleopenal/internal/audio"
+)
+
+var (
+	ErrDistance = errors.New("gumbleopenal: invalid positional audio distance")
+)
+
+// Default positional audio settings, which match the official client's.
+const (
+	DefaultMinDistance = 2.4
+	DefaultMaxDistance = 15
+	DefaultMinVolume   = 0.1
+)
+
+// playbackOptions are the options that apply to the sources of all audio
+// streams.
+type playbackOptions struct {
+	positional bool
+	panning    bool
+	distance   distance
+}
+
+type distance struct {
+	min, max, minVolume float32
+}
+
+var defaultPlaybackOptions = playbackOptions{
+	distance: distance{
+		min:       DefaultMinDistance,
+		max:       DefaultMaxDistance,
+		minVolume: DefaultMinVolume,
+	},
+}
+
+// userOptions are the options that apply to the audio streams of a user.
+type userOptions struct {
+	gain  float32
+	muted bool
+}
+
+// listener is the position and orientation of the listener, in Mumble's
+// coordinates.
+type listener struct {
+	position, front, top [3]float32
+}
+
+var defaultListener = listener{
+	front: [3]float32{0, 0, 1},
+	top:   [3]float32{0, 1, 0},
+}
+
+// toOpenAL converts a vector from Mumble's left-handed coordinates (X right,
+// Y up, Z forward) to OpenAL's right-handed coordinates.
+func toOpenAL(v [3]float32) openal.Vector {
+	return openal.Vector{v[0], v[1], -v[2]}
+}
+
+// SetUserGain sets the gain of the user's audio, where 1 is unchanged and 0 is
+// silent. The gain applies until the user disconnects.
+func (s *Stream) SetUserGain(user *gumble.User, gain float32) {
+	if gain < 0 {
+		gain = 0
+	}
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	options := s.userOptions(user)
+	options.gain = gain
+	s.setUserOptions(user, options)
+}
+
+// UserGain returns the gain of the user's audio.
+func (s *Stream) UserGain(user *gumble.User) float32 {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	return s.userOptions(user).gain
+}
+
+// SetUserMuted sets whether the user's audio is muted locally. The user
+// remains muted until they disconnect.
+func (s *Stream) SetUserMuted(user *gumble.User, muted bool) {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	options := s.userOptions(user)
+	options.muted = muted
+	s.setUserOptions(user, options)
+}
+
+// UserMuted returns whether the user's audio is muted locally.
+func (s *Stream) UserMuted(user *gumble.User) bool {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	return s.userOptions(user).muted
+}
+
+// userOptions returns the options of a user. s.playbackMu must be held.
+func (s *Stream) userOptions(user *gumble.User) userOptions {
+	if options, ok := s.users[user]; ok {
+		return options
+	}
+	return userOptions{gain: 1}
+}
+
+// setUserOptions sets the options of a user. s.playbackMu must be held.
+func (s *Stream) setUserOptions(user *gumble.User, options userOptions) {
+	if options == (userOptions{gain: 1}) {
+		delete(s.users, user)
+		return
+	}
+	if s.users == nil {
+		s.users = make(map[*gumble.User]userOptions)
+	}
+	s.users[user] = options
+}
+
+// onUserDisconnect forgets the options of users that have disconnected.
+// Users that reconnect are new *gumble.User values, so their options would
+// never be used again.
+func (s *Stream) onUserDisconnect(e *gumble.UserChangeEvent) {
+	if !e.Type.Has(gumble.UserChangeDisconnected) {
+		return
+	}
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	delete(s.users, e.User)
+}
+
+// SetPositional sets whether audio packets that contain a position are
+// positioned in 3D around the listener (see SetListener). It is disabled by
+// default.
+func (s *Stream) SetPositional(enabled bool) {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	s.playback.positional = enabled
+}
+
+// SetPanning sets whether speakers whose audio is not positioned in 3D are
+// spread across the stereo field, so that they can be told apart. It is
+// disabled by default.
+func (s *Stream) SetPanning(enabled bool) {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	s.playback.panning = enabled
+}
+
+// SetDistance sets how positional audio is attenuated. Speakers closer than
+// min are at full volume, and the volume falls linearly to minVolume (between
+// 0 and 1) at max and beyond.
+func (s *Stream) SetDistance(min, max, minVolume float32) error {
+	if min < 0 || max <= min || minVolume < 0 || minVolume > 1 {
+		return ErrDistance
+	}
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	s.playback.distance = distance{
+		min:       min,
+		max:       max,
+		minVolume: minVolume,
+	}
+	return nil
+}
+
+// SetListener sets the position of the listener, and the directions that
+// they face (front) and that are up from them (top). The vectors use the same
+// coordinates as the positions of audio packets (X right, Y up, Z forward).
+func (s *Stream) SetListener(position, front, top [3]float32) {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	s.listener = listener{
+		position: position,
+		front:    front,
+		top:      top,
+	}
+	if s.sink != nil {
+		s.applyListener()
+	}
+}
+
+// applyListener applies the listener and the distance model to the current
+// context. s.sinkMu must be held for writing.
+func (s *Stream) applyListener() {
+	openal.SetDistanceModel(openal.LinearDistanceClamped)
+	var l openal.Listener
+	position := toOpenAL(s.listener.position)
+	l.SetPosition(&position)
+	front, top := toOpenAL(s.listener.front), toOpenAL(s.listener.top)
+	l.SetOrientation(&front, &top)
+}
+
+// sourceState is the state that has been applied to an audio stream's
+// source.
+type sourceState struct {
+	valid    bool
+	gain     float32
+	relative bool
+	position openal.Vector
+	rolloff  float32
+	distance distance
+	// The index of the stream's pan position, or -1.
+	pan int
+}
+
+// updateSource applies the options of the stream's user and the packet's
+// position to source, and returns false if the packet should be dropped
+// because the user is muted. s.sinkMu must be held for reading.
+func (s *Stream) updateSource(source openal.Source, state *sourceState, packet *gumble.AudioPacket) bool {
+	s.playbackMu.Lock()
+	options := s.playback
+	user := s.userOptions(packet.Sender)
+	positional := options.positional && packet.HasPosition
+	if !positional && options.panning {
+		if state.pan < 0 {
+			state.pan = s.panner.Allocate()
+		}
+	} else if state.pan >= 0 {
+		s.panner.Release(state.pan)
+		state.pan = -1
+	}
+	s.playbackMu.Unlock()
+
+	if user.muted {
+		return false
+	}
+
+	// Non-positional sources are relative to the listener and are not
+	// attenuated by distance.
+	relative := true
+	var position openal.Vector
+	var rolloff float32
+	switch {
+	case positional:
+		relative = false
+		position = toOpenAL([3]float32{packet.X, packet.Y, packet.Z})
+		rolloff = 1 - options.distance.minVolume
+	case state.pan >= 0:
+		x, z := audio.PanPosition(state.pan)
+		position = toOpenAL([3]float32{x, 0, z})
+	}
+
+	if !state.valid || state.gain != user.gain {
+		source.SetGain(user.gain)
+	}
+	if !state.valid || state.relative != relative {
+		source.SetSourceRelative(relative)
+	}
+	if !state.valid || state.position != position {
+		source.SetPosition(&position)
+	}
+	if !state.valid || state.rolloff != rolloff {
+		source.SetRolloffFactor(rolloff)
+	}
+	if !state.valid || state.distance != options.distance {
+		source.SetReferenceDistance(options.distance.min)
+		source.SetMaxDistance(options.distance.max)
+	}
+	state.valid = true
+	state.gain = user.gain
+	state.relative = relative
+	state.position = position
+	state.rolloff = rolloff
+	state.distance = options.distance
+	return true
+}
@@ -1,12 +1,13 @@
 package gumbleopenal
 
 import (
-	"encoding/binary"
 	"errors"
-	"time"
+	"sync"
 
 	"github.com/dchote/go-openal/openal"
 	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbleopenal/internal/audio"
+	"layeh.com/gumble/gumbleutil"
 )
 
 var (
@@ -14,140 +15,395 @@ var (
 )
 
 type Stream struct {
-	client *gumble.Client
-	link   gumble.Detacher
+	client    *gumble.Client
+	link      gumble.Detacher
+	eventLink gumble.Detacher
 
-	deviceSource    *openal.CaptureDevice
+	// mu protects the devices against concurrent calls to Stream's methods.
+	mu sync.Mutex
+
+	deviceSource    *captureDevice
+	sourceName      string
 	sourceFrameSize int
-	sourceStop      chan bool
+	sourceStop      chan struct{}
+	sourceDone      chan struct{}
+
+	// sinkMu is held for writing while the playback device is replaced, and
+	// for reading while audio streams use it. sinkGeneration is incremented
+	// each time the device is replaced.
+	sinkMu         sync.RWMutex
+	sink           *playbackDevice
+	sinkName       string
+	sinkGeneration uint64
+	listener       listener
+
+	// playbackMu protects the options that apply to audio streams.
+	playbackMu sync.Mutex
+	playback   playbackOptions
+	users      map[*gumble.User]userOptions
+	// The pan positions of streams.
+	panner audio.Panner
 
-	deviceSink  *openal.Device
-	contextSink *openal.Context
+	// captureMu protects the state of the capture controller.
+	captureMu sync.Mutex
+	capture   captureState
 }
 
+// New returns a new Stream that uses the default capture and playback
+// devices. If the capture device cannot be opened, the stream only plays
+// audio, and StartSource returns ErrNoCapture.
 func New(client *gumble.Client) (*Stream, error) {
-	s := &Stream{
-		client:          client,
-		sourceFrameSize: client.Config.AudioFrameSize(),
+	s := newStream(client)
+
+	deviceSource, err := openCapture("", s.sourceFrameSize)
+	if err != nil {
+		client.Logger().Warn("gumbleopenal: failed to open capture device", gumble.LogKeyError, err)
 	}
+	s.deviceSource = deviceSource
 
-	s.deviceSource = openal.CaptureOpenDevice("", gumble.AudioSampleRate, openal.FormatMono16, uint32(s.sourceFrameSize))
+	if err := s.open(""); err != nil {
+		if deviceSource != nil {
+			deviceSource.close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
 
-	s.deviceSink = openal.OpenDevice("")
-	s.contextSink = s.deviceSink.CreateContext()
-	s.contextSink.Activate()
+// NewWithDevices returns a new Stream that uses the named capture and
+// playback devices (see CaptureDevices and PlaybackDevices). An empty name
+// selects the default device. An error is returned if either device cannot be
+// opened.
+func NewWithDevices(client *gumble.Client, capture, playback string) (*Stream, error) {
+	s := newStream(client)
+	s.sourceName = capture
 
-	s.link = client.Config.AttachAudio(s)
+	deviceSource, err := openCapture(capture, s.sourceFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	s.deviceSource = deviceSource
 
+	if err := s.open(playback); err != nil {
+		deviceSource.close()
+		return nil, err
+	}
 	return s, nil
 }
 
+func newStream(client *gumble.Client) *Stream {
+	return &Stream{
+		client:          client,
+		sourceFrameSize: client.Config.AudioFrameSize(),
+		listener:        defaultListener,
+		playback:        defaultPlaybackOptions,
+		capture: captureState{
+			activation: DefaultVoiceActivation,
+		},
+	}
+}
+
+// open opens the playback device, and attaches the stream to the client.
+func (s *Stream) open(playback string) error {
+	sink, err := openPlayback(playback)
+	if err != nil {
+		return err
+	}
+	sink.activate()
+	s.sink = sink
+	s.sinkName = playback
+	s.applyListener()
+
+	s.client.Do(func() {
+		if self := s.client.Self; self != nil {
+			s.capture.selfMuted = self.SelfMuted
+			s.capture.muted = self.SelfMuted
+		}
+	})
+	s.link = s.client.Config.AttachAudio(s)
+	s.eventLink = s.client.Config.Attach(gumbleutil.Listener{
+		Connect:    s.onConnect,
+		UserChange: s.onUserChange,
+	})
+	return nil
+}
+
+func (s *Stream) onUserChange(e *gumble.UserChangeEvent) {
+	s.onSelfChange(e)
+	s.onUserDisconnect(e)
+}
+
 func (s *Stream) Destroy() {
 	s.link.Detach()
+	s.eventLink.Detach()
+	s.StopSource()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.deviceSource != nil {
-		s.StopSource()
-		s.deviceSource.CaptureCloseDevice()
+		s.deviceSource.close()
 		s.deviceSource = nil
 	}
-	if s.deviceSink != nil {
-		s.contextSink.Destroy()
-		s.deviceSink.CloseDevice()
-		s.contextSink = nil
-		s.deviceSink = nil
+
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	if s.sink != nil {
+		s.sink.close()
+		s.sink = nil
+		s.sinkGeneration++
 	}
 }
 
+// CaptureDevice returns the name of the capture device that the stream was
+// opened with ("" for the default device).
+func (s *Stream) CaptureDevice() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sourceName
+}
+
+// PlaybackDevice returns the name of the playback device that the stream was
+// opened with ("" for the default device).
+func (s *Stream) PlaybackDevice() string {
+	s.sinkMu.RLock()
+	defer s.sinkMu.RUnlock()
+	return s.sinkName
+}
+
+// SetCaptureDevice switches to the named capture device ("" for the default
+// device). If the stream is capturing, capturing continues on the new device.
+// If the device cannot be opened, the previous device remains in use.
+func (s *Stream) SetCaptureDevice(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frameSize := s.client.Config.AudioFrameSize()
+	deviceSource, err := openCapture(name, frameSize)
+	if err != nil {
+		return err
+	}
+
+	capturing := s.sourceStop != nil
+	if capturing {
+		s.stopSource()
+	}
+	if s.deviceSource != nil {
+		s.deviceSource.close()
+	}
+	s.deviceSource = deviceSource
+	s.sourceName = name
+	s.sourceFrameSize = frameSize
+	s.client.Logger().Debug("gumbleopenal: capture device changed", "device", name)
+	if capturing {
+		return s.startSource()
+	}
+	return nil
+}
+
+// SetPlaybackDevice switches to the named playback device ("" for the
+// default device). Audio streams that are playing continue on the new device.
+// If the device cannot be opened, the previous device remains in use.
+func (s *Stream) SetPlaybackDevice(name string) error {
+	sink, err := openPlayback(name)
+	if err != nil {
+		return err
+	}
+
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	if s.sink == nil {
+		// The stream has been destroyed.
+		sink.close()
+		return ErrState
+	}
+	// Destroying the context frees the sources and buffers of the audio
+	// streams, which create new ones when they see that sinkGeneration has
+	// changed.
+	sink.activate()
+	s.sink.close()
+	s.sink = sink
+	s.sinkName = name
+	s.sinkGeneration++
+	s.applyListener()
+	s.client.Logger().Debug("gumbleopenal: playback device changed", "device", name)
+	return nil
+}
+
 func (s *Stream) StartSource() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startSource()
+}
+
+// startSource starts capturing. s.mu must be held.
+func (s *Stream) startSource() error {
 	if s.sourceStop != nil {
 		return ErrState
 	}
-	s.deviceSource.CaptureStart()
-	s.sourceStop = make(chan bool)
-	go s.sourceRoutine()
+	if s.deviceSource == nil {
+		return ErrNoCapture
+	}
+	if frameSize := s.client.Config.AudioFrameSize(); frameSize != s.sourceFrameSize {
+		deviceSource, err := openCapture(s.sourceName, frameSize)
+		if err != nil {
+			return err
+		}
+		s.deviceSource.close()
+		s.deviceSource = deviceSource
+		s.sourceFrameSize = frameSize
+	}
+	s.deviceSource.start()
+	s.sourceStop = make(chan struct{})
+	s.sourceDone = make(chan struct{})
+	go s.sourceRoutine(s.deviceSource, s.sourceFrameSize, s.sourceStop, s.sourceDone)
 	return nil
 }
 
 func (s *Stream) StopSource() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopSource()
+}
+
+// stopSource stops capturing, and waits for sourceRoutine to return. s.mu
+// must be held.
+func (s *Stream) stopSource() error {
 	if s.sourceStop == nil {
 		return ErrState
 	}
 	close(s.sourceStop)
+	<-s.sourceDone
 	s.sourceStop = nil
-	s.deviceSource.CaptureStop()
+	s.sourceDone = nil
+	s.deviceSource.stop()
 	return nil
 }
 
 func (s *Stream) OnAudioStream(e *gumble.AudioStreamEvent) {
+	logger := s.client.Logger()
+	logger.Debug("gumbleopenal: audio stream started", gumble.LogKeySession, e.User.Session)
 	go func() {
-		source := openal.NewSource()
-		emptyBufs := openal.NewBuffers(8)
+		var (
+			source     openal.Source
+			buffers    *audio.Buffers
+			generation uint64
+			allocated  bool
+			state      = sourceState{pan: -1}
+		)
 		reclaim := func() {
 			if n := source.BuffersProcessed(); n > 0 {
-				reclaimedBufs := make(openal.Buffers, n)
-				source.UnqueueBuffers(reclaimedBufs)
-				emptyBufs = append(emptyBufs, reclaimedBufs...)
+				processed := make(openal.Buffers, n)
+				source.UnqueueBuffers(processed)
+				buffers.Unqueued(bufferNames(processed))
 			}
 		}
 		var raw [gumble.AudioMaximumFrameSize * 2]byte
 		for packet := range e.C {
-			samples := len(packet.AudioBuffer)
-			if samples > cap(raw) {
+			if len(packet.AudioBuffer)*2 > len(raw) {
+				logger.Warn("gumbleopenal: audio frame too large", gumble.LogKeySession, e.User.Session, gumble.LogKeyLength, len(packet.AudioBuffer))
 				continue
 			}
-			for i, value := range packet.AudioBuffer {
-				binary.LittleEndian.PutUint16(raw[i*2:], uint16(value))
+			size := audio.PutSamples(raw[:], packet.AudioBuffer)
+
+			s.sinkMu.RLock()
+			if s.sink == nil {
+				s.sinkMu.RUnlock()
+				continue
+			}
+			if !allocated || generation != s.sinkGeneration {
+				// The source and buffers of a previous playback device were
+				// freed with its context.
+				source = openal.NewSource()
+				buffers = audio.NewBuffers(bufferNames(openal.NewBuffers(8)))
+				generation = s.sinkGeneration
+				allocated = true
+				state.valid = false
+			}
+			if !s.updateSource(source, &state, packet) {
+				s.sinkMu.RUnlock()
+				continue
 			}
 			reclaim()
-			if len(emptyBufs) == 0 {
+			name, ok := buffers.Queue()
+			if !ok {
+				s.sinkMu.RUnlock()
+				logger.Debug("gumbleopenal: playback buffers full, audio frame dropped", gumble.LogKeySession, e.User.Session)
 				continue
 			}
-			last := len(emptyBufs) - 1
-			buffer := emptyBufs[last]
-			emptyBufs = emptyBufs[:last]
-			buffer.SetData(openal.FormatMono16, raw[:samples*2], gumble.AudioSampleRate)
+			buffer := openal.Buffer(name)
+			buffer.SetData(openal.FormatMono16, raw[:size], gumble.AudioSampleRate)
 			source.QueueBuffer(buffer)
 			if source.State() != openal.Playing {
 				source.Play()
 			}
+			s.sinkMu.RUnlock()
+		}
+
+		if state.pan >= 0 {
+			s.playbackMu.Lock()
+			s.panner.Release(state.pan)
+			s.playbackMu.Unlock()
+		}
+
+		s.sinkMu.RLock()
+		defer s.sinkMu.RUnlock()
+		if allocated && generation == s.sinkGeneration {
+			reclaim()
+			free := buffers.Free()
+			deleted := make(openal.Buffers, len(free))
+			for i, name := range free {
+				deleted[i] = openal.Buffer(name)
+			}
+			deleted.Delete()
+			source.Delete()
 		}
-		reclaim()
-		emptyBufs.Delete()
-		source.Delete()
 	}()
 }
 
-func (s *Stream) sourceRoutine() {
-	interval := s.client.Config.AudioInterval
-	frameSize := s.client.Config.AudioFrameSize()
-
-	if frameSize != s.sourceFrameSize {
-		s.deviceSource.CaptureCloseDevice()
-		s.sourceFrameSize = frameSize
-		s.deviceSource = openal.CaptureOpenDevice("", gumble.AudioSampleRate, openal.FormatMono16, uint32(s.sourceFrameSize))
+// bufferNames returns the names of OpenAL buffers.
+func bufferNames(buffers openal.Buffers) []uint32 {
+	names := make([]uint32, len(buffers))
+	for i, buffer := range buffers {
+		names[i] = uint32(buffer)
 	}
+	return names
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+func (s *Stream) sourceRoutine(device *captureDevice, frameSize int, stop, done chan struct{}) {
+	defer close(done)
 
-	stop := s.sourceStop
+	interval := s.client.Config.AudioInterval
+	pacer := gumble.NewAudioPacer(interval)
+	pacer.OnUnderrun = func(skipped int) {
+		s.client.Logger().Warn("gumbleopenal: audio underrun", "skipped", skipped)
+	}
 
-	outgoing := s.client.AudioOutgoing()
-	defer close(outgoing)
+	// A new outgoing audio stream is started each time transmission starts.
+	// Closing it sends the last frame as the end of the transmission.
+	var outgoing chan<- gumble.AudioBuffer
+	defer func() {
+		if outgoing != nil {
+			close(outgoing)
+		}
+		s.stopTransmitting()
+	}()
 
-	for {
-		select {
-		case <-stop:
-			return
-		case <-ticker.C:
-			buff := s.deviceSource.CaptureSamples(uint32(frameSize))
-			if len(buff) != frameSize*2 {
-				continue
-			}
-			int16Buffer := make([]int16, frameSize)
-			for i := range int16Buffer {
-				int16Buffer[i] = int16(binary.LittleEndian.Uint16(buff[i*2 : (i+1)*2]))
+	for pacer.Wait(stop) {
+		int16Buffer := make([]int16, frameSize)
+		if !device.capture(int16Buffer) {
+			s.client.Logger().Debug("gumbleopenal: incomplete capture frame", gumble.LogKeyLength, frameSize)
+			continue
+		}
+		if !s.transmit(int16Buffer, interval) {
+			if outgoing != nil {
+				close(outgoing)
+				outgoing = nil
 			}
-			outgoing <- gumble.AudioBuffer(int16Buffer)
+			continue
+		}
+		if outgoing == nil {
+			outgoing = s.client.AudioOutgoing()
 		}
+		outgoing <- gumble.AudioBuffer(int16Buffer)
 	}
 }
@@ -0,0 +1,43 @@
+package gumbletest
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"layeh.com/gumble/gumble"
+)
+
+func TestServerDialError(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Require a client certificate, which the client does not have, so that
+	// the handshake fails.
+	listener := server.listener
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = tls.NewListener(server.tcpListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if _, err := server.Dial(gumble.NewConfig()); err == nil {
+		t.Fatal("expected dial error")
+	} else if strings.Contains(err.Error(), "closed network connection") {
+		t.Fatalf("dial error hidden by accept error: %v", err)
+	}
+
+	// The server is still usable.
+	server.listener = listener
+	client, err := server.Dial(gumble.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+}
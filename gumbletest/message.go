@@ -0,0 +1,180 @@
+package gumbletest
+
+import (
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/MumbleProto"
+)
+
+// newMessage returns an empty protobuf message of the given packet type, or
+// nil if the type is unknown or is not a protobuf message (i.e. UDPTunnel).
+func newMessage(packetType uint16) proto.Message {
+	switch packetType {
+	case 0:
+		return &MumbleProto.Version{}
+	case 2:
+		return &MumbleProto.Authenticate{}
+	case 3:
+		return &MumbleProto.Ping{}
+	case 4:
+		return &MumbleProto.Reject{}
+	case 5:
+		return &MumbleProto.ServerSync{}
+	case 6:
+		return &MumbleProto.ChannelRemove{}
+	case 7:
+		return &MumbleProto.ChannelState{}
+	case 8:
+		return &MumbleProto.UserRemove{}
+	case 9:
+		return &MumbleProto.UserState{}
+	case 10:
+		return &MumbleProto.BanList{}
+	case 11:
+		return &MumbleProto.TextMessage{}
+	case 12:
+		return &MumbleProto.PermissionDenied{}
+	case 13:
+		return &MumbleProto.ACL{}
+	case 14:
+		return &MumbleProto.QueryUsers{}
+	case 15:
+		return &MumbleProto.CryptSetup{}
+	case 16:
+		return &MumbleProto.ContextActionModify{}
+	case 17:
+		return &MumbleProto.ContextAction{}
+	case 18:
+		return &MumbleProto.UserList{}
+	case 19:
+		return &MumbleProto.VoiceTarget{}
+	case 20:
+		return &MumbleProto.PermissionQuery{}
+	case 21:
+		return &MumbleProto.CodecVersion{}
+	case 22:
+		return &MumbleProto.UserStats{}
+	case 23:
+		return &MumbleProto.RequestBlob{}
+	case 24:
+		return &MumbleProto.ServerConfig{}
+	case 25:
+		return &MumbleProto.SuggestConfig{}
+	}
+	return nil
+}
+
+// ChannelState returns a message that creates or updates the channel with
+// the given ID. The root channel has ID 0 and no parent; for other channels,
+// parent is the ID of the parent channel.
+func ChannelState(id, parent uint32, name string) *MumbleProto.ChannelState {
+	packet := &MumbleProto.ChannelState{
+		ChannelId: proto.Uint32(id),
+		Name:      proto.String(name),
+	}
+	if id != 0 {
+		packet.Parent = proto.Uint32(parent)
+	}
+	return packet
+}
+
+// ChannelRemove returns a message that removes the channel with the given ID.
+func ChannelRemove(id uint32) *MumbleProto.ChannelRemove {
+	return &MumbleProto.ChannelRemove{
+		ChannelId: proto.Uint32(id),
+	}
+}
+
+// UserState returns a message that adds a user with the given session, or
+// updates its name and channel if it already exists.
+func UserState(session uint32, name string, channel uint32) *MumbleProto.UserState {
+	return &MumbleProto.UserState{
+		Session:   proto.Uint32(session),
+		Name:      proto.String(name),
+		ChannelId: proto.Uint32(channel),
+	}
+}
+
+// UserMove returns a message that moves the user with the given session to
+// channel. actor is the session of the user who moved them (0 for the
+// server).
+func UserMove(session, actor, channel uint32) *MumbleProto.UserState {
+	return &MumbleProto.UserState{
+		Session:   proto.Uint32(session),
+		Actor:     proto.Uint32(actor),
+		ChannelId: proto.Uint32(channel),
+	}
+}
+
+// UserRemove returns a message that removes the user with the given session
+// from the server. If actor is non-zero, the user was kicked (or banned) by
+// actor.
+func UserRemove(session, actor uint32, reason string, ban bool) *MumbleProto.UserRemove {
+	packet := &MumbleProto.UserRemove{
+		Session: proto.Uint32(session),
+	}
+	if actor != 0 {
+		packet.Actor = proto.Uint32(actor)
+		packet.Ban = proto.Bool(ban)
+	}
+	if reason != "" {
+		packet.Reason = proto.String(reason)
+	}
+	return packet
+}
+
+// TextMessage returns a text message from actor that is sent to the given
+// users (by session). If no sessions are given, the message is sent to the
+// root channel.
+func TextMessage(actor uint32, message string, sessions ...uint32) *MumbleProto.TextMessage {
+	packet := &MumbleProto.TextMessage{
+		Actor:   proto.Uint32(actor),
+		Message: proto.String(message),
+	}
+	if len(sessions) > 0 {
+		packet.Session = sessions
+	} else {
+		packet.ChannelId = []uint32{0}
+	}
+	return packet
+}
+
+// PermissionDenied returns a message that denies permission in the channel
+// with the given ID.
+func PermissionDenied(permission gumble.Permission, channel uint32, reason string) *MumbleProto.PermissionDenied {
+	packet := &MumbleProto.PermissionDenied{
+		Type:       MumbleProto.PermissionDenied_Permission.Enum(),
+		Permission: proto.Uint32(uint32(permission)),
+		ChannelId:  proto.Uint32(channel),
+	}
+	if reason != "" {
+		packet.Reason = proto.String(reason)
+	}
+	return packet
+}
+
+// Denied returns a PermissionDenied message of the given type.
+// PermissionDeniedInvalidChannelName and PermissionDeniedInvalidUserName
+// denials carry the offending name in reason.
+func Denied(t gumble.PermissionDeniedType, reason string) *MumbleProto.PermissionDenied {
+	packet := &MumbleProto.PermissionDenied{
+		Type: MumbleProto.PermissionDenied_DenyType(t).Enum(),
+	}
+	if reason != "" {
+		switch t {
+		case gumble.PermissionDeniedInvalidChannelName, gumble.PermissionDeniedInvalidUserName:
+			packet.Name = proto.String(reason)
+		default:
+			packet.Reason = proto.String(reason)
+		}
+	}
+	return packet
+}
+
+// Reject returns a message that rejects the client's connection.
+func Reject(t gumble.RejectType, reason string) *MumbleProto.Reject {
+	return &MumbleProto.Reject{
+		Type:   MumbleProto.Reject_RejectType(t).Enum(),
+		Reason: proto.String(reason),
+	}
+}
@@ -0,0 +1,450 @@
+// Package gumbletest provides an in-process fake Mumble server for testing
+// code that uses gumble.Client.
+//
+// The server accepts a single client over loopback TLS, syncs an initial
+// server state, and then lets the test script server-side events and inspect
+// the messages that the client sent:
+//
+//	server, err := gumbletest.NewServer()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer server.Close()
+//	server.Send(gumbletest.ChannelState(1, 0, "Lobby"))
+//
+//	client, err := server.Dial(gumble.NewConfig())
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	alice := server.AddUser("Alice", 1)
+//	server.Send(gumbletest.TextMessage(alice, "!ping", server.Session()))
+//
+//	var reply MumbleProto.TextMessage
+//	if err := server.ExpectMessage(time.Second, &reply); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// The server does not implement any server logic: messages sent by the client
+// (e.g. a UserState that moves a user) are only recorded, and the test must
+// send the server's response itself, either after Expect returns, or from a
+// function passed to Handle. Pings are the exception; they are answered
+// automatically so that gumble.Request and the helpers built on it complete.
+package gumbletest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/MumbleProto"
+	"layeh.com/gumble/gumble/varint"
+)
+
+var (
+	errNotConnected = errors.New("gumbletest: client is not connected")
+	errTimeout      = errors.New("gumbletest: timed out waiting for packet")
+	errClosed       = errors.New("gumbletest: connection closed")
+)
+
+// Packet is a packet that the server received from the client.
+type Packet struct {
+	// The packet type (see gumble.PacketTypeName).
+	Type uint16
+	// The raw packet data.
+	Data []byte
+	// The decoded message, or nil if the packet is not a protobuf message
+	// (i.e. a UDPTunnel packet) or could not be decoded.
+	Message proto.Message
+}
+
+// Server is a fake Mumble server that accepts a single client.
+type Server struct {
+	// The welcome message and maximum bandwidth sent to the client in the
+	// ServerSync message. Must be set before Dial.
+	WelcomeText  string
+	MaxBandwidth uint32
+	// The user name assigned to the client. Defaults to the user name that
+	// the client authenticated with.
+	Username string
+
+	listener net.Listener
+	// The TCP listener wrapped by listener, used to interrupt Accept.
+	tcpListener *net.TCPListener
+
+	mu          sync.Mutex
+	conn        *gumble.Conn
+	initial     []proto.Message
+	nextSession uint32
+	session     uint32
+	pending     []*Packet
+	received    []*Packet
+	changed     chan struct{}
+	closed      bool
+	handler     func(*Packet) []proto.Message
+}
+
+// NewServer starts a new fake server listening on a loopback address with a
+// self-signed certificate.
+func NewServer() (*Server, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	listener := tls.NewListener(tcpListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	return &Server{
+		listener:    listener,
+		tcpListener: tcpListener,
+		nextSession: 1,
+		changed:     make(chan struct{}),
+	}, nil
+}
+
+// Addr returns the address on which the server is listening.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Dial connects a new gumble.Client to the server. The client is synced with
+// the root channel, the channels and users that were sent before Dial, and a
+// UserState for the client itself.
+func (s *Server) Dial(config *gumble.Config) (*gumble.Client, error) {
+	accepted := make(chan error, 1)
+	go func() {
+		accepted <- s.Accept()
+	}()
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
+	client, err := gumble.DialWithDialer(dialer, s.Addr(), config, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		// Stop the pending Accept without closing the listener, so that the
+		// server can still be used.
+		s.tcpListener.SetDeadline(time.Now())
+		<-accepted
+		s.tcpListener.SetDeadline(time.Time{})
+		return nil, err
+	}
+	return client, nil
+}
+
+// Accept waits for a client to connect to Addr, and syncs the initial state
+// (see Dial). It can be used to test code that dials the server itself, and
+// can be called again after the client has disconnected to accept a
+// reconnecting client.
+func (s *Server) Accept() error {
+	netConn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	conn := gumble.NewConn(netConn)
+	conn.Timeout = time.Hour
+
+	var username string
+	for done := false; !done; {
+		packet, err := readPacket(conn)
+		if err != nil {
+			netConn.Close()
+			return err
+		}
+		s.record(packet)
+		if authenticate, ok := packet.Message.(*MumbleProto.Authenticate); ok {
+			username = authenticate.GetUsername()
+			done = true
+		}
+	}
+
+	s.mu.Lock()
+	s.closed = false
+	if s.Username != "" {
+		username = s.Username
+	}
+	s.session = s.nextSession
+	s.nextSession++
+	messages := []proto.Message{
+		&MumbleProto.Version{
+			Version: proto.Uint32(gumble.ClientVersion),
+			Release: proto.String("gumbletest"),
+		},
+		&MumbleProto.CodecVersion{
+			Alpha:       proto.Int32(0),
+			Beta:        proto.Int32(0),
+			PreferAlpha: proto.Bool(true),
+			Opus:        proto.Bool(true),
+		},
+		ChannelState(0, 0, "Root"),
+	}
+	messages = append(messages, s.initial...)
+	messages = append(messages,
+		UserState(s.session, username, 0),
+		&MumbleProto.ServerSync{
+			Session:      proto.Uint32(s.session),
+			WelcomeText:  proto.String(s.WelcomeText),
+			MaxBandwidth: proto.Uint32(s.MaxBandwidth),
+		},
+	)
+	s.initial = nil
+	for _, message := range messages {
+		if err := conn.WriteProto(message); err != nil {
+			s.mu.Unlock()
+			netConn.Close()
+			return err
+		}
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	go s.readRoutine(conn)
+	return nil
+}
+
+// readRoutine records the packets sent by the client, and answers pings.
+func (s *Server) readRoutine(conn *gumble.Conn) {
+	for {
+		packet, err := readPacket(conn)
+		if err != nil {
+			break
+		}
+		if ping, ok := packet.Message.(*MumbleProto.Ping); ok {
+			conn.WriteProto(&MumbleProto.Ping{
+				Timestamp: ping.Timestamp,
+			})
+			continue
+		}
+		s.mu.Lock()
+		handler := s.handler
+		s.mu.Unlock()
+		if handler != nil {
+			for _, message := range handler(packet) {
+				conn.WriteProto(message)
+			}
+		}
+		s.record(packet)
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	s.notify()
+	s.mu.Unlock()
+}
+
+func readPacket(conn *gumble.Conn) (*Packet, error) {
+	pType, data, err := conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	packet := &Packet{
+		Type: pType,
+		Data: append([]byte(nil), data...),
+	}
+	if message := newMessage(pType); message != nil {
+		if err := proto.Unmarshal(packet.Data, message); err == nil {
+			packet.Message = message
+		}
+	}
+	return packet, nil
+}
+
+func (s *Server) record(packet *Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, packet)
+	s.received = append(s.received, packet)
+	s.notify()
+}
+
+// notify wakes up the goroutines waiting in Expect. s.mu must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Session returns the session of the connected client, or 0 if no client
+// has connected.
+func (s *Server) Session() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+// Send sends message to the client. Messages sent before Dial are part of the
+// initial server state.
+func (s *Server) Send(message proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		s.initial = append(s.initial, message)
+		return nil
+	}
+	return s.conn.WriteProto(message)
+}
+
+// Handle sets a function that is called with each packet that the client
+// sends, except pings. The messages that handler returns are sent to the
+// client before the next packet is read, so, like responses from a real
+// server, they arrive before the answer to any later ping (and so before the
+// gumble.Request that sent the packet completes). The packets are still
+// recorded for Expect.
+//
+// handler is called from the server's read goroutine; it must not call
+// Expect or ExpectMessage.
+func (s *Server) Handle(handler func(packet *Packet) []proto.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+// AddUser adds a fake user with the given name to the channel, and returns
+// its session.
+func (s *Server) AddUser(name string, channel uint32) uint32 {
+	s.mu.Lock()
+	session := s.nextSession
+	s.nextSession++
+	s.mu.Unlock()
+	s.Send(UserState(session, name, channel))
+	return session
+}
+
+// SendAudio sends an Opus voice packet from the fake user with the given
+// session to the client. data is an encoded Opus frame.
+func (s *Server) SendAudio(session uint32, sequence int64, data []byte, final bool) error {
+	var buff [1 + 3*varint.MaxVarintLen]byte
+	buff[0] = 4 << 5
+	n := 1
+	n += varint.Encode(buff[n:], int64(session))
+	n += varint.Encode(buff[n:], sequence)
+	length := int64(len(data))
+	if final {
+		length |= 0x2000
+	}
+	n += varint.Encode(buff[n:], length)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.WritePacket(1, append(buff[:n], data...))
+}
+
+// Received returns all of the packets that the client has sent, including
+// the Version and Authenticate packets but excluding pings.
+func (s *Server) Received() []*Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Packet(nil), s.received...)
+}
+
+// Expect waits for the client to send a packet that match accepts, and
+// returns it. Packets are matched in the order they were received; each
+// packet can be returned by Expect only once. Packets that are not matched
+// are left for later calls.
+func (s *Server) Expect(timeout time.Duration, match func(*Packet) bool) (*Packet, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		for i, packet := range s.pending {
+			if match(packet) {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				s.mu.Unlock()
+				return packet, nil
+			}
+		}
+		changed := s.changed
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed {
+			return nil, errClosed
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, errTimeout
+		}
+	}
+}
+
+// ExpectMessage waits for the client to send a message of the same type as
+// message, and copies it into message.
+//
+//	var state MumbleProto.UserState
+//	err := server.ExpectMessage(time.Second, &state)
+func (s *Server) ExpectMessage(timeout time.Duration, message proto.Message) error {
+	t := reflect.TypeOf(message)
+	packet, err := s.Expect(timeout, func(p *Packet) bool {
+		return p.Message != nil && reflect.TypeOf(p.Message) == t
+	})
+	if err != nil {
+		return err
+	}
+	message.Reset()
+	proto.Merge(message, packet.Message)
+	return nil
+}
+
+// Disconnect closes the connection to the client.
+func (s *Server) Disconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.Close()
+}
+
+// Close stops the server and closes the connection to the client.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gumbletest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
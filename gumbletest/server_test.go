@@ -0,0 +1,162 @@
+package gumbletest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/MumbleProto"
+	"layeh.com/gumble/gumbletest"
+)
+
+func TestServer(t *testing.T) {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.WelcomeText = "Welcome"
+	server.Send(gumbletest.ChannelState(1, 0, "Lobby"))
+
+	config := gumble.NewConfig()
+	config.Username = "bot"
+	messages := make(chan *gumble.TextMessageEvent, 1)
+	config.Attach(gumbleListener{messages})
+
+	client, err := server.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	var self string
+	var lobby *gumble.Channel
+	client.Do(func() {
+		self = client.Self.Name
+		lobby = client.Channels[1]
+	})
+	if self != "bot" || lobby == nil || lobby.Name != "Lobby" {
+		t.Fatalf("unexpected initial state: self %q, lobby %v", self, lobby)
+	}
+
+	alice := server.AddUser("Alice", 1)
+	server.Send(gumbletest.TextMessage(alice, "hello", server.Session()))
+	select {
+	case e := <-messages:
+		if e.Sender == nil || e.Sender.Name != "Alice" || e.Message != "hello" {
+			t.Errorf("unexpected text message: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for text message")
+	}
+
+	client.Self.Channel.Send("hi", false)
+	var sent MumbleProto.TextMessage
+	if err := server.ExpectMessage(5*time.Second, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.GetMessage() != "hi" {
+		t.Errorf("unexpected message sent: %q", sent.GetMessage())
+	}
+
+	// The handler's responses arrive before the request's ping is answered.
+	server.Handle(func(p *gumbletest.Packet) []proto.Message {
+		if m, ok := p.Message.(*MumbleProto.TextMessage); ok && m.GetMessage() == "denied" {
+			return []proto.Message{gumbletest.PermissionDenied(gumble.PermissionTextMessage, 1, "")}
+		}
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scope := gumble.RequestScope{Permission: gumble.PermissionTextMessage}
+	r := client.Track(scope, func() {
+		client.Self.Channel.Send("denied", false)
+	})
+	if _, ok := r.Wait(ctx).(*gumble.PermissionDeniedError); !ok {
+		t.Errorf("expected permission denied error, got %v", r.Err())
+	}
+	r = client.Track(scope, func() {
+		client.Self.Channel.Send("allowed", false)
+	})
+	if err := r.Wait(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type gumbleListener struct {
+	messages chan *gumble.TextMessageEvent
+}
+
+func (l gumbleListener) OnConnect(e *gumble.ConnectEvent)                         {}
+func (l gumbleListener) OnDisconnect(e *gumble.DisconnectEvent)                   {}
+func (l gumbleListener) OnTextMessage(e *gumble.TextMessageEvent)                 { l.messages <- e }
+func (l gumbleListener) OnUserChange(e *gumble.UserChangeEvent)                   {}
+func (l gumbleListener) OnChannelChange(e *gumble.ChannelChangeEvent)             {}
+func (l gumbleListener) OnPermissionDenied(e *gumble.PermissionDeniedEvent)       {}
+func (l gumbleListener) OnUserList(e *gumble.UserListEvent)                       {}
+func (l gumbleListener) OnACL(e *gumble.ACLEvent)                                 {}
+func (l gumbleListener) OnBanList(e *gumble.BanListEvent)                         {}
+func (l gumbleListener) OnContextActionChange(e *gumble.ContextActionChangeEvent) {}
+func (l gumbleListener) OnServerConfig(e *gumble.ServerConfigEvent)               {}
+
+func TestServerAudio(t *testing.T) {
+	gumble.RegisterAudioCodec(4, testCodec{})
+
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	alice := server.AddUser("Alice", 0)
+
+	config := gumble.NewConfig()
+	packets := make(chan *gumble.AudioPacket, 1)
+	config.AttachAudio(audioListener{packets})
+	client, err := server.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if err := server.SendAudio(alice, 0, []byte{1, 2, 3}, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-packets:
+		if p.Sender.Session != alice || len(p.AudioBuffer) != 3 || p.AudioBuffer[2] != 3 {
+			t.Errorf("unexpected audio packet: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for audio packet")
+	}
+}
+
+type audioListener struct {
+	packets chan *gumble.AudioPacket
+}
+
+func (l audioListener) OnAudioStream(e *gumble.AudioStreamEvent) {
+	go func() {
+		for p := range e.C {
+			l.packets <- p
+		}
+	}()
+}
+
+// testCodec "decodes" each byte of a frame to a sample.
+type testCodec struct{}
+
+func (testCodec) ID() int                         { return 4 }
+func (testCodec) NewEncoder() gumble.AudioEncoder { return nil }
+func (testCodec) NewDecoder() gumble.AudioDecoder { return testCodec{} }
+func (testCodec) Reset()                          {}
+
+func (testCodec) Decode(data []byte, frameSize int) ([]int16, error) {
+	pcm := make([]int16, len(data))
+	for i, b := range data {
+		pcm[i] = int16(b)
+	}
+	return pcm, nil
+}
@@ -1,6 +1,8 @@
 package gumbleutil
 
 import (
+	"context"
+
 	"layeh.com/gumble/gumble"
 )
 
@@ -53,3 +55,45 @@ func UserGroups(client *gumble.Client, user *gumble.User, channel *gumble.Channe
 
 	return ch
 }
+
+// FetchACL requests the ACL of channel, and blocks until it is received, the
+// server denies the request, the channel is removed, or ctx is done.
+//
+// This function must not be called from inside of an event listener.
+func FetchACL(ctx context.Context, client *gumble.Client, channel *gumble.Channel) (*gumble.ACL, error) {
+	var acl *gumble.ACL
+	err := waitCondition(ctx, client, func() (bool, error) {
+		if channelRemoved(client, channel) {
+			return true, errChannelRemoved
+		}
+		channel.RequestACL()
+		return false, nil
+	}, func(e interface{}) (bool, error) {
+		switch e := e.(type) {
+		case *gumble.ACLEvent:
+			if e.ACL.Channel == channel {
+				acl = e.ACL
+				return true, nil
+			}
+		case *gumble.ChannelChangeEvent:
+			if e.Channel == channel && e.Type.Has(gumble.ChannelChangeRemoved) {
+				return true, errChannelRemoved
+			}
+		case *gumble.PermissionDeniedEvent:
+			if e.Channel == channel && e.Type == gumble.PermissionDeniedPermission && e.Permission.Has(gumble.PermissionWrite) {
+				return true, e.Err()
+			}
+		}
+		return false, nil
+	})
+	return acl, err
+}
+
+// channelRemoved returns true if channel is no longer one of the client's
+// channels.
+func channelRemoved(client *gumble.Client, channel *gumble.Channel) (removed bool) {
+	client.Do(func() {
+		removed = client.Channels[channel.ID] != channel
+	})
+	return
+}
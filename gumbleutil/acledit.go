@@ -0,0 +1,362 @@
+package gumbleutil
+
+import (
+	"sort"
+
+	"layeh.com/gumble/gumble"
+)
+
+// CopyACL returns a deep copy of acl. The returned ACL's rules reference the
+// copied groups.
+func CopyACL(acl *gumble.ACL) *gumble.ACL {
+	copyUsers := func(users map[uint32]*gumble.ACLUser) map[uint32]*gumble.ACLUser {
+		if users == nil {
+			return nil
+		}
+		c := make(map[uint32]*gumble.ACLUser, len(users))
+		for id, user := range users {
+			u := *user
+			c[id] = &u
+		}
+		return c
+	}
+
+	c := &gumble.ACL{
+		Channel:  acl.Channel,
+		Inherits: acl.Inherits,
+	}
+	groups := make(map[*gumble.ACLGroup]*gumble.ACLGroup, len(acl.Groups))
+	for _, group := range acl.Groups {
+		g := *group
+		g.UsersAdd = copyUsers(group.UsersAdd)
+		g.UsersRemove = copyUsers(group.UsersRemove)
+		g.UsersInherited = copyUsers(group.UsersInherited)
+		groups[group] = &g
+		c.Groups = append(c.Groups, &g)
+	}
+	for _, rule := range acl.Rules {
+		r := *rule
+		if rule.User != nil {
+			u := *rule.User
+			r.User = &u
+		}
+		if rule.Group != nil {
+			if g := groups[rule.Group]; g != nil {
+				r.Group = g
+			} else {
+				g := *rule.Group
+				r.Group = &g
+			}
+		}
+		c.Rules = append(c.Rules, &r)
+	}
+	return c
+}
+
+// ACLBuilder makes programmatic edits to a copy of an ACL. The edited ACL can
+// be sent to the server with:
+//
+//	client.Send(builder.ACL())
+//
+// Only non-inherited groups and rules are modified by the builder.
+type ACLBuilder struct {
+	acl *gumble.ACL
+}
+
+// NewACLBuilder returns a new ACLBuilder that edits a copy of acl.
+func NewACLBuilder(acl *gumble.ACL) *ACLBuilder {
+	return &ACLBuilder{
+		acl: CopyACL(acl),
+	}
+}
+
+// ACL returns the edited ACL.
+func (b *ACLBuilder) ACL() *gumble.ACL {
+	return b.acl
+}
+
+// SetInherits sets whether the ACL inherits the parent channel's ACL.
+func (b *ACLBuilder) SetInherits(inherits bool) {
+	b.acl.Inherits = inherits
+}
+
+// Group returns the group with the given name, creating it if it does not
+// exist. Modifying an inherited group creates a local group of the same name
+// on the channel.
+func (b *ACLBuilder) Group(name string) *gumble.ACLGroup {
+	for _, group := range b.acl.Groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	group := &gumble.ACLGroup{
+		Name:         name,
+		InheritUsers: true,
+		Inheritable:  true,
+	}
+	b.acl.Groups = append(b.acl.Groups, group)
+	return group
+}
+
+// RemoveGroup removes the local group with the given name. If the group is
+// inherited, only the channel's modifications to it are removed.
+func (b *ACLBuilder) RemoveGroup(name string) {
+	for i, group := range b.acl.Groups {
+		if group.Name != name {
+			continue
+		}
+		if group.Inherited {
+			group.InheritUsers = true
+			group.Inheritable = true
+			group.UsersAdd = nil
+			group.UsersRemove = nil
+		} else {
+			b.acl.Groups = append(b.acl.Groups[:i], b.acl.Groups[i+1:]...)
+		}
+		return
+	}
+}
+
+// AddGroupUser adds user to the named group.
+func (b *ACLBuilder) AddGroupUser(name string, user *gumble.ACLUser) {
+	group := b.Group(name)
+	if group.UsersAdd == nil {
+		group.UsersAdd = make(map[uint32]*gumble.ACLUser)
+	}
+	group.UsersAdd[user.UserID] = user
+	delete(group.UsersRemove, user.UserID)
+}
+
+// RemoveGroupUser removes user from the named group. If the user is an
+// inherited member of the group, the user is explicitly excluded.
+func (b *ACLBuilder) RemoveGroupUser(name string, user *gumble.ACLUser) {
+	group := b.Group(name)
+	delete(group.UsersAdd, user.UserID)
+	if group.UsersInherited[user.UserID] != nil {
+		if group.UsersRemove == nil {
+			group.UsersRemove = make(map[uint32]*gumble.ACLUser)
+		}
+		group.UsersRemove[user.UserID] = user
+	}
+}
+
+// AddGroupRule appends a rule for the named group to the ACL.
+func (b *ACLBuilder) AddGroupRule(name string, granted, denied gumble.Permission, appliesCurrent, appliesChildren bool) *gumble.ACLRule {
+	var group *gumble.ACLGroup
+	for _, g := range b.acl.Groups {
+		if g.Name == name {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		group = &gumble.ACLGroup{
+			Name: name,
+		}
+	}
+	rule := &gumble.ACLRule{
+		AppliesCurrent:  appliesCurrent,
+		AppliesChildren: appliesChildren,
+		Granted:         granted,
+		Denied:          denied,
+		Group:           group,
+	}
+	b.acl.Rules = append(b.acl.Rules, rule)
+	return rule
+}
+
+// AddUserRule appends a rule for user to the ACL.
+func (b *ACLBuilder) AddUserRule(user *gumble.ACLUser, granted, denied gumble.Permission, appliesCurrent, appliesChildren bool) *gumble.ACLRule {
+	rule := &gumble.ACLRule{
+		AppliesCurrent:  appliesCurrent,
+		AppliesChildren: appliesChildren,
+		Granted:         granted,
+		Denied:          denied,
+		User:            user,
+	}
+	b.acl.Rules = append(b.acl.Rules, rule)
+	return rule
+}
+
+// RemoveRules removes the non-inherited rules for which f returns true.
+func (b *ACLBuilder) RemoveRules(f func(rule *gumble.ACLRule) bool) {
+	rules := b.acl.Rules[:0]
+	for _, rule := range b.acl.Rules {
+		if rule.Inherited || !f(rule) {
+			rules = append(rules, rule)
+		}
+	}
+	b.acl.Rules = rules
+}
+
+// ACLGroupDiff describes how a group differs between two ACLs.
+type ACLGroupDiff struct {
+	Name     string
+	Old, New *gumble.ACLGroup
+
+	// Did InheritUsers or Inheritable change?
+	InheritUsersChanged bool
+	InheritableChanged  bool
+
+	// Users added to and removed from the group's UsersAdd set.
+	UsersAddAdded, UsersAddRemoved []*gumble.ACLUser
+	// Users added to and removed from the group's UsersRemove set.
+	UsersRemoveAdded, UsersRemoveRemoved []*gumble.ACLUser
+}
+
+// ACLDiff is the difference between two ACLs. Inherited rules and unmodified
+// inherited groups, which cannot be changed through the channel's ACL, are
+// ignored.
+type ACLDiff struct {
+	InheritsChanged bool
+
+	GroupsAdded   []*gumble.ACLGroup
+	GroupsRemoved []*gumble.ACLGroup
+	GroupsChanged []*ACLGroupDiff
+
+	RulesAdded   []*gumble.ACLRule
+	RulesRemoved []*gumble.ACLRule
+	// Is the order of the rules that are in both ACLs different?
+	RulesReordered bool
+}
+
+// Empty returns true if the ACLs are equivalent.
+func (d *ACLDiff) Empty() bool {
+	return !d.InheritsChanged && len(d.GroupsAdded) == 0 && len(d.GroupsRemoved) == 0 && len(d.GroupsChanged) == 0 && len(d.RulesAdded) == 0 && len(d.RulesRemoved) == 0 && !d.RulesReordered
+}
+
+// DiffACL returns the changes needed to turn old into new.
+func DiffACL(old, new *gumble.ACL) *ACLDiff {
+	d := &ACLDiff{
+		InheritsChanged: old.Inherits != new.Inherits,
+	}
+
+	oldGroups := groupsByName(old)
+	newGroups := groupsByName(new)
+	for _, group := range old.Groups {
+		if isLocalGroup(group) && newGroups[group.Name] == nil {
+			d.GroupsRemoved = append(d.GroupsRemoved, group)
+		}
+	}
+	for _, group := range new.Groups {
+		oldGroup := oldGroups[group.Name]
+		if oldGroup == nil {
+			if isLocalGroup(group) {
+				d.GroupsAdded = append(d.GroupsAdded, group)
+			}
+			continue
+		}
+		if gd := diffACLGroup(oldGroup, group); gd != nil {
+			d.GroupsChanged = append(d.GroupsChanged, gd)
+		}
+	}
+
+	oldRules := localRules(old)
+	newRules := localRules(new)
+	var common []int
+	matched := make([]bool, len(newRules))
+	for _, rule := range oldRules {
+		found := false
+		for j, other := range newRules {
+			if !matched[j] && equalACLRule(rule, other) {
+				matched[j] = true
+				found = true
+				common = append(common, j)
+				break
+			}
+		}
+		if !found {
+			d.RulesRemoved = append(d.RulesRemoved, rule)
+		}
+	}
+	for j, rule := range newRules {
+		if !matched[j] {
+			d.RulesAdded = append(d.RulesAdded, rule)
+		}
+	}
+	for i := 1; i < len(common); i++ {
+		if common[i] < common[i-1] {
+			d.RulesReordered = true
+			break
+		}
+	}
+	return d
+}
+
+func groupsByName(acl *gumble.ACL) map[string]*gumble.ACLGroup {
+	groups := make(map[string]*gumble.ACLGroup, len(acl.Groups))
+	for _, group := range acl.Groups {
+		groups[group.Name] = group
+	}
+	return groups
+}
+
+// isLocalGroup returns true if the group is defined or modified by the
+// channel that the group's ACL belongs to.
+func isLocalGroup(group *gumble.ACLGroup) bool {
+	return !group.Inherited || !group.InheritUsers || !group.Inheritable || len(group.UsersAdd) > 0 || len(group.UsersRemove) > 0
+}
+
+func localRules(acl *gumble.ACL) []*gumble.ACLRule {
+	var rules []*gumble.ACLRule
+	for _, rule := range acl.Rules {
+		if !rule.Inherited {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func diffACLGroup(old, new *gumble.ACLGroup) *ACLGroupDiff {
+	d := &ACLGroupDiff{
+		Name:                new.Name,
+		Old:                 old,
+		New:                 new,
+		InheritUsersChanged: old.InheritUsers != new.InheritUsers,
+		InheritableChanged:  old.Inheritable != new.Inheritable,
+	}
+	d.UsersAddAdded, d.UsersAddRemoved = diffACLUsers(old.UsersAdd, new.UsersAdd)
+	d.UsersRemoveAdded, d.UsersRemoveRemoved = diffACLUsers(old.UsersRemove, new.UsersRemove)
+	if !d.InheritUsersChanged && !d.InheritableChanged && len(d.UsersAddAdded) == 0 && len(d.UsersAddRemoved) == 0 && len(d.UsersRemoveAdded) == 0 && len(d.UsersRemoveRemoved) == 0 {
+		return nil
+	}
+	return d
+}
+
+func diffACLUsers(old, new map[uint32]*gumble.ACLUser) (added, removed []*gumble.ACLUser) {
+	for id, user := range new {
+		if old[id] == nil {
+			added = append(added, user)
+		}
+	}
+	for id, user := range old {
+		if new[id] == nil {
+			removed = append(removed, user)
+		}
+	}
+	sortACLUsers(added)
+	sortACLUsers(removed)
+	return
+}
+
+func sortACLUsers(users []*gumble.ACLUser) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserID < users[j].UserID
+	})
+}
+
+func equalACLRule(a, b *gumble.ACLRule) bool {
+	if a.AppliesCurrent != b.AppliesCurrent || a.AppliesChildren != b.AppliesChildren || a.Granted != b.Granted || a.Denied != b.Denied {
+		return false
+	}
+	if (a.User == nil) != (b.User == nil) || (a.Group == nil) != (b.Group == nil) {
+		return false
+	}
+	if a.User != nil && a.User.UserID != b.User.UserID {
+		return false
+	}
+	if a.Group != nil && a.Group.Name != b.Group.Name {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,308 @@
+package gumbleutil
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"layeh.com/gumble/gumble"
+)
+
+// PermissionDefault is the set of permissions that every user has in a
+// channel, before any ACL rules are applied.
+const PermissionDefault = gumble.PermissionTraverse | gumble.PermissionEnter | gumble.PermissionSpeak | gumble.PermissionWhisper | gumble.PermissionTextMessage
+
+// PermissionAll is the set of all permissions.
+const PermissionAll = gumble.PermissionWrite | gumble.PermissionTraverse | gumble.PermissionEnter | gumble.PermissionSpeak | gumble.PermissionMuteDeafen | gumble.PermissionMove | gumble.PermissionMakeChannel | gumble.PermissionLinkChannel | gumble.PermissionWhisper | gumble.PermissionTextMessage | gumble.PermissionMakeTemporaryChannel | gumble.PermissionKick | gumble.PermissionBan | gumble.PermissionRegister | gumble.PermissionRegisterSelf
+
+// rootPermissions are the permissions that only apply to the server as a whole,
+// and are only granted in the root channel.
+const rootPermissions = gumble.PermissionKick | gumble.PermissionBan | gumble.PermissionRegister | gumble.PermissionRegisterSelf
+
+// ACLSubject describes the user for whom permissions are evaluated.
+type ACLSubject struct {
+	// Is the user registered with the server?
+	Registered bool
+	// The user's ID. Ignored if the user is not registered. The user with ID 0
+	// is the server's SuperUser.
+	UserID uint32
+	// The channel the user is currently in. Used to evaluate the "in", "out",
+	// and "sub" groups.
+	Channel *gumble.Channel
+	// The hash of the user's certificate.
+	Hash string
+	// Does the user have a strong certificate?
+	StrongCertificate bool
+	// The access tokens that the user has sent to the server.
+	Tokens gumble.AccessTokens
+	// Additional groups that the user is a member of, regardless of the group
+	// members stored in the ACLs.
+	Groups []string
+}
+
+// UserACLSubject returns an ACLSubject for the given connected user. The
+// user's tokens and certificate strength are not known to the client, and
+// must be filled in by the caller if needed.
+func UserACLSubject(user *gumble.User) *ACLSubject {
+	return &ACLSubject{
+		Registered: user.IsRegistered(),
+		UserID:     user.UserID,
+		Channel:    user.Channel,
+		Hash:       user.Hash,
+	}
+}
+
+// ACLEvaluator computes effective permissions from fetched ACLs, using the
+// same algorithm as murmur.
+//
+// The ACL of every channel on the path from the root channel to the channel
+// being evaluated must be added to the evaluator.
+type ACLEvaluator struct {
+	acls map[uint32]*gumble.ACL
+}
+
+// NewACLEvaluator returns a new ACLEvaluator containing the given ACLs.
+func NewACLEvaluator(acls ...*gumble.ACL) *ACLEvaluator {
+	e := &ACLEvaluator{
+		acls: make(map[uint32]*gumble.ACL),
+	}
+	for _, acl := range acls {
+		e.Add(acl)
+	}
+	return e
+}
+
+// Add adds acl to the evaluator, replacing any existing ACL for the same
+// channel.
+func (e *ACLEvaluator) Add(acl *gumble.ACL) {
+	e.acls[acl.Channel.ID] = acl
+}
+
+// Missing returns the channels on the path from the root channel to channel
+// whose ACLs have not been added to the evaluator.
+func (e *ACLEvaluator) Missing(channel *gumble.Channel) []*gumble.Channel {
+	var missing []*gumble.Channel
+	for ch := channel; ch != nil; ch = ch.Parent {
+		if e.acls[ch.ID] == nil {
+			missing = append(missing, ch)
+		}
+	}
+	return missing
+}
+
+// Permission returns the effective permissions that subject has in channel.
+// An error is returned if the ACL of a channel on the path to channel is
+// missing.
+func (e *ACLEvaluator) Permission(channel *gumble.Channel, subject *ACLSubject) (gumble.Permission, error) {
+	if missing := e.Missing(channel); len(missing) > 0 {
+		return 0, errors.New("gumbleutil: missing ACL for channel " + strconv.FormatUint(uint64(missing[0].ID), 10))
+	}
+
+	if subject.Registered && subject.UserID == 0 {
+		return PermissionAll &^ (gumble.PermissionSpeak | gumble.PermissionWhisper), nil
+	}
+
+	var path []*gumble.Channel
+	for ch := channel; ch != nil; ch = ch.Parent {
+		path = append(path, ch)
+	}
+
+	granted := PermissionDefault
+	traverse := true
+	write := false
+	for i := len(path) - 1; i >= 0; i-- {
+		ch := path[i]
+		acl := e.acls[ch.ID]
+		if !acl.Inherits {
+			granted = PermissionDefault
+		}
+		for _, rule := range acl.Rules {
+			if rule.Inherited {
+				continue
+			}
+			matchUser := rule.User != nil && subject.Registered && rule.User.UserID == subject.UserID
+			matchGroup := rule.Group != nil && e.isMember(channel, ch, rule.Group.Name, subject)
+			if !matchUser && !matchGroup {
+				continue
+			}
+			if rule.Granted.Has(gumble.PermissionTraverse) {
+				traverse = true
+			}
+			if rule.Denied.Has(gumble.PermissionTraverse) {
+				traverse = false
+			}
+			if rule.Granted.Has(gumble.PermissionWrite) {
+				write = true
+			}
+			if rule.Denied.Has(gumble.PermissionWrite) {
+				write = false
+			}
+			if (ch == channel && rule.AppliesCurrent) || (ch != channel && rule.AppliesChildren) {
+				granted |= rule.Granted
+				granted &^= rule.Denied
+			}
+		}
+		if !traverse && !write {
+			return 0, nil
+		}
+	}
+
+	if granted.Has(gumble.PermissionWrite) {
+		granted |= gumble.PermissionTraverse | gumble.PermissionEnter | gumble.PermissionMuteDeafen | gumble.PermissionMove | gumble.PermissionMakeChannel | gumble.PermissionLinkChannel | gumble.PermissionTextMessage | gumble.PermissionMakeTemporaryChannel
+		if channel.IsRoot() {
+			granted |= rootPermissions
+		}
+	}
+	// Like murmur, only honor server-wide permissions in the root channel,
+	// even if a rule grants them in another channel.
+	if !channel.IsRoot() {
+		granted &^= rootPermissions
+	}
+	return granted, nil
+}
+
+// UserPermission is a shortcut for e.Permission(channel, UserACLSubject(user)).
+func (e *ACLEvaluator) UserPermission(channel *gumble.Channel, user *gumble.User) (gumble.Permission, error) {
+	return e.Permission(channel, UserACLSubject(user))
+}
+
+// isMember returns if subject is a member of the group name, where current is
+// the channel whose permissions are being evaluated and aclChannel is the
+// channel containing the rule that references the group.
+func (e *ACLEvaluator) isMember(current, aclChannel *gumble.Channel, name string, subject *ACLSubject) bool {
+	context := current
+	invert, token, hash := false, false, false
+prefix:
+	for name != "" {
+		switch name[0] {
+		case '!':
+			invert = true
+		case '~':
+			context = aclChannel
+		case '#':
+			token = true
+		case '$':
+			hash = true
+		default:
+			break prefix
+		}
+		name = name[1:]
+	}
+	if name == "" {
+		return false
+	}
+
+	for _, group := range subject.Groups {
+		if group == name {
+			return !invert
+		}
+	}
+
+	var member bool
+	switch {
+	case token:
+		for _, t := range subject.Tokens {
+			if strings.EqualFold(t, name) {
+				member = true
+				break
+			}
+		}
+	case hash:
+		member = subject.Hash == name
+	case name == "none":
+		member = false
+	case name == gumble.ACLGroupEveryone:
+		member = true
+	case name == gumble.ACLGroupAuthenticated:
+		member = subject.Registered
+	case name == "strong":
+		member = subject.StrongCertificate
+	case name == gumble.ACLGroupInsideChannel:
+		member = subject.Channel == context
+	case name == gumble.ACLGroupOutsideChannel:
+		member = subject.Channel != context
+	case name == "sub" || strings.HasPrefix(name, "sub,"):
+		member = isSubMember(context, strings.TrimPrefix(strings.TrimPrefix(name, "sub"), ","), subject.Channel)
+	default:
+		member = e.isGroupMember(context, name, subject)
+	}
+	if invert {
+		return !member
+	}
+	return member
+}
+
+// isSubMember evaluates the "sub,<minpath>,<mindesc>,<maxdesc>" group.
+func isSubMember(context *gumble.Channel, args string, channel *gumble.Channel) bool {
+	minPath, minDesc, maxDesc := 0, 1, 1000
+	if args != "" {
+		values := []*int{&minPath, &minDesc, &maxDesc}
+		for i, arg := range strings.Split(args, ",") {
+			if i >= len(values) {
+				break
+			}
+			if n, err := strconv.Atoi(arg); err == nil {
+				*values[i] = n
+			}
+		}
+	}
+
+	chain := func(ch *gumble.Channel) []*gumble.Channel {
+		var c []*gumble.Channel
+		for ; ch != nil; ch = ch.Parent {
+			c = append([]*gumble.Channel{ch}, c...)
+		}
+		return c
+	}
+	userChain := chain(channel)
+	groupChain := chain(context)
+
+	offset := len(groupChain) - 1 + minPath
+	if offset >= len(groupChain) {
+		return false
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	needed := groupChain[offset]
+	found := false
+	for _, ch := range userChain {
+		if ch == needed {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	depth := len(userChain) - 1
+	return depth >= offset+minDesc && depth <= offset+maxDesc
+}
+
+// isGroupMember returns if subject is a member of the named group, as seen
+// from context. If the group is not listed in the ACL of context, it is
+// looked up in the ACLs of the parent channels.
+func (e *ACLEvaluator) isGroupMember(context *gumble.Channel, name string, subject *ACLSubject) bool {
+	if !subject.Registered {
+		return false
+	}
+	for ch := context; ch != nil; ch = ch.Parent {
+		acl := e.acls[ch.ID]
+		if acl == nil {
+			return false
+		}
+		for _, group := range acl.Groups {
+			if group.Name != name {
+				continue
+			}
+			if ch != context && !group.Inheritable {
+				return false
+			}
+			if group.UsersRemove[subject.UserID] != nil {
+				return false
+			}
+			return group.UsersAdd[subject.UserID] != nil || group.UsersInherited[subject.UserID] != nil
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package gumbleutil
+
+import (
+	"testing"
+
+	"layeh.com/gumble/gumble"
+)
+
+func testChannels() (root, a, b *gumble.Channel) {
+	root = &gumble.Channel{ID: 0, Name: "Root"}
+	a = &gumble.Channel{ID: 1, Name: "A", Parent: root}
+	b = &gumble.Channel{ID: 2, Name: "B", Parent: a}
+	return
+}
+
+func TestACLEvaluator(t *testing.T) {
+	root, a, b := testChannels()
+
+	admins := &gumble.ACLGroup{
+		Name:         "admins",
+		InheritUsers: true,
+		Inheritable:  true,
+		UsersAdd: map[uint32]*gumble.ACLUser{
+			7: {UserID: 7},
+		},
+	}
+	rootACL := &gumble.ACL{
+		Channel:  root,
+		Inherits: true,
+		Groups:   []*gumble.ACLGroup{admins},
+		Rules: []*gumble.ACLRule{
+			{AppliesCurrent: true, AppliesChildren: true, Denied: gumble.PermissionEnter, Group: &gumble.ACLGroup{Name: gumble.ACLGroupEveryone}},
+			{AppliesChildren: true, Granted: gumble.PermissionWrite, Group: admins},
+		},
+	}
+	aACL := &gumble.ACL{
+		Channel:  a,
+		Inherits: true,
+		Rules: []*gumble.ACLRule{
+			{AppliesCurrent: true, Granted: gumble.PermissionEnter, User: &gumble.ACLUser{UserID: 5}},
+			{AppliesCurrent: true, AppliesChildren: true, Granted: gumble.PermissionMakeChannel, Group: &gumble.ACLGroup{Name: gumble.ACLGroupInsideChannel}},
+			{AppliesCurrent: true, Granted: gumble.PermissionKick | gumble.PermissionBan | gumble.PermissionRegister | gumble.PermissionRegisterSelf, User: &gumble.ACLUser{UserID: 5}},
+		},
+	}
+	bACL := &gumble.ACL{
+		Channel:  b,
+		Inherits: false,
+	}
+
+	e := NewACLEvaluator(rootACL, aACL)
+	if _, err := e.Permission(b, &ACLSubject{}); err == nil {
+		t.Fatal("expected error for missing ACL")
+	}
+	e.Add(bACL)
+
+	anonymous := &ACLSubject{Channel: root}
+	user5 := &ACLSubject{Registered: true, UserID: 5, Channel: root}
+	user7 := &ACLSubject{Registered: true, UserID: 7, Channel: a}
+
+	tests := []struct {
+		channel *gumble.Channel
+		subject *ACLSubject
+		has     gumble.Permission
+		hasNot  gumble.Permission
+	}{
+		{root, anonymous, gumble.PermissionSpeak, gumble.PermissionEnter},
+		{a, anonymous, gumble.PermissionSpeak, gumble.PermissionEnter | gumble.PermissionMakeChannel},
+		{a, user5, gumble.PermissionEnter, gumble.PermissionWrite | gumble.PermissionKick | gumble.PermissionBan | gumble.PermissionRegister | gumble.PermissionRegisterSelf},
+		{root, user7, 0, gumble.PermissionWrite},
+		{a, user7, gumble.PermissionWrite | gumble.PermissionEnter | gumble.PermissionMakeChannel, gumble.PermissionKick},
+		{b, user7, PermissionDefault, gumble.PermissionWrite},
+		{b, &ACLSubject{Registered: true, UserID: 0}, gumble.PermissionWrite | gumble.PermissionBan, gumble.PermissionSpeak},
+	}
+	for i, test := range tests {
+		p, err := e.Permission(test.channel, test.subject)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if !p.Has(test.has) {
+			t.Errorf("%d: permission %#x does not have %#x", i, p, test.has)
+		}
+		if p&test.hasNot != 0 {
+			t.Errorf("%d: permission %#x has %#x", i, p, test.hasNot)
+		}
+	}
+
+	rootACL.Rules = append(rootACL.Rules, &gumble.ACLRule{
+		AppliesCurrent: true,
+		Denied:         gumble.PermissionTraverse,
+		Group:          &gumble.ACLGroup{Name: "!admins"},
+	})
+	if p, _ := e.Permission(a, user5); p != 0 {
+		t.Errorf("permission %#x, expected none", p)
+	}
+	if p, _ := e.Permission(a, user7); !p.Has(gumble.PermissionWrite) {
+		t.Errorf("permission %#x, expected write", p)
+	}
+}
+
+func TestDiffACL(t *testing.T) {
+	root, _, _ := testChannels()
+	acl := &gumble.ACL{
+		Channel:  root,
+		Inherits: true,
+		Groups: []*gumble.ACLGroup{
+			{Name: "inherited", Inherited: true, InheritUsers: true, Inheritable: true},
+		},
+		Rules: []*gumble.ACLRule{
+			{Inherited: true, AppliesChildren: true, Granted: gumble.PermissionSpeak, Group: &gumble.ACLGroup{Name: gumble.ACLGroupEveryone}},
+		},
+	}
+
+	builder := NewACLBuilder(acl)
+	if d := DiffACL(acl, builder.ACL()); !d.Empty() {
+		t.Fatalf("copy differs: %+v", d)
+	}
+
+	user := &gumble.ACLUser{UserID: 3}
+	builder.AddGroupUser("inherited", user)
+	builder.AddGroupUser("local", user)
+	builder.AddUserRule(user, gumble.PermissionMove, 0, true, false)
+	d := DiffACL(acl, builder.ACL())
+	if len(d.GroupsAdded) != 1 || d.GroupsAdded[0].Name != "local" {
+		t.Errorf("unexpected added groups: %+v", d.GroupsAdded)
+	}
+	if len(d.GroupsChanged) != 1 || len(d.GroupsChanged[0].UsersAddAdded) != 1 {
+		t.Errorf("unexpected changed groups: %+v", d.GroupsChanged)
+	}
+	if len(d.RulesAdded) != 1 || len(d.RulesRemoved) != 0 {
+		t.Errorf("unexpected rules: %+v %+v", d.RulesAdded, d.RulesRemoved)
+	}
+	if len(acl.Groups[0].UsersAdd) != 0 {
+		t.Error("builder modified the original ACL")
+	}
+
+	builder.RemoveGroup("inherited")
+	builder.RemoveGroup("local")
+	builder.RemoveRules(func(*gumble.ACLRule) bool { return true })
+	if d := DiffACL(acl, builder.ACL()); !d.Empty() {
+		t.Errorf("reverted ACL differs: %+v", d)
+	}
+}
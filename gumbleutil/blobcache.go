@@ -0,0 +1,86 @@
+package gumbleutil
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"layeh.com/gumble/gumble"
+)
+
+// MemoryBlobCache is a gumble.BlobCache that keeps blobs in memory. The zero
+// value is ready to use.
+type MemoryBlobCache struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+var _ gumble.BlobCache = (*MemoryBlobCache)(nil)
+
+// Blob implements gumble.BlobCache.Blob.
+func (m *MemoryBlobCache) Blob(hash []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blobs[string(hash)]
+}
+
+// SetBlob implements gumble.BlobCache.SetBlob.
+func (m *MemoryBlobCache) SetBlob(hash, blob []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.blobs == nil {
+		m.blobs = make(map[string][]byte)
+	}
+	m.blobs[string(hash)] = blob
+}
+
+// DirBlobCache is a gumble.BlobCache that stores each blob as a file in the
+// given directory. The directory is created when the first blob is stored.
+//
+// Blobs whose contents do not match their hash (e.g. because the file was
+// modified) are ignored.
+type DirBlobCache string
+
+var _ gumble.BlobCache = DirBlobCache("")
+
+func (d DirBlobCache) path(hash []byte) string {
+	return filepath.Join(string(d), hex.EncodeToString(hash))
+}
+
+// Blob implements gumble.BlobCache.Blob.
+func (d DirBlobCache) Blob(hash []byte) []byte {
+	blob, err := ioutil.ReadFile(d.path(hash))
+	if err != nil {
+		return nil
+	}
+	if sum := sha1.Sum(blob); !bytes.Equal(sum[:], hash) {
+		return nil
+	}
+	return blob
+}
+
+// SetBlob implements gumble.BlobCache.SetBlob.
+func (d DirBlobCache) SetBlob(hash, blob []byte) {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(string(d), ".blob")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(blob)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err := os.Rename(f.Name(), d.path(hash)); err != nil {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,56 @@
+package gumbleutil
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"layeh.com/gumble/gumble"
+)
+
+func testBlobCache(t *testing.T, cache gumble.BlobCache) {
+	blob := []byte("blob")
+	hash := sha1.Sum(blob)
+	if b := cache.Blob(hash[:]); b != nil {
+		t.Fatalf("Blob() = %q before SetBlob", b)
+	}
+	cache.SetBlob(hash[:], blob)
+	if b := cache.Blob(hash[:]); string(b) != "blob" {
+		t.Fatalf("Blob() = %q", b)
+	}
+}
+
+func TestMemoryBlobCache(t *testing.T) {
+	testBlobCache(t, &MemoryBlobCache{})
+}
+
+func TestDirBlobCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	cache := DirBlobCache(dir)
+	testBlobCache(t, cache)
+
+	// Files whose contents do not match their hash are ignored.
+	blob := []byte("other")
+	hash := sha1.Sum(blob)
+	cache.SetBlob(hash[:], blob)
+	if err := ioutil.WriteFile(cache.path(hash[:]), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b := cache.Blob(hash[:]); b != nil {
+		t.Fatalf("Blob() = %q for modified file", b)
+	}
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected files in cache directory: %d", len(files))
+	}
+	if _, err := os.Stat(cache.path([]byte{1})); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+}
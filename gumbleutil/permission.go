@@ -0,0 +1,59 @@
+package gumbleutil
+
+import (
+	"errors"
+	"strings"
+
+	"layeh.com/gumble/gumble"
+)
+
+var permissionNames = []struct {
+	Permission gumble.Permission
+	Name       string
+}{
+	{gumble.PermissionWrite, "write"},
+	{gumble.PermissionTraverse, "traverse"},
+	{gumble.PermissionEnter, "enter"},
+	{gumble.PermissionSpeak, "speak"},
+	{gumble.PermissionMuteDeafen, "mutedeafen"},
+	{gumble.PermissionMove, "move"},
+	{gumble.PermissionMakeChannel, "makechannel"},
+	{gumble.PermissionLinkChannel, "linkchannel"},
+	{gumble.PermissionWhisper, "whisper"},
+	{gumble.PermissionTextMessage, "textmessage"},
+	{gumble.PermissionMakeTemporaryChannel, "maketemporarychannel"},
+	{gumble.PermissionKick, "kick"},
+	{gumble.PermissionBan, "ban"},
+	{gumble.PermissionRegister, "register"},
+	{gumble.PermissionRegisterSelf, "registerself"},
+}
+
+// PermissionNames returns the names of the permissions contained in p (e.g.
+// "speak", "textmessage").
+func PermissionNames(p gumble.Permission) []string {
+	var names []string
+	for _, n := range permissionNames {
+		if p.Has(n.Permission) {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+// ParsePermission returns the permission containing each of the named
+// permissions. Names are case-insensitive, and are the same as those returned
+// by PermissionNames.
+func ParsePermission(names ...string) (gumble.Permission, error) {
+	var p gumble.Permission
+outer:
+	for _, name := range names {
+		for _, n := range permissionNames {
+			if strings.EqualFold(n.Name, name) {
+				p |= n.Permission
+				continue outer
+			}
+		}
+		return 0, errors.New("gumbleutil: unknown permission " + name)
+	}
+	return p, nil
+}
@@ -0,0 +1,635 @@
+package gumbleutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"layeh.com/gumble/gumble"
+)
+
+// ChannelSpec is the desired state of a channel and its sub-channels. It is
+// used by Provision to modify a server's channel tree.
+//
+// Fields that are nil are left unchanged on the server.
+type ChannelSpec struct {
+	// The channel's name. Ignored for the root channel.
+	Name string `json:"name" yaml:"name"`
+	// The channel's description.
+	Description *string `json:"description,omitempty" yaml:"description,omitempty"`
+	// The channel's position.
+	Position *int32 `json:"position,omitempty" yaml:"position,omitempty"`
+	// The maximum number of users allowed in the channel.
+	MaxUsers *uint32 `json:"max_users,omitempty" yaml:"max_users,omitempty"`
+	// The channels that are linked to the channel. Each link is a channel path
+	// from the root channel, with channel names separated by "/" (e.g.
+	// "Games/Chess"). Links are symmetric, so they only need to be listed on
+	// one of the two channels.
+	Links []string `json:"links,omitempty" yaml:"links,omitempty"`
+	// The channel's ACL.
+	ACL *ACLSpec `json:"acl,omitempty" yaml:"acl,omitempty"`
+	// The channel's sub-channels.
+	Children []*ChannelSpec `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// ACLSpec is the desired ACL of a channel. The spec replaces all of the
+// channel's non-inherited groups and rules.
+type ACLSpec struct {
+	// Does the ACL inherit the parent channel's ACL? Defaults to true.
+	Inherits *bool `json:"inherits,omitempty" yaml:"inherits,omitempty"`
+	// The channel's groups.
+	Groups []*ACLGroupSpec `json:"groups,omitempty" yaml:"groups,omitempty"`
+	// The channel's rules.
+	Rules []*ACLRuleSpec `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// ACLGroupSpec is the desired state of an ACL group.
+type ACLGroupSpec struct {
+	// The group name.
+	Name string `json:"name" yaml:"name"`
+	// Are members inherited from the parent channel's group? Defaults to true.
+	Inherit *bool `json:"inherit,omitempty" yaml:"inherit,omitempty"`
+	// Can the group be inherited by child channels? Defaults to true.
+	Inheritable *bool `json:"inheritable,omitempty" yaml:"inheritable,omitempty"`
+	// The IDs of the registered users explicitly added to and removed from the
+	// group.
+	Add    []uint32 `json:"add,omitempty" yaml:"add,omitempty"`
+	Remove []uint32 `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// ACLRuleSpec is the desired state of an ACL rule. Exactly one of User and
+// Group must be set.
+type ACLRuleSpec struct {
+	// The registered user ID the rule applies to.
+	User *uint32 `json:"user,omitempty" yaml:"user,omitempty"`
+	// The group the rule applies to.
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Does the rule apply to the channel? Defaults to true.
+	Here *bool `json:"here,omitempty" yaml:"here,omitempty"`
+	// Does the rule apply to sub-channels? Defaults to true.
+	Subs *bool `json:"subs,omitempty" yaml:"subs,omitempty"`
+	// The names of the granted and denied permissions (see ParsePermission).
+	Grant []string `json:"grant,omitempty" yaml:"grant,omitempty"`
+	Deny  []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+}
+
+// ReadChannelSpec reads a ChannelSpec for the root channel from r. The spec
+// can be either YAML or JSON.
+func ReadChannelSpec(r io.Reader) (*ChannelSpec, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var spec ChannelSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// ProvisionAction is the type of change made by a ProvisionStep.
+type ProvisionAction int
+
+// Provision actions.
+const (
+	ProvisionCreate ProvisionAction = iota + 1
+	ProvisionRemove
+	ProvisionDescription
+	ProvisionPosition
+	ProvisionMaxUsers
+	ProvisionLink
+	ProvisionUnlink
+	ProvisionACL
+)
+
+// ProvisionStep is a single change that is made to the server.
+type ProvisionStep struct {
+	Action ProvisionAction
+	// The path of the channel from the root channel. The channel may not exist
+	// yet if it is created by an earlier step.
+	Path []string
+
+	// The new value for ProvisionDescription, ProvisionPosition, and
+	// ProvisionMaxUsers steps.
+	Description string
+	Position    int32
+	MaxUsers    uint32
+	// The path of the other channel for ProvisionLink and ProvisionUnlink
+	// steps.
+	Other []string
+	// The new ACL for ProvisionACL steps, and its difference from the current
+	// ACL (nil if the channel does not exist yet).
+	ACL  *gumble.ACL
+	Diff *ACLDiff
+}
+
+func formatPath(path []string) string {
+	return strconv.Quote("/" + strings.Join(path, "/"))
+}
+
+// String returns a human-readable description of the step.
+func (s *ProvisionStep) String() string {
+	path := formatPath(s.Path)
+	switch s.Action {
+	case ProvisionCreate:
+		return "create channel " + path
+	case ProvisionRemove:
+		return "remove channel " + path
+	case ProvisionDescription:
+		return "set description of " + path
+	case ProvisionPosition:
+		return "set position of " + path + " to " + strconv.FormatInt(int64(s.Position), 10)
+	case ProvisionMaxUsers:
+		return "set maximum users of " + path + " to " + strconv.FormatUint(uint64(s.MaxUsers), 10)
+	case ProvisionLink:
+		return "link " + path + " and " + formatPath(s.Other)
+	case ProvisionUnlink:
+		return "unlink " + path + " and " + formatPath(s.Other)
+	case ProvisionACL:
+		if s.Diff == nil {
+			return "set ACL of " + path
+		}
+		return fmt.Sprintf("set ACL of %s (%d groups added, %d removed, %d changed; %d rules added, %d removed)", path, len(s.Diff.GroupsAdded), len(s.Diff.GroupsRemoved), len(s.Diff.GroupsChanged), len(s.Diff.RulesAdded), len(s.Diff.RulesRemoved))
+	}
+	return "unknown step"
+}
+
+// ProvisionPlan is the list of steps needed to make a server's channel tree
+// match a ChannelSpec.
+type ProvisionPlan struct {
+	Steps []*ProvisionStep
+}
+
+// ProvisionOptions changes how Provision modifies the server.
+type ProvisionOptions struct {
+	// Remove channels that are not in the spec. Temporary channels are never
+	// removed.
+	Prune bool
+	// Only compute the plan, without modifying the server.
+	DryRun bool
+}
+
+// Provision computes the steps needed to make the server's channel tree match
+// spec, which describes the root channel, and applies them (unless
+// options.DryRun is set). Applying the same spec again results in an empty
+// plan.
+//
+// Channel descriptions and ACLs are fetched from the server while the plan is
+// computed. This function must not be called from inside of an event listener.
+func Provision(ctx context.Context, client *gumble.Client, spec *ChannelSpec, options ProvisionOptions) (*ProvisionPlan, error) {
+	p := newProvisioner(ctx, client, options)
+	plan, err := p.run(spec)
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		return plan, nil
+	}
+	return plan, plan.Apply(ctx, client)
+}
+
+type provisioner struct {
+	ctx     context.Context
+	client  *gumble.Client
+	options ProvisionOptions
+	plan    *ProvisionPlan
+
+	// desired links, keyed by channel path
+	links map[string]map[string]bool
+	// channels whose links are managed by the spec
+	managed map[string]bool
+
+	linkSteps, aclSteps, removeSteps []*ProvisionStep
+
+	// If non-nil, called when the server denies fetching the ACL of a channel,
+	// instead of failing. The channel's ACL is left unchanged.
+	aclDenied func(path []string, err error)
+}
+
+func newProvisioner(ctx context.Context, client *gumble.Client, options ProvisionOptions) *provisioner {
+	return &provisioner{
+		ctx:     ctx,
+		client:  client,
+		options: options,
+		plan:    &ProvisionPlan{},
+		links:   make(map[string]map[string]bool),
+		managed: make(map[string]bool),
+	}
+}
+
+// run computes the plan for spec.
+func (p *provisioner) run(spec *ChannelSpec) (*ProvisionPlan, error) {
+	if err := p.collectLinks(nil, spec); err != nil {
+		return nil, err
+	}
+
+	var root *gumble.Channel
+	p.client.Do(func() {
+		root = p.client.Channels[0]
+	})
+	if root == nil {
+		return nil, errors.New("gumbleutil: root channel not found")
+	}
+	if err := p.planChannel(nil, spec, root); err != nil {
+		return nil, err
+	}
+	p.plan.Steps = append(p.plan.Steps, p.linkSteps...)
+	p.plan.Steps = append(p.plan.Steps, p.aclSteps...)
+	p.plan.Steps = append(p.plan.Steps, p.removeSteps...)
+	return p.plan, nil
+}
+
+func appendPath(path []string, name string) []string {
+	p := make([]string, len(path)+1)
+	copy(p, path)
+	p[len(path)] = name
+	return p
+}
+
+func splitPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// collectLinks builds the symmetric set of desired links.
+func (p *provisioner) collectLinks(path []string, spec *ChannelSpec) error {
+	key := strings.Join(path, "/")
+	if spec.Links != nil {
+		p.managed[key] = true
+		for _, link := range spec.Links {
+			other := strings.Join(splitPath(link), "/")
+			if other == key {
+				return errors.New("gumbleutil: channel " + formatPath(path) + " cannot be linked to itself")
+			}
+			p.addLink(key, other)
+			p.addLink(other, key)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, child := range spec.Children {
+		if child.Name == "" {
+			return errors.New("gumbleutil: channel in " + formatPath(path) + " has no name")
+		}
+		if seen[child.Name] {
+			return errors.New("gumbleutil: duplicate channel " + formatPath(appendPath(path, child.Name)))
+		}
+		seen[child.Name] = true
+		if err := p.collectLinks(appendPath(path, child.Name), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provisioner) addLink(a, b string) {
+	if p.links[a] == nil {
+		p.links[a] = make(map[string]bool)
+	}
+	p.links[a][b] = true
+}
+
+// channelState is the part of a channel's state that is compared to the spec.
+type channelState struct {
+	channel  *gumble.Channel
+	position int32
+	maxUsers uint32
+	links    []string
+	children map[string]*gumble.Channel
+	// names of temporary children
+	temporary map[string]bool
+}
+
+func (p *provisioner) state(channel *gumble.Channel) *channelState {
+	var s channelState
+	p.client.Do(func() {
+		s.channel = channel
+		s.position = channel.Position
+		s.maxUsers = channel.MaxUsers
+		for _, link := range channel.Links {
+			s.links = append(s.links, strings.Join(ChannelPath(link)[1:], "/"))
+		}
+		s.children = make(map[string]*gumble.Channel, len(channel.Children))
+		s.temporary = make(map[string]bool)
+		for _, child := range channel.Children {
+			s.children[child.Name] = child
+			if child.Temporary {
+				s.temporary[child.Name] = true
+			}
+		}
+	})
+	sort.Strings(s.links)
+	return &s
+}
+
+// planChannel adds the steps needed to make channel (which can be nil if it
+// does not exist) match spec.
+func (p *provisioner) planChannel(path []string, spec *ChannelSpec, channel *gumble.Channel) error {
+	key := strings.Join(path, "/")
+	var s *channelState
+	if channel == nil {
+		p.plan.Steps = append(p.plan.Steps, &ProvisionStep{
+			Action: ProvisionCreate,
+			Path:   path,
+		})
+	} else {
+		s = p.state(channel)
+	}
+
+	if spec.Description != nil {
+		var description string
+		if channel != nil {
+			var err error
+			if description, err = channel.DescriptionContext(p.ctx); err != nil {
+				return err
+			}
+		}
+		if channel == nil && *spec.Description != "" || channel != nil && description != *spec.Description {
+			p.plan.Steps = append(p.plan.Steps, &ProvisionStep{
+				Action:      ProvisionDescription,
+				Path:        path,
+				Description: *spec.Description,
+			})
+		}
+	}
+	if spec.Position != nil && (s == nil && *spec.Position != 0 || s != nil && s.position != *spec.Position) {
+		p.plan.Steps = append(p.plan.Steps, &ProvisionStep{
+			Action:   ProvisionPosition,
+			Path:     path,
+			Position: *spec.Position,
+		})
+	}
+	if spec.MaxUsers != nil && (s == nil && *spec.MaxUsers != 0 || s != nil && s.maxUsers != *spec.MaxUsers) {
+		p.plan.Steps = append(p.plan.Steps, &ProvisionStep{
+			Action:   ProvisionMaxUsers,
+			Path:     path,
+			MaxUsers: *spec.MaxUsers,
+		})
+	}
+
+	// Links
+	current := make(map[string]bool)
+	if s != nil {
+		for _, link := range s.links {
+			current[link] = true
+		}
+	}
+	var desired []string
+	for link := range p.links[key] {
+		desired = append(desired, link)
+	}
+	sort.Strings(desired)
+	for _, link := range desired {
+		// Only add each symmetric link once.
+		if !current[link] && key < link {
+			p.linkSteps = append(p.linkSteps, &ProvisionStep{
+				Action: ProvisionLink,
+				Path:   path,
+				Other:  splitPath(link),
+			})
+		}
+	}
+	if p.managed[key] && s != nil {
+		for _, link := range s.links {
+			if !p.links[key][link] && (key < link || !p.managed[link]) {
+				p.linkSteps = append(p.linkSteps, &ProvisionStep{
+					Action: ProvisionUnlink,
+					Path:   path,
+					Other:  splitPath(link),
+				})
+			}
+		}
+	}
+
+	// ACL
+	if spec.ACL != nil {
+		step, err := p.planACL(path, spec.ACL, channel)
+		if err != nil {
+			return err
+		}
+		if step != nil {
+			p.aclSteps = append(p.aclSteps, step)
+		}
+	}
+
+	// Children
+	names := make(map[string]bool, len(spec.Children))
+	for _, childSpec := range spec.Children {
+		names[childSpec.Name] = true
+		var child *gumble.Channel
+		if s != nil {
+			child = s.children[childSpec.Name]
+		}
+		if err := p.planChannel(appendPath(path, childSpec.Name), childSpec, child); err != nil {
+			return err
+		}
+	}
+	if p.options.Prune && s != nil {
+		var extra []string
+		for name := range s.children {
+			if !names[name] && !s.temporary[name] {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			p.removeSteps = append(p.removeSteps, &ProvisionStep{
+				Action: ProvisionRemove,
+				Path:   appendPath(path, name),
+			})
+		}
+	}
+	return nil
+}
+
+// planACL returns a step that sets the ACL of channel to spec, or nil if the
+// ACL already matches.
+func (p *provisioner) planACL(path []string, spec *ACLSpec, channel *gumble.Channel) (*ProvisionStep, error) {
+	current := &gumble.ACL{
+		Channel:  channel,
+		Inherits: true,
+	}
+	if channel != nil {
+		var err error
+		if current, err = FetchACL(p.ctx, p.client, channel); err != nil {
+			if p.aclDenied != nil && permissionDenied(err) != nil {
+				p.aclDenied(path, err)
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	b := NewACLBuilder(current)
+	b.SetInherits(spec.Inherits == nil || *spec.Inherits)
+	for _, group := range current.Groups {
+		b.RemoveGroup(group.Name)
+	}
+	b.RemoveRules(func(*gumble.ACLRule) bool {
+		return true
+	})
+	for _, groupSpec := range spec.Groups {
+		group := b.Group(groupSpec.Name)
+		group.InheritUsers = groupSpec.Inherit == nil || *groupSpec.Inherit
+		group.Inheritable = groupSpec.Inheritable == nil || *groupSpec.Inheritable
+		for _, id := range groupSpec.Add {
+			b.AddGroupUser(groupSpec.Name, &gumble.ACLUser{UserID: id})
+		}
+		for _, id := range groupSpec.Remove {
+			if group.UsersRemove == nil {
+				group.UsersRemove = make(map[uint32]*gumble.ACLUser)
+			}
+			group.UsersRemove[id] = &gumble.ACLUser{UserID: id}
+		}
+	}
+	for _, ruleSpec := range spec.Rules {
+		granted, err := ParsePermission(ruleSpec.Grant...)
+		if err != nil {
+			return nil, err
+		}
+		denied, err := ParsePermission(ruleSpec.Deny...)
+		if err != nil {
+			return nil, err
+		}
+		here := ruleSpec.Here == nil || *ruleSpec.Here
+		subs := ruleSpec.Subs == nil || *ruleSpec.Subs
+		switch {
+		case ruleSpec.User != nil && ruleSpec.Group == "":
+			b.AddUserRule(&gumble.ACLUser{UserID: *ruleSpec.User}, granted, denied, here, subs)
+		case ruleSpec.User == nil && ruleSpec.Group != "":
+			b.AddGroupRule(ruleSpec.Group, granted, denied, here, subs)
+		default:
+			return nil, errors.New("gumbleutil: ACL rule in " + formatPath(path) + " must have either a user or a group")
+		}
+	}
+
+	step := &ProvisionStep{
+		Action: ProvisionACL,
+		Path:   path,
+		ACL:    b.ACL(),
+	}
+	if channel != nil {
+		step.Diff = DiffACL(current, step.ACL)
+		if step.Diff.Empty() {
+			return nil, nil
+		}
+	} else if len(spec.Groups) == 0 && len(spec.Rules) == 0 && step.ACL.Inherits {
+		return nil, nil
+	}
+	return step, nil
+}
+
+// Apply applies the steps of the plan, in order. Each step waits until the
+// server has processed the change (see gumble.Client.Track) before the next
+// step is applied. Apply stops at the first step that fails.
+//
+// This function must not be called from inside of an event listener.
+func (p *ProvisionPlan) Apply(ctx context.Context, client *gumble.Client) error {
+	for _, step := range p.Steps {
+		if err := applyStep(ctx, client, step); err != nil {
+			return fmt.Errorf("gumbleutil: %s: %v", step, err)
+		}
+	}
+	return nil
+}
+
+func applyStep(ctx context.Context, client *gumble.Client, step *ProvisionStep) error {
+	find := func(path []string) (channel *gumble.Channel) {
+		client.Do(func() {
+			channel = client.Channels.Find(path...)
+		})
+		return
+	}
+	self := findSelf(client)
+
+	if step.Action == ProvisionCreate {
+		if len(step.Path) == 0 {
+			return errors.New("cannot create the root channel")
+		}
+		parentPath, name := step.Path[:len(step.Path)-1], step.Path[len(step.Path)-1]
+		parent := find(parentPath)
+		if parent == nil {
+			return errors.New("parent channel not found")
+		}
+		scope := gumble.RequestScope{
+			Types: []gumble.PermissionDeniedType{
+				gumble.PermissionDeniedPermission,
+				gumble.PermissionDeniedInvalidChannelName,
+				gumble.PermissionDeniedNestingLimit,
+				gumble.PermissionDeniedChannelCountLimit,
+			},
+			Permission: gumble.PermissionMakeChannel,
+			Channel:    parent,
+			User:       self,
+		}
+		if err := client.Track(scope, func() { parent.Add(name, false) }).Wait(ctx); err != nil {
+			return err
+		}
+		// The server sends the new channel before it answers the request.
+		if find(step.Path) == nil {
+			return errors.New("channel was not created")
+		}
+		return nil
+	}
+
+	channel := find(step.Path)
+	if channel == nil {
+		return errors.New("channel not found")
+	}
+
+	var send func()
+	scope := gumble.RequestScope{
+		Types:      []gumble.PermissionDeniedType{gumble.PermissionDeniedPermission},
+		Permission: gumble.PermissionWrite,
+		Channel:    channel,
+		User:       self,
+	}
+	switch step.Action {
+	case ProvisionRemove:
+		send = channel.Remove
+	case ProvisionDescription:
+		send = func() { channel.SetDescription(step.Description) }
+		scope.Types = append(scope.Types, gumble.PermissionDeniedTextTooLong)
+	case ProvisionPosition:
+		send = func() { channel.SetPosition(step.Position) }
+	case ProvisionMaxUsers:
+		send = func() { channel.SetMaxUsers(step.MaxUsers) }
+	case ProvisionACL:
+		acl := *step.ACL
+		acl.Channel = channel
+		send = func() { client.Send(&acl) }
+	case ProvisionLink, ProvisionUnlink:
+		other := find(step.Other)
+		if other == nil {
+			return errors.New("linked channel not found")
+		}
+		if step.Action == ProvisionLink {
+			send = func() { channel.Link(other) }
+		} else {
+			send = func() { channel.Unlink(other) }
+		}
+		// The permission is checked in both channels.
+		scope.Permission = gumble.PermissionLinkChannel
+		scope.Channel = nil
+	default:
+		return errors.New("unknown action")
+	}
+	return client.Track(scope, send).Wait(ctx)
+}
+
+func findSelf(client *gumble.Client) (self *gumble.User) {
+	client.Do(func() {
+		self = client.Self
+	})
+	return
+}
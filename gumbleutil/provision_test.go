@@ -0,0 +1,174 @@
+package gumbleutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/MumbleProto"
+	"layeh.com/gumble/gumbletest"
+)
+
+// dialServer starts a gumbletest server with the given initial state, and
+// connects a client to it.
+func dialServer(t *testing.T, initial ...proto.Message) (*gumbletest.Server, *gumble.Client) {
+	server, err := gumbletest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	for _, message := range initial {
+		server.Send(message)
+	}
+	client, err := server.Dial(gumble.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	return server, client
+}
+
+func expectMessage(t *testing.T, server *gumbletest.Server, message proto.Message) {
+	t.Helper()
+	if err := server.ExpectMessage(5*time.Second, message); err != nil {
+		t.Fatalf("waiting for %T: %v", message, err)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	server, client := dialServer(t,
+		gumbletest.ChannelState(1, 0, "Lobby"),
+		gumbletest.ChannelState(2, 0, "Old"),
+	)
+	position := int32(5)
+	spec := &ChannelSpec{
+		Children: []*ChannelSpec{
+			{Name: "Lobby", Position: &position},
+			{Name: "New"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	plan, err := Provision(ctx, client, spec, ProvisionOptions{Prune: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, step := range plan.Steps {
+		steps = append(steps, step.String())
+	}
+	expected := []string{
+		`set position of "/Lobby" to 5`,
+		`create channel "/New"`,
+		`remove channel "/Old"`,
+	}
+	if strings.Join(steps, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected plan:\n%s", strings.Join(steps, "\n"))
+	}
+
+	server.Handle(func(p *gumbletest.Packet) []proto.Message {
+		switch m := p.Message.(type) {
+		case *MumbleProto.ChannelState:
+			if m.ChannelId == nil {
+				return []proto.Message{gumbletest.ChannelState(3, m.GetParent(), m.GetName())}
+			}
+			return []proto.Message{m}
+		case *MumbleProto.ChannelRemove:
+			return []proto.Message{m}
+		}
+		return nil
+	})
+	if err := plan.Apply(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	var state MumbleProto.ChannelState
+	expectMessage(t, server, &state)
+	if state.GetChannelId() != 1 || state.GetPosition() != 5 {
+		t.Fatalf("unexpected position change: %v", &state)
+	}
+	expectMessage(t, server, &state)
+	if state.ChannelId != nil || state.GetParent() != 0 || state.GetName() != "New" {
+		t.Fatalf("unexpected channel creation: %v", &state)
+	}
+	var remove MumbleProto.ChannelRemove
+	expectMessage(t, server, &remove)
+	if remove.GetChannelId() != 2 {
+		t.Fatalf("unexpected channel removal: %v", &remove)
+	}
+
+	plan, err = Provision(ctx, client, spec, ProvisionOptions{Prune: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 0 {
+		t.Errorf("expected empty plan, got %d steps", len(plan.Steps))
+	}
+}
+
+func TestProvisionDenied(t *testing.T) {
+	server, client := dialServer(t, gumbletest.ChannelState(1, 0, "Lobby"))
+	alice := server.AddUser("Alice", 0)
+	spec := &ChannelSpec{
+		Children: []*ChannelSpec{
+			{Name: "Lobby"},
+			{Name: "New"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server.Handle(func(p *gumbletest.Packet) []proto.Message {
+		if _, ok := p.Message.(*MumbleProto.ChannelState); !ok {
+			return nil
+		}
+		// Denials of other permissions, in other channels, or to other users
+		// do not fail the step.
+		other := gumbletest.PermissionDenied(gumble.PermissionMakeChannel, 0, "alice")
+		other.Session = proto.Uint32(alice)
+		denied := gumbletest.PermissionDenied(gumble.PermissionMakeChannel, 0, "denied")
+		denied.Session = proto.Uint32(server.Session())
+		return []proto.Message{
+			gumbletest.PermissionDenied(gumble.PermissionWrite, 0, "write"),
+			gumbletest.PermissionDenied(gumble.PermissionMakeChannel, 1, "lobby"),
+			other,
+			denied,
+		}
+	})
+	_, err := Provision(ctx, client, spec, ProvisionOptions{})
+	if err == nil || !strings.Contains(err.Error(), `create channel "/New"`) || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestProvisionIgnored(t *testing.T) {
+	server, client := dialServer(t, gumbletest.ChannelState(1, 0, "Lobby"))
+	position := int32(5)
+	spec := &ChannelSpec{
+		Children: []*ChannelSpec{
+			{Name: "Lobby", Position: &position},
+			{Name: "New"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A change that the server does not answer completes the step, but a
+	// channel that is not created fails it.
+	_, err := Provision(ctx, client, spec, ProvisionOptions{})
+	if err == nil || !strings.Contains(err.Error(), `create channel "/New": channel was not created`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Provision waited for the context to end")
+	}
+	var state MumbleProto.ChannelState
+	expectMessage(t, server, &state)
+	if state.GetChannelId() != 1 || state.GetPosition() != 5 {
+		t.Fatalf("unexpected position change: %v", &state)
+	}
+}
@@ -0,0 +1,706 @@
+package gumbleutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"layeh.com/gumble/gumble"
+)
+
+// SnapshotVersion is the version of the snapshot document format written by
+// Export.
+const SnapshotVersion = 1
+
+// Snapshot is a JSON-serializable copy of the server state that is visible to
+// a client.
+type Snapshot struct {
+	// The version of the document format. Always SnapshotVersion for snapshots
+	// created by Export.
+	Version int `json:"version"`
+	// When the snapshot was created.
+	Time time.Time `json:"time"`
+
+	Channels        []*SnapshotChannel        `json:"channels"`
+	Users           []*SnapshotUser           `json:"users"`
+	RegisteredUsers []*SnapshotRegisteredUser `json:"registered_users,omitempty"`
+	Bans            []*SnapshotBan            `json:"bans,omitempty"`
+	ContextActions  []*SnapshotContextAction  `json:"context_actions,omitempty"`
+
+	// The parts of the server state that could not be exported because the
+	// server denied the request (e.g. "ban list", or "acl /Lobby").
+	Denied []string `json:"denied,omitempty"`
+	// The parts of the server state that could not be exported because the
+	// user disconnected, or the channel was removed, during the export (e.g. a
+	// user's comment, or a channel's description and ACL). The user or channel
+	// itself is still included.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// SnapshotChannel is a channel in a Snapshot.
+type SnapshotChannel struct {
+	ID uint32 `json:"id"`
+	// The ID of the parent channel. nil for the root channel.
+	Parent      *uint32 `json:"parent,omitempty"`
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Position    int32   `json:"position,omitempty"`
+	MaxUsers    uint32  `json:"max_users,omitempty"`
+	Temporary   bool    `json:"temporary,omitempty"`
+	// The IDs of the linked channels.
+	Links []uint32 `json:"links,omitempty"`
+	// The channel's ACL. nil if it could not be fetched.
+	ACL *SnapshotACL `json:"acl,omitempty"`
+}
+
+// SnapshotACL is a channel ACL in a Snapshot.
+type SnapshotACL struct {
+	Inherits bool                `json:"inherits"`
+	Groups   []*SnapshotACLGroup `json:"groups,omitempty"`
+	Rules    []*SnapshotACLRule  `json:"rules,omitempty"`
+}
+
+// SnapshotACLGroup is an ACL group in a Snapshot.
+type SnapshotACLGroup struct {
+	Name        string   `json:"name"`
+	Inherited   bool     `json:"inherited,omitempty"`
+	Inherit     bool     `json:"inherit"`
+	Inheritable bool     `json:"inheritable"`
+	Add         []uint32 `json:"add,omitempty"`
+	Remove      []uint32 `json:"remove,omitempty"`
+	// The members inherited from the parent channel's group.
+	InheritedMembers []uint32 `json:"inherited_members,omitempty"`
+}
+
+// SnapshotACLRule is an ACL rule in a Snapshot. Permissions are stored by name
+// (see PermissionNames).
+type SnapshotACLRule struct {
+	Inherited bool     `json:"inherited,omitempty"`
+	Here      bool     `json:"here"`
+	Subs      bool     `json:"subs"`
+	User      *uint32  `json:"user,omitempty"`
+	Group     string   `json:"group,omitempty"`
+	Grant     []string `json:"grant,omitempty"`
+	Deny      []string `json:"deny,omitempty"`
+}
+
+// SnapshotUser is a connected user in a Snapshot.
+type SnapshotUser struct {
+	Session uint32 `json:"session"`
+	// The user's registered ID. nil if the user is not registered.
+	UserID  *uint32 `json:"user_id,omitempty"`
+	Name    string  `json:"name"`
+	Channel uint32  `json:"channel"`
+
+	Muted           bool `json:"muted,omitempty"`
+	Deafened        bool `json:"deafened,omitempty"`
+	Suppressed      bool `json:"suppressed,omitempty"`
+	SelfMuted       bool `json:"self_muted,omitempty"`
+	SelfDeafened    bool `json:"self_deafened,omitempty"`
+	PrioritySpeaker bool `json:"priority_speaker,omitempty"`
+	Recording       bool `json:"recording,omitempty"`
+
+	Comment string `json:"comment,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	// The user's texture. Only exported if ExportOptions.Textures is set.
+	Texture []byte `json:"texture,omitempty"`
+}
+
+// SnapshotRegisteredUser is a registered user in a Snapshot.
+type SnapshotRegisteredUser struct {
+	UserID   uint32     `json:"user_id"`
+	Name     string     `json:"name"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// The ID of the last channel the user was seen in.
+	LastChannel *uint32 `json:"last_channel,omitempty"`
+}
+
+// SnapshotBan is a ban list entry in a Snapshot.
+type SnapshotBan struct {
+	Address string `json:"address"`
+	// The prefix length of the banned subnet, relative to the IPv6 (or
+	// IPv4-mapped IPv6) address.
+	Mask   int        `json:"mask"`
+	Name   string     `json:"name,omitempty"`
+	Hash   string     `json:"hash,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	// The duration of the ban, in seconds. Zero if the ban is permanent.
+	Duration uint32 `json:"duration,omitempty"`
+}
+
+// SnapshotContextAction is a context action in a Snapshot.
+type SnapshotContextAction struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	// The contexts in which the action can be triggered: "server", "channel",
+	// and/or "user".
+	Contexts []string `json:"contexts"`
+}
+
+// ReadSnapshot reads a JSON snapshot from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Version != SnapshotVersion {
+		return nil, errors.New("gumbleutil: unsupported snapshot version")
+	}
+	return &s, nil
+}
+
+// WriteTo writes the snapshot as indented JSON to w.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	data = append(data, '\n')
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// ExportOptions changes what Export includes in a snapshot.
+type ExportOptions struct {
+	// Include user textures.
+	Textures bool
+}
+
+// FetchBanList requests the server's ban list, and blocks until it is
+// received, the server denies the request, or ctx is done.
+//
+// This function must not be called from inside of an event listener.
+func FetchBanList(ctx context.Context, client *gumble.Client) (gumble.BanList, error) {
+	var bans gumble.BanList
+	err := waitEvent(ctx, client, client.RequestBanList, func(e interface{}) (bool, error) {
+		switch e := e.(type) {
+		case *gumble.BanListEvent:
+			bans = e.BanList
+			return true, nil
+		case *gumble.PermissionDeniedEvent:
+			if e.Type == gumble.PermissionDeniedPermission && e.Permission.Has(gumble.PermissionBan) {
+				return true, e.Err()
+			}
+		}
+		return false, nil
+	})
+	return bans, err
+}
+
+// FetchRegisteredUsers requests the server's registered user list, and blocks
+// until it is received, the server denies the request, or ctx is done.
+//
+// This function must not be called from inside of an event listener.
+func FetchRegisteredUsers(ctx context.Context, client *gumble.Client) (gumble.RegisteredUsers, error) {
+	var users gumble.RegisteredUsers
+	err := waitEvent(ctx, client, client.RequestUserList, func(e interface{}) (bool, error) {
+		switch e := e.(type) {
+		case *gumble.UserListEvent:
+			users = e.UserList
+			return true, nil
+		case *gumble.PermissionDeniedEvent:
+			if e.Type == gumble.PermissionDeniedPermission && e.Permission.Has(gumble.PermissionRegister) {
+				return true, e.Err()
+			}
+		}
+		return false, nil
+	})
+	return users, err
+}
+
+// Export creates a snapshot of the server state that is visible to client.
+// Channel descriptions, user comments, ACLs, the registered user list, and the
+// ban list are fetched from the server. Parts that the server denies access to
+// are listed in Snapshot.Denied, and parts of users and channels that went
+// away while they were fetched are listed in Snapshot.Missing.
+//
+// This function must not be called from inside of an event listener.
+func Export(ctx context.Context, client *gumble.Client, options ExportOptions) (*Snapshot, error) {
+	s := &Snapshot{
+		Version: SnapshotVersion,
+		Time:    time.Now().UTC(),
+	}
+
+	var channels []*gumble.Channel
+	var users []*gumble.User
+	client.Do(func() {
+		for _, channel := range client.Channels {
+			channels = append(channels, channel)
+			c := &SnapshotChannel{
+				ID:        channel.ID,
+				Name:      channel.Name,
+				Position:  channel.Position,
+				MaxUsers:  channel.MaxUsers,
+				Temporary: channel.Temporary,
+			}
+			if channel.Parent != nil {
+				c.Parent = uint32Ptr(channel.Parent.ID)
+			}
+			for id := range channel.Links {
+				c.Links = append(c.Links, id)
+			}
+			sortUint32s(c.Links)
+			s.Channels = append(s.Channels, c)
+		}
+		for _, user := range client.Users {
+			users = append(users, user)
+			u := &SnapshotUser{
+				Session:         user.Session,
+				Name:            user.Name,
+				Muted:           user.Muted,
+				Deafened:        user.Deafened,
+				Suppressed:      user.Suppressed,
+				SelfMuted:       user.SelfMuted,
+				SelfDeafened:    user.SelfDeafened,
+				PrioritySpeaker: user.PrioritySpeaker,
+				Recording:       user.Recording,
+				Hash:            user.Hash,
+			}
+			if user.IsRegistered() {
+				u.UserID = uint32Ptr(user.UserID)
+			}
+			if user.Channel != nil {
+				u.Channel = user.Channel.ID
+			}
+			s.Users = append(s.Users, u)
+		}
+		for _, action := range client.ContextActions {
+			a := &SnapshotContextAction{
+				Name:  action.Name,
+				Label: action.Label,
+			}
+			if action.Type&gumble.ContextActionServer != 0 {
+				a.Contexts = append(a.Contexts, "server")
+			}
+			if action.Type&gumble.ContextActionChannel != 0 {
+				a.Contexts = append(a.Contexts, "channel")
+			}
+			if action.Type&gumble.ContextActionUser != 0 {
+				a.Contexts = append(a.Contexts, "user")
+			}
+			s.ContextActions = append(s.ContextActions, a)
+		}
+	})
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+	sort.Slice(s.Channels, func(i, j int) bool { return s.Channels[i].ID < s.Channels[j].ID })
+	sort.Slice(users, func(i, j int) bool { return users[i].Session < users[j].Session })
+	sort.Slice(s.Users, func(i, j int) bool { return s.Users[i].Session < s.Users[j].Session })
+	sort.Slice(s.ContextActions, func(i, j int) bool { return s.ContextActions[i].Name < s.ContextActions[j].Name })
+
+	denied := func(part string, err error) error {
+		if permissionDenied(err) == nil {
+			return err
+		}
+		s.Denied = append(s.Denied, part)
+		return nil
+	}
+
+	for i, channel := range channels {
+		path := formatPath(ChannelPath(channel)[1:])
+		var err error
+		if s.Channels[i].Description, err = channel.DescriptionContext(ctx); err != nil {
+			if !channelRemoved(client, channel) {
+				return nil, err
+			}
+			s.Missing = append(s.Missing, "description "+path, "acl "+path)
+			continue
+		}
+		acl, err := FetchACL(ctx, client, channel)
+		if err == errChannelRemoved {
+			s.Missing = append(s.Missing, "acl "+path)
+			continue
+		}
+		if err != nil {
+			if err := denied("acl "+path, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.Channels[i].ACL = snapshotACL(acl)
+	}
+	for i, user := range users {
+		name := strconv.Quote(s.Users[i].Name)
+		var err error
+		if s.Users[i].Comment, err = user.CommentContext(ctx); err != nil {
+			if !userDisconnected(client, user) {
+				return nil, err
+			}
+			s.Missing = append(s.Missing, "comment of user "+name)
+			if options.Textures {
+				s.Missing = append(s.Missing, "texture of user "+name)
+			}
+			continue
+		}
+		if options.Textures {
+			if s.Users[i].Texture, err = user.TextureContext(ctx); err != nil {
+				if !userDisconnected(client, user) {
+					return nil, err
+				}
+				s.Missing = append(s.Missing, "texture of user "+name)
+			}
+		}
+	}
+
+	registered, err := FetchRegisteredUsers(ctx, client)
+	if err != nil {
+		if err := denied("registered users", err); err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range registered {
+		u := &SnapshotRegisteredUser{
+			UserID: user.UserID,
+			Name:   user.Name,
+		}
+		if !user.LastSeen.IsZero() {
+			lastSeen := user.LastSeen
+			u.LastSeen = &lastSeen
+		}
+		if user.LastChannel != nil {
+			u.LastChannel = uint32Ptr(user.LastChannel.ID)
+		}
+		s.RegisteredUsers = append(s.RegisteredUsers, u)
+	}
+
+	bans, err := FetchBanList(ctx, client)
+	if err != nil {
+		if err := denied("ban list", err); err != nil {
+			return nil, err
+		}
+	}
+	for _, ban := range bans {
+		b := &SnapshotBan{
+			Address:  ban.Address.String(),
+			Name:     ban.Name,
+			Hash:     ban.Hash,
+			Reason:   ban.Reason,
+			Duration: uint32(ban.Duration / time.Second),
+		}
+		b.Mask = banMaskSize(ban.Mask)
+		if !ban.Start.IsZero() {
+			start := ban.Start
+			b.Start = &start
+		}
+		s.Bans = append(s.Bans, b)
+	}
+
+	return s, nil
+}
+
+// userDisconnected returns true if user is no longer one of the client's
+// users.
+func userDisconnected(client *gumble.Client, user *gumble.User) (disconnected bool) {
+	client.Do(func() {
+		disconnected = client.Users[user.Session] != user
+	})
+	return
+}
+
+// banMaskSize returns the number of leading ones in mask, as a prefix length
+// of an IPv6 (or IPv4-mapped IPv6) address.
+func banMaskSize(mask net.IPMask) int {
+	ones, bits := mask.Size()
+	if bits == net.IPv4len*8 {
+		ones += (net.IPv6len - net.IPv4len) * 8
+	}
+	return ones
+}
+
+func uint32Ptr(v uint32) *uint32 {
+	return &v
+}
+
+func sortUint32s(s []uint32) {
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+}
+
+func aclUserIDs(users map[uint32]*gumble.ACLUser) []uint32 {
+	var ids []uint32
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortUint32s(ids)
+	return ids
+}
+
+func snapshotACL(acl *gumble.ACL) *SnapshotACL {
+	s := &SnapshotACL{
+		Inherits: acl.Inherits,
+	}
+	for _, group := range acl.Groups {
+		s.Groups = append(s.Groups, &SnapshotACLGroup{
+			Name:             group.Name,
+			Inherited:        group.Inherited,
+			Inherit:          group.InheritUsers,
+			Inheritable:      group.Inheritable,
+			Add:              aclUserIDs(group.UsersAdd),
+			Remove:           aclUserIDs(group.UsersRemove),
+			InheritedMembers: aclUserIDs(group.UsersInherited),
+		})
+	}
+	for _, rule := range acl.Rules {
+		r := &SnapshotACLRule{
+			Inherited: rule.Inherited,
+			Here:      rule.AppliesCurrent,
+			Subs:      rule.AppliesChildren,
+			Grant:     PermissionNames(rule.Granted),
+			Deny:      PermissionNames(rule.Denied),
+		}
+		if rule.User != nil {
+			r.User = uint32Ptr(rule.User.UserID)
+		}
+		if rule.Group != nil {
+			r.Group = rule.Group.Name
+		}
+		s.Rules = append(s.Rules, r)
+	}
+	return s
+}
+
+// ImportOptions changes how Import modifies the server.
+type ImportOptions struct {
+	// Remove channels that are not in the snapshot.
+	Prune bool
+	// Replace the server's ban list with the snapshot's bans, instead of adding
+	// the snapshot's bans to the existing list.
+	ReplaceBans bool
+	// Do not import the snapshot's bans.
+	SkipBans bool
+}
+
+// ImportFailure is a change that could not be made by Import.
+type ImportFailure struct {
+	// A description of the change (e.g. `create channel "/Lobby"`).
+	Item string
+	Err  error
+	// The server's response, if the change failed because the server denied
+	// it.
+	Denied *gumble.PermissionDeniedError
+}
+
+// ImportReport is the result of Import.
+type ImportReport struct {
+	// The changes that were made.
+	Applied []string
+	// The changes that could not be made.
+	Failures []*ImportFailure
+}
+
+func (r *ImportReport) fail(item string, err error) {
+	r.Failures = append(r.Failures, &ImportFailure{
+		Item:   item,
+		Err:    err,
+		Denied: permissionDenied(err),
+	})
+}
+
+// SnapshotChannelSpec returns a ChannelSpec for the root channel that
+// describes the channel tree, including ACLs, of s. Temporary channels are
+// not included.
+func SnapshotChannelSpec(s *Snapshot) (*ChannelSpec, error) {
+	byID := make(map[uint32]*SnapshotChannel, len(s.Channels))
+	children := make(map[uint32][]*SnapshotChannel)
+	var root *SnapshotChannel
+	for _, channel := range s.Channels {
+		byID[channel.ID] = channel
+		if channel.Parent == nil {
+			if root != nil {
+				return nil, errors.New("gumbleutil: snapshot has multiple root channels")
+			}
+			root = channel
+			continue
+		}
+		children[*channel.Parent] = append(children[*channel.Parent], channel)
+	}
+	if root == nil {
+		return nil, errors.New("gumbleutil: snapshot has no root channel")
+	}
+
+	var path func(channel *SnapshotChannel) (string, bool)
+	path = func(channel *SnapshotChannel) (string, bool) {
+		if channel.Parent == nil {
+			return "", true
+		}
+		parent := byID[*channel.Parent]
+		if parent == nil || parent.Temporary || channel.Temporary {
+			return "", false
+		}
+		p, ok := path(parent)
+		return p + "/" + channel.Name, ok
+	}
+
+	var build func(channel *SnapshotChannel) *ChannelSpec
+	build = func(channel *SnapshotChannel) *ChannelSpec {
+		description := channel.Description
+		position := channel.Position
+		maxUsers := channel.MaxUsers
+		spec := &ChannelSpec{
+			Name:        channel.Name,
+			Description: &description,
+			Position:    &position,
+			MaxUsers:    &maxUsers,
+			Links:       []string{},
+		}
+		for _, id := range channel.Links {
+			if other := byID[id]; other != nil {
+				if p, ok := path(other); ok {
+					spec.Links = append(spec.Links, strings.TrimPrefix(p, "/"))
+				}
+			}
+		}
+		if channel.ACL != nil {
+			spec.ACL = aclSpec(channel.ACL)
+		}
+		kids := children[channel.ID]
+		sort.Slice(kids, func(i, j int) bool {
+			if kids[i].Position != kids[j].Position {
+				return kids[i].Position < kids[j].Position
+			}
+			return kids[i].Name < kids[j].Name
+		})
+		for _, child := range kids {
+			if !child.Temporary {
+				spec.Children = append(spec.Children, build(child))
+			}
+		}
+		return spec
+	}
+	return build(root), nil
+}
+
+func aclSpec(acl *SnapshotACL) *ACLSpec {
+	inherits := acl.Inherits
+	spec := &ACLSpec{
+		Inherits: &inherits,
+	}
+	for _, group := range acl.Groups {
+		if group.Inherited && group.Inherit && group.Inheritable && len(group.Add) == 0 && len(group.Remove) == 0 {
+			continue
+		}
+		inherit, inheritable := group.Inherit, group.Inheritable
+		spec.Groups = append(spec.Groups, &ACLGroupSpec{
+			Name:        group.Name,
+			Inherit:     &inherit,
+			Inheritable: &inheritable,
+			Add:         group.Add,
+			Remove:      group.Remove,
+		})
+	}
+	for _, rule := range acl.Rules {
+		if rule.Inherited {
+			continue
+		}
+		here, subs := rule.Here, rule.Subs
+		spec.Rules = append(spec.Rules, &ACLRuleSpec{
+			User:  rule.User,
+			Group: rule.Group,
+			Here:  &here,
+			Subs:  &subs,
+			Grant: rule.Grant,
+			Deny:  rule.Deny,
+		})
+	}
+	return spec
+}
+
+// Import makes the channel tree, ACLs, and bans of the server match those of
+// s, using the same write paths as Provision. Changes that fail, for example
+// because the server denied them, are listed in the returned report; Import
+// only returns an error if the snapshot is invalid, ctx is done, or the client
+// disconnects.
+//
+// Registered user IDs in ACLs are imported as-is, so they only refer to the
+// same users if the servers share a user database.
+//
+// This function must not be called from inside of an event listener.
+func Import(ctx context.Context, client *gumble.Client, s *Snapshot, options ImportOptions) (*ImportReport, error) {
+	if s.Version != SnapshotVersion {
+		return nil, errors.New("gumbleutil: unsupported snapshot version")
+	}
+	spec, err := SnapshotChannelSpec(s)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	p := newProvisioner(ctx, client, ProvisionOptions{Prune: options.Prune})
+	p.aclDenied = func(path []string, err error) {
+		report.fail("set ACL of "+formatPath(path), err)
+	}
+	plan, err := p.run(spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range plan.Steps {
+		if err := applyStep(ctx, client, step); err != nil {
+			if client.State() == gumble.StateDisconnected || ctx.Err() != nil {
+				return report, err
+			}
+			report.fail(step.String(), err)
+			continue
+		}
+		report.Applied = append(report.Applied, step.String())
+	}
+
+	if !options.SkipBans {
+		if err := importBans(ctx, client, s.Bans, options.ReplaceBans); err != nil {
+			if client.State() == gumble.StateDisconnected || ctx.Err() != nil {
+				return report, err
+			}
+			report.fail("update ban list", err)
+		} else {
+			report.Applied = append(report.Applied, "update ban list")
+		}
+	}
+	return report, nil
+}
+
+func importBans(ctx context.Context, client *gumble.Client, bans []*SnapshotBan, replace bool) error {
+	var list gumble.BanList
+	if !replace {
+		var err error
+		if list, err = FetchBanList(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range bans {
+		address := net.ParseIP(b.Address)
+		if address == nil {
+			return errors.New("gumbleutil: invalid ban address " + b.Address)
+		}
+		mask := net.CIDRMask(b.Mask, net.IPv6len*8)
+		if mask == nil {
+			return errors.New("gumbleutil: invalid ban mask")
+		}
+		exists := false
+		for _, ban := range list {
+			if ban.Address.Equal(address) && banMaskSize(ban.Mask) == b.Mask && ban.Hash == b.Hash {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+		ban := list.Add(address, mask, b.Reason, time.Duration(b.Duration)*time.Second)
+		ban.Name = b.Name
+		ban.Hash = b.Hash
+		if b.Start != nil {
+			ban.Start = *b.Start
+		}
+	}
+
+	scope := gumble.RequestScope{
+		Types:      []gumble.PermissionDeniedType{gumble.PermissionDeniedPermission},
+		Permission: gumble.PermissionBan,
+	}
+	return client.Track(scope, func() { client.Send(list) }).Wait(ctx)
+}
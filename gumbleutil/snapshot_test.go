@@ -0,0 +1,275 @@
+package gumbleutil
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumble/MumbleProto"
+	"layeh.com/gumble/gumbletest"
+)
+
+// snapshotServer answers the requests that Export and Import make, and
+// applies the channel changes, ACLs, and ban lists sent by the client.
+type snapshotServer struct {
+	server *gumbletest.Server
+
+	mu          sync.Mutex
+	nextChannel uint32
+	acls        map[uint32]*MumbleProto.ACL
+	bans        []*MumbleProto.BanList_BanEntry
+	// The last ban list sent by the client.
+	banUpdate *MumbleProto.BanList
+}
+
+func newSnapshotServer(t *testing.T, initial ...proto.Message) (*snapshotServer, *gumble.Client) {
+	server, client := dialServer(t, initial...)
+	s := &snapshotServer{
+		server:      server,
+		nextChannel: 100,
+		acls:        make(map[uint32]*MumbleProto.ACL),
+	}
+	server.Handle(s.handle)
+	return s, client
+}
+
+func (s *snapshotServer) handle(packet *gumbletest.Packet) []proto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m := packet.Message.(type) {
+	case *MumbleProto.ChannelState:
+		if m.ChannelId == nil {
+			m.ChannelId = proto.Uint32(s.nextChannel)
+			s.nextChannel++
+		}
+		return []proto.Message{m}
+	case *MumbleProto.ChannelRemove:
+		return []proto.Message{m}
+	case *MumbleProto.ACL:
+		if !m.GetQuery() {
+			// Like murmur, mark the channel's own groups and rules, since
+			// inherited defaults to true.
+			for _, group := range m.Groups {
+				group.Inherited = proto.Bool(false)
+			}
+			for _, rule := range m.Acls {
+				rule.Inherited = proto.Bool(false)
+			}
+			s.acls[m.GetChannelId()] = m
+			return nil
+		}
+		acl := s.acls[m.GetChannelId()]
+		if acl == nil {
+			acl = &MumbleProto.ACL{InheritAcls: proto.Bool(true)}
+		}
+		acl = proto.Clone(acl).(*MumbleProto.ACL)
+		acl.ChannelId = m.ChannelId
+		acl.Query = nil
+		return []proto.Message{acl, &MumbleProto.QueryUsers{}}
+	case *MumbleProto.BanList:
+		if !m.GetQuery() {
+			s.bans = m.Bans
+			s.banUpdate = m
+			return nil
+		}
+		return []proto.Message{&MumbleProto.BanList{Bans: s.bans}}
+	case *MumbleProto.UserList:
+		return []proto.Message{&MumbleProto.UserList{}}
+	}
+	return nil
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	lobby := gumbletest.ChannelState(1, 0, "Lobby")
+	lobby.Description = proto.String("Welcome")
+	lobby.Position = proto.Int32(1)
+	lobby.LinksAdd = []uint32{3}
+	source, client := newSnapshotServer(t,
+		gumbletest.ChannelState(2, 0, "Games"),
+		gumbletest.ChannelState(3, 2, "Chess"),
+		lobby,
+	)
+	source.acls[1] = &MumbleProto.ACL{
+		InheritAcls: proto.Bool(false),
+		Groups: []*MumbleProto.ACL_ChanGroup{
+			{Name: proto.String("admins"), Inherited: proto.Bool(false), Inherit: proto.Bool(true), Inheritable: proto.Bool(false), Add: []uint32{5}, Remove: []uint32{6}},
+		},
+		Acls: []*MumbleProto.ACL_ChanACL{
+			{Inherited: proto.Bool(false), ApplyHere: proto.Bool(true), ApplySubs: proto.Bool(true), Group: proto.String("admins"), Grant: proto.Uint32(uint32(gumble.PermissionWrite))},
+			{Inherited: proto.Bool(false), ApplyHere: proto.Bool(true), ApplySubs: proto.Bool(false), UserId: proto.Uint32(7), Deny: proto.Uint32(uint32(gumble.PermissionEnter | gumble.PermissionSpeak))},
+		},
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	source.bans = []*MumbleProto.BanList_BanEntry{
+		{
+			Address:  net.IPv4(192, 0, 2, 1).To4(),
+			Mask:     proto.Uint32(24),
+			Name:     proto.String("mallory"),
+			Hash:     proto.String("0123456789abcdef"),
+			Reason:   proto.String("spam"),
+			Start:    proto.String(start.Format(time.RFC3339)),
+			Duration: proto.Uint32(3600),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	snapshot, err := Export(ctx, client, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Denied) != 0 {
+		t.Fatalf("unexpected denied parts: %v", snapshot.Denied)
+	}
+	if len(snapshot.Channels) != 4 {
+		t.Fatalf("expected 4 channels, got %d", len(snapshot.Channels))
+	}
+	exported := snapshot.Channels[1]
+	if exported.Name != "Lobby" || exported.Description != "Welcome" || exported.Position != 1 || !reflect.DeepEqual(exported.Links, []uint32{3}) {
+		t.Errorf("unexpected channel: %+v", exported)
+	}
+	expectedACL := &SnapshotACL{
+		Groups: []*SnapshotACLGroup{
+			{Name: "admins", Inherit: true, Add: []uint32{5}, Remove: []uint32{6}},
+		},
+		Rules: []*SnapshotACLRule{
+			{Here: true, Subs: true, Group: "admins", Grant: []string{"write"}},
+			{Here: true, User: uint32Ptr(7), Deny: []string{"enter", "speak"}},
+		},
+	}
+	if !reflect.DeepEqual(exported.ACL, expectedACL) {
+		t.Errorf("unexpected ACL: %+v", exported.ACL)
+	}
+	expectedBans := []*SnapshotBan{
+		{
+			Address:  "192.0.2.1",
+			Mask:     120,
+			Name:     "mallory",
+			Hash:     "0123456789abcdef",
+			Reason:   "spam",
+			Start:    &start,
+			Duration: 3600,
+		},
+	}
+	if !reflect.DeepEqual(snapshot.Bans, expectedBans) {
+		t.Errorf("unexpected bans: %+v", snapshot.Bans[0])
+	}
+
+	var buf bytes.Buffer
+	if _, err := snapshot.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, snapshot) {
+		t.Fatal("snapshot changed after being written and read")
+	}
+
+	target, client := newSnapshotServer(t)
+	report, err := Import(ctx, client, read, ImportOptions{ReplaceBans: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failures) != 0 {
+		t.Fatalf("import failed: %s: %v", report.Failures[0].Item, report.Failures[0].Err)
+	}
+
+	target.mu.Lock()
+	update := target.banUpdate
+	target.mu.Unlock()
+	if update == nil || len(update.Bans) != 1 {
+		t.Fatalf("unexpected ban list update: %v", update)
+	}
+	if entry := update.Bans[0]; entry.GetName() != "mallory" || entry.GetHash() != "0123456789abcdef" || entry.GetStart() != start.Format(time.RFC3339) {
+		t.Errorf("unexpected ban entry: %v", entry)
+	}
+
+	imported, err := Export(ctx, client, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSpec, err := SnapshotChannelSpec(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := SnapshotChannelSpec(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, expectedSpec) {
+		t.Errorf("imported channel tree differs from snapshot")
+	}
+	if !reflect.DeepEqual(imported.Bans, expectedBans) {
+		t.Errorf("unexpected imported bans: %+v", imported.Bans)
+	}
+}
+
+func TestSnapshotExportUserDisconnected(t *testing.T) {
+	state := gumbletest.UserState(100, "Alice", 0)
+	state.CommentHash = []byte{1}
+	s, client := newSnapshotServer(t, state)
+	// Alice disconnects instead of her comment being sent.
+	s.server.Handle(func(p *gumbletest.Packet) []proto.Message {
+		if _, ok := p.Message.(*MumbleProto.RequestBlob); ok {
+			return []proto.Message{gumbletest.UserRemove(100, 0, "", false)}
+		}
+		return s.handle(p)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	snapshot, err := Export(ctx, client, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{`comment of user "Alice"`}; !reflect.DeepEqual(snapshot.Missing, expected) {
+		t.Errorf("unexpected missing parts: %q", snapshot.Missing)
+	}
+	if len(snapshot.Users) != 2 || snapshot.Users[1].Name != "Alice" {
+		t.Errorf("unexpected users: %+v", snapshot.Users)
+	}
+	if snapshot.Channels[0].ACL == nil {
+		t.Error("export stopped before fetching the ACLs")
+	}
+}
+
+func TestSnapshotExportChannelRemoved(t *testing.T) {
+	lobby := gumbletest.ChannelState(1, 0, "Lobby")
+	lobby.DescriptionHash = []byte{1}
+	s, client := newSnapshotServer(t, lobby, gumbletest.ChannelState(2, 0, "Games"))
+	// Lobby is removed instead of its description being sent, and Games is
+	// removed instead of its ACL being sent.
+	s.server.Handle(func(p *gumbletest.Packet) []proto.Message {
+		switch m := p.Message.(type) {
+		case *MumbleProto.RequestBlob:
+			return []proto.Message{gumbletest.ChannelRemove(1)}
+		case *MumbleProto.ACL:
+			if m.GetChannelId() == 2 {
+				return []proto.Message{gumbletest.ChannelRemove(2)}
+			}
+		}
+		return s.handle(p)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	snapshot, err := Export(ctx, client, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`description "/Lobby"`, `acl "/Lobby"`, `acl "/Games"`}
+	if !reflect.DeepEqual(snapshot.Missing, expected) {
+		t.Errorf("unexpected missing parts: %q", snapshot.Missing)
+	}
+	if len(snapshot.Channels) != 3 || snapshot.Channels[0].ACL == nil {
+		t.Errorf("unexpected channels: %+v", snapshot.Channels)
+	}
+}
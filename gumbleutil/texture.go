@@ -0,0 +1,199 @@
+package gumbleutil
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+
+	"layeh.com/gumble/gumble"
+)
+
+// Dimensions of textures that were used by Mumble clients prior to 1.2.
+const (
+	LegacyTextureWidth  = 600
+	LegacyTextureHeight = 60
+)
+
+// TextureMaxSize is the maximum width and height of textures produced by
+// EncodeTexture.
+const TextureMaxSize = 128
+
+const legacyTextureBytes = LegacyTextureWidth * LegacyTextureHeight * 4
+
+var (
+	errTextureTooLarge = errors.New("gumbleutil: texture cannot be encoded under the size limit")
+	errTextureEmpty    = errors.New("gumbleutil: cannot encode an empty image as a texture")
+)
+
+// DecodeTexture decodes a user texture (e.g. gumble.User.Texture). PNG and
+// JPEG textures are supported, as well as the legacy raw 600x60 BGRA format
+// (either uncompressed or compressed in Qt's qCompress format).
+func DecodeTexture(texture []byte) (image.Image, error) {
+	if len(texture) == legacyTextureBytes {
+		return decodeLegacyTexture(texture), nil
+	}
+	if len(texture) > 4 && binary.BigEndian.Uint32(texture) == legacyTextureBytes {
+		r, err := zlib.NewReader(bytes.NewReader(texture[4:]))
+		if err == nil {
+			raw, err := ioutil.ReadAll(r)
+			if err == nil && len(raw) == legacyTextureBytes {
+				return decodeLegacyTexture(raw), nil
+			}
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(texture))
+	return img, err
+}
+
+func decodeLegacyTexture(raw []byte) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, LegacyTextureWidth, LegacyTextureHeight))
+	for i := 0; i < len(raw); i += 4 {
+		img.Pix[i+0] = raw[i+2]
+		img.Pix[i+1] = raw[i+1]
+		img.Pix[i+2] = raw[i+0]
+		img.Pix[i+3] = raw[i+3]
+	}
+	return img
+}
+
+// EncodeTexture converts img into a texture that can be passed to
+// gumble.User.SetTexture.
+//
+// The image is cropped to a centered square and scaled down so that it is no
+// larger than TextureMaxSize pixels in each dimension. It is then encoded as a
+// PNG or, if that is too large, a JPEG. If maxBytes is positive, the image is
+// scaled down further until the encoded texture is no larger than maxBytes;
+// the server's limit is sent as gumble.ServerConfigEvent.MaximumImageMessageLength.
+func EncodeTexture(img image.Image, maxBytes int) ([]byte, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, errTextureEmpty
+	}
+	crop := bounds
+	if w, h := bounds.Dx(), bounds.Dy(); w > h {
+		crop.Min.X += (w - h) / 2
+		crop.Max.X = crop.Min.X + h
+	} else if h > w {
+		crop.Min.Y += (h - w) / 2
+		crop.Max.Y = crop.Min.Y + w
+	}
+
+	size := crop.Dx()
+	if size > TextureMaxSize {
+		size = TextureMaxSize
+	}
+	for ; size > 0; size /= 2 {
+		texture, err := encodeTexture(scaleImage(img, crop, size, size), maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if texture != nil {
+			return texture, nil
+		}
+	}
+	return nil, errTextureTooLarge
+}
+
+// encodeTexture encodes img as a PNG, then as JPEGs of decreasing quality,
+// until it is no larger than maxBytes. nil is returned if none of the
+// encodings fit.
+func encodeTexture(img image.Image, maxBytes int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 || b.Len() <= maxBytes {
+		return b.Bytes(), nil
+	}
+	for quality := 90; quality >= 30; quality -= 20 {
+		b.Reset()
+		if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		if b.Len() <= maxBytes {
+			return b.Bytes(), nil
+		}
+	}
+	return nil, nil
+}
+
+// scaleImage scales the src rectangle of img down to a width by height image
+// by averaging the source pixels that cover each destination pixel.
+func scaleImage(img image.Image, src image.Rectangle, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := src.Min.Y + (y+1)*src.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := src.Min.X + (x+1)*src.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			c := color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			}
+			dst.Set(x, y, c)
+		}
+	}
+	return dst
+}
+
+// SetTexture encodes img using EncodeTexture and sets it as the user's
+// texture.
+func SetTexture(user *gumble.User, img image.Image, maxBytes int) error {
+	texture, err := EncodeTexture(img, maxBytes)
+	if err != nil {
+		return err
+	}
+	user.SetTexture(texture)
+	return nil
+}
+
+// ImageHTML encodes img using EncodeTexture, and returns an HTML <img>
+// element that embeds it, for use in text messages (e.g. to show the cover
+// art from gumbleffmpeg.Metadata). maxBytes limits the length of the
+// returned element; the server's limit is
+// gumble.ServerConfigEvent.MaximumImageMessageLength.
+func ImageHTML(img image.Image, maxBytes int) (string, error) {
+	// The length of the element without the image data, with the longest
+	// MIME type that EncodeTexture produces.
+	const overhead = len(`<img src="data:image/jpeg;base64," />`)
+	limit := 0
+	if maxBytes > 0 {
+		limit = base64.StdEncoding.DecodedLen(maxBytes - overhead)
+		if limit <= 0 {
+			return "", errTextureTooLarge
+		}
+	}
+	data, err := EncodeTexture(img, limit)
+	if err != nil {
+		return "", err
+	}
+	return `<img src="data:` + http.DetectContentType(data) + `;base64,` + base64.StdEncoding.EncodeToString(data) + `" />`, nil
+}
@@ -0,0 +1,144 @@
+package gumbleutil
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// noiseImage returns an image of random pixels, which does not compress well.
+func noiseImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	return img
+}
+
+func TestEncodeTexture(t *testing.T) {
+	// An image whose center square is blue, and whose sides are red.
+	wide := image.NewNRGBA(image.Rect(10, 20, 310, 120))
+	for y := wide.Rect.Min.Y; y < wide.Rect.Max.Y; y++ {
+		for x := wide.Rect.Min.X; x < wide.Rect.Max.X; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= 110 && x < 210 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			wide.Set(x, y, c)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		maxBytes int
+		size     int
+		err      error
+	}{
+		{"wide", wide, 0, 100, nil},
+		{"large", noiseImage(1000, 500), 0, TextureMaxSize, nil},
+		{"tall", noiseImage(10, 30), 0, 10, nil},
+		{"limited", noiseImage(200, 200), 4000, 0, nil},
+		{"too large", noiseImage(200, 200), 10, 0, errTextureTooLarge},
+		{"empty", image.NewNRGBA(image.Rect(0, 0, 0, 0)), 0, 0, errTextureEmpty},
+		{"zero width", image.NewNRGBA(image.Rect(5, 5, 5, 50)), 0, 0, errTextureEmpty},
+	}
+	for _, test := range tests {
+		texture, err := EncodeTexture(test.img, test.maxBytes)
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if test.maxBytes > 0 && len(texture) > test.maxBytes {
+			t.Errorf("%s: texture is %d bytes, larger than %d", test.name, len(texture), test.maxBytes)
+		}
+		img, err := DecodeTexture(texture)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		bounds := img.Bounds()
+		if bounds.Dx() != bounds.Dy() || (test.size > 0 && bounds.Dx() != test.size) {
+			t.Errorf("%s: got %v texture, expected %dx%d", test.name, bounds.Size(), test.size, test.size)
+		}
+	}
+
+	// Only the center square is kept.
+	texture, _ := EncodeTexture(wide, 0)
+	img, _ := DecodeTexture(texture)
+	for _, p := range []image.Point{{0, 0}, {99, 0}, {0, 99}, {99, 99}, {50, 50}} {
+		if r, _, b, _ := img.At(p.X, p.Y).RGBA(); r != 0 || b != 0xffff {
+			t.Errorf("pixel %v is not blue: %v", p, img.At(p.X, p.Y))
+		}
+	}
+}
+
+func TestDecodeLegacyTexture(t *testing.T) {
+	raw := make([]byte, legacyTextureBytes)
+	for i := 0; i < len(raw); i += 4 {
+		// BGRA
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = 1, 2, 3, 4
+	}
+	var compressed bytes.Buffer
+	binary.Write(&compressed, binary.BigEndian, uint32(len(raw)))
+	w := zlib.NewWriter(&compressed)
+	w.Write(raw)
+	w.Close()
+
+	for name, texture := range map[string][]byte{"raw": raw, "compressed": compressed.Bytes()} {
+		img, err := DecodeTexture(texture)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if size := img.Bounds().Size(); size != image.Pt(LegacyTextureWidth, LegacyTextureHeight) {
+			t.Errorf("%s: unexpected size %v", name, size)
+		}
+		if c := img.At(LegacyTextureWidth-1, LegacyTextureHeight-1); c != (color.NRGBA{R: 3, G: 2, B: 1, A: 4}) {
+			t.Errorf("%s: unexpected color %v", name, c)
+		}
+	}
+}
+
+func TestImageHTML(t *testing.T) {
+	const prefix = `<img src="data:image/png;base64,`
+	html, err := ImageHTML(noiseImage(16, 16), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(html, prefix) || !strings.HasSuffix(html, `" />`) {
+		t.Fatalf("unexpected element: %.60s", html)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(html, prefix), `" />`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err := DecodeTexture(data); err != nil || img.Bounds().Dx() != 16 {
+		t.Errorf("embedded image could not be decoded: %v", err)
+	}
+
+	// The whole element fits under the limit, even when the image has to be
+	// encoded as a JPEG.
+	for _, maxBytes := range []int{2000, 5000, 20000} {
+		html, err := ImageHTML(noiseImage(200, 200), maxBytes)
+		if err != nil {
+			t.Errorf("%d: %v", maxBytes, err)
+		} else if len(html) > maxBytes {
+			t.Errorf("%d: element is %d bytes", maxBytes, len(html))
+		}
+	}
+
+	if _, err := ImageHTML(noiseImage(16, 16), 20); err != errTextureTooLarge {
+		t.Errorf("expected errTextureTooLarge, got %v", err)
+	}
+	if _, err := ImageHTML(image.NewNRGBA(image.Rect(0, 0, 0, 0)), 0); err != errTextureEmpty {
+		t.Errorf("expected errTextureEmpty, got %v", err)
+	}
+}
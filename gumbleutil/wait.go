@@ -0,0 +1,201 @@
+package gumbleutil
+
+import (
+	"context"
+	"errors"
+
+	"layeh.com/gumble/gumble"
+)
+
+var (
+	errDisconnected   = errors.New("gumbleutil: client disconnected")
+	errChannelRemoved = errors.New("gumbleutil: channel removed")
+)
+
+// permissionDenied returns the denial that caused err, or nil if err was not
+// caused by the server denying a request.
+func permissionDenied(err error) *gumble.PermissionDeniedError {
+	d, _ := err.(*gumble.PermissionDeniedError)
+	return d
+}
+
+// waitEvent attaches a listener to client, calls send (if non-nil), and
+// blocks until match returns true for an event, ctx is done, or the client
+// disconnects. The error returned by match is returned.
+//
+// match is called from the client's event goroutine; waitEvent must not be.
+func waitEvent(ctx context.Context, client *gumble.Client, send func(), match func(e interface{}) (bool, error)) error {
+	return waitCondition(ctx, client, func() (bool, error) {
+		if send != nil {
+			send()
+		}
+		return false, nil
+	}, match)
+}
+
+// waitCondition is like waitEvent, but calls check after the listener has been
+// attached. If check returns true, its error is returned without waiting for
+// an event.
+func waitCondition(ctx context.Context, client *gumble.Client, check func() (bool, error), match func(e interface{}) (bool, error)) error {
+	result := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	listener := ListenerFunc(func(e interface{}) {
+		if _, ok := e.(*gumble.DisconnectEvent); ok {
+			done(errDisconnected)
+			return
+		}
+		if ok, err := match(e); ok {
+			done(err)
+		}
+	})
+
+	var detacher gumble.Detacher
+	client.Do(func() {
+		detacher = client.Config.Attach(listener)
+	})
+	defer client.Do(func() {
+		detacher.Detach()
+	})
+
+	if client.State() == gumble.StateDisconnected {
+		return errDisconnected
+	}
+	if ok, err := check(); ok {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForUser blocks until a connected user for which predicate returns true
+// exists, ctx is done, or the client disconnects. The matching user is
+// returned.
+//
+// predicate is called with the client's state locked, either from inside of
+// Client.Do, or from the client's event goroutine whenever a user or channel
+// changes. It must not block.
+//
+// This function must not be called from inside of an event listener.
+func WaitForUser(ctx context.Context, client *gumble.Client, predicate func(user *gumble.User) bool) (*gumble.User, error) {
+	// found receives the match from the event goroutine; initial is only set
+	// by the initial check.
+	found := make(chan *gumble.User, 1)
+	var initial *gumble.User
+	find := func(result **gumble.User) bool {
+		for _, user := range client.Users {
+			if predicate(user) {
+				*result = user
+				return true
+			}
+		}
+		return false
+	}
+	err := waitCondition(ctx, client, func() (ok bool, err error) {
+		client.Do(func() {
+			ok = find(&initial)
+		})
+		return
+	}, func(e interface{}) (bool, error) {
+		switch e := e.(type) {
+		case *gumble.UserChangeEvent:
+			if !e.Type.Has(gumble.UserChangeDisconnected) && predicate(e.User) {
+				sendFoundUser(found, e.User)
+				return true, nil
+			}
+		case *gumble.ChannelChangeEvent:
+			var user *gumble.User
+			if find(&user) {
+				sendFoundUser(found, user)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if initial != nil {
+		return initial, nil
+	}
+	return <-found, nil
+}
+
+// WaitForChannel blocks until a channel for which predicate returns true
+// exists, ctx is done, or the client disconnects. The matching channel is
+// returned.
+//
+// predicate is called with the client's state locked, either from inside of
+// Client.Do, or from the client's event goroutine whenever a user or channel
+// changes. It must not block.
+//
+// This function must not be called from inside of an event listener.
+func WaitForChannel(ctx context.Context, client *gumble.Client, predicate func(channel *gumble.Channel) bool) (*gumble.Channel, error) {
+	// found receives the match from the event goroutine; initial is only set
+	// by the initial check.
+	found := make(chan *gumble.Channel, 1)
+	var initial *gumble.Channel
+	find := func(result **gumble.Channel) bool {
+		for _, channel := range client.Channels {
+			if predicate(channel) {
+				*result = channel
+				return true
+			}
+		}
+		return false
+	}
+	err := waitCondition(ctx, client, func() (ok bool, err error) {
+		client.Do(func() {
+			ok = find(&initial)
+		})
+		return
+	}, func(e interface{}) (bool, error) {
+		switch e := e.(type) {
+		case *gumble.ChannelChangeEvent:
+			if !e.Type.Has(gumble.ChannelChangeRemoved) && predicate(e.Channel) {
+				sendFoundChannel(found, e.Channel)
+				return true, nil
+			}
+		case *gumble.UserChangeEvent:
+			var channel *gumble.Channel
+			if find(&channel) {
+				sendFoundChannel(found, channel)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if initial != nil {
+		return initial, nil
+	}
+	return <-found, nil
+}
+
+// sendFoundUser and sendFoundChannel pass the first match to the waiting
+// goroutine. Later matches, which can happen before the listener is detached,
+// are discarded.
+func sendFoundUser(found chan *gumble.User, user *gumble.User) {
+	select {
+	case found <- user:
+	default:
+	}
+}
+
+func sendFoundChannel(found chan *gumble.Channel, channel *gumble.Channel) {
+	select {
+	case found <- channel:
+	default:
+	}
+}
@@ -0,0 +1,106 @@
+package gumbleutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"layeh.com/gumble/gumble"
+	"layeh.com/gumble/gumbletest"
+)
+
+func TestWaitFor(t *testing.T) {
+	server, client := dialServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users := make(chan *gumble.User, 1)
+	go func() {
+		user, err := WaitForUser(ctx, client, func(user *gumble.User) bool {
+			return user.Channel != nil && user.Channel.Name == "Lobby"
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		users <- user
+	}()
+	channels := make(chan *gumble.Channel, 1)
+	go func() {
+		channel, err := WaitForChannel(ctx, client, func(channel *gumble.Channel) bool {
+			return channel.Name == "Lobby"
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		channels <- channel
+	}()
+
+	// Further matching events, which can happen before the listeners are
+	// detached, must not race with the result being returned.
+	time.Sleep(10 * time.Millisecond)
+	server.Send(gumbletest.ChannelState(1, 0, "Lobby"))
+	server.AddUser("Alice", 1)
+	server.AddUser("Bob", 1)
+	server.Send(gumbletest.ChannelState(2, 0, "Lobby"))
+
+	if user := <-users; user == nil || user.Channel.Name != "Lobby" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	if channel := <-channels; channel == nil || channel.Name != "Lobby" {
+		t.Errorf("unexpected channel: %+v", channel)
+	}
+}
+
+func TestWaitForExisting(t *testing.T) {
+	_, client := dialServer(t,
+		gumbletest.ChannelState(1, 0, "Lobby"),
+		gumbletest.UserState(5, "Alice", 1),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Users and channels that already exist are returned without waiting for
+	// an event.
+	user, err := WaitForUser(ctx, client, func(user *gumble.User) bool {
+		return user.Name == "Alice"
+	})
+	if err != nil || user == nil || user.Session != 5 {
+		t.Errorf("unexpected user: %+v, %v", user, err)
+	}
+	channel, err := WaitForChannel(ctx, client, func(channel *gumble.Channel) bool {
+		return channel.Name == "Lobby"
+	})
+	if err != nil || channel == nil || channel.ID != 1 {
+		t.Errorf("unexpected channel: %+v, %v", channel, err)
+	}
+}
+
+func TestWaitForCancel(t *testing.T) {
+	server, client := dialServer(t)
+	never := func(*gumble.User) bool { return false }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := WaitForUser(ctx, client, never); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := WaitForChannel(context.Background(), client, func(*gumble.Channel) bool { return false })
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	server.Disconnect()
+	select {
+	case err := <-errs:
+		if err != errDisconnected {
+			t.Errorf("expected errDisconnected, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForChannel did not return after disconnect")
+	}
+	if _, err := WaitForUser(context.Background(), client, never); err != errDisconnected {
+		t.Errorf("expected errDisconnected, got %v", err)
+	}
+}